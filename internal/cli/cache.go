@@ -0,0 +1,138 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+
+	sfs "github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+const (
+	defaultCacheMaxSize = "10g"
+
+	cacheDescription = `Manage the local cache of fetched commits used with --cache-dir.
+
+  list    list cached commits, most recently used first
+  prune   evict the least recently used commits until the cache fits in
+          --cache-max-size, and those unused for --older-than
+  verify  check the packfiles and objects of every cached commit, and remove
+          broken ones with --remove`
+	cacheUsage = `sfs cache <list|prune|verify> --cache-dir <dir> [flags]`
+)
+
+func AddCacheFlags(flagset *pflag.FlagSet) {
+	flagset.String("cache-dir", "", "directory of the cache")
+	flagset.String("cache-max-size", defaultCacheMaxSize, "size to prune the cache to (<n>[kmg], 0 for no limit)")
+	flagset.Duration("older-than", 0, "also prune commits not used for this long, like 720h")
+	flagset.Bool("remove", false, "remove cached commits that fail to verify")
+	flagset.BoolP("help", "h", false, "help for cache")
+}
+
+func runCache(args []string) {
+	cacheFlags := pflag.NewFlagSet("shallow-fetch-sha cache", pflag.ContinueOnError)
+	AddCacheFlags(cacheFlags)
+	cacheFlags.SortFlags = false
+	cacheFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s\nsee \"shallow-fetch-sha cache --help\" for more information\n", cacheUsage)
+	}
+
+	fail := func(err error) {
+		log.Errorln(err)
+		cacheFlags.Usage()
+		os.Exit(ExitUsage)
+	}
+
+	if err := cacheFlags.Parse(args); err != nil {
+		fail(err)
+	}
+
+	if help, _ := cacheFlags.GetBool("help"); help {
+		fmt.Fprintln(os.Stderr, cacheDescription)
+		fmt.Fprintf(os.Stderr, "\nUsage:\n  %s\n", cacheUsage)
+		fmt.Fprintf(os.Stderr, "\nFlags:\n%s", cacheFlags.FlagUsages())
+		os.Exit(0)
+	}
+
+	dir, _ := cacheFlags.GetString("cache-dir")
+	if dir == "" {
+		fail(&sfs.OptionError{Option: "cache-dir", Reason: "it is required"})
+	}
+	maxSize, err := cacheMaxSize(cacheFlags)
+	if err != nil {
+		fail(err)
+	}
+	c := &sfs.Cache{Dir: dir, MaxSize: maxSize}
+
+	if cacheFlags.NArg() != 1 {
+		fail(errors.New("must specify one of list, prune or verify"))
+	}
+
+	switch cacheFlags.Arg(0) {
+	case "list":
+		entries, err := c.List()
+		exit(err)
+		printCacheEntries(os.Stdout, entries)
+	case "prune":
+		olderThan, _ := cacheFlags.GetDuration("older-than")
+		removed, err := c.Prune(maxSize, olderThan)
+		for _, e := range removed {
+			log.WithFields(log.Fields{
+				"repo": e.Repo,
+				"sha":  e.SHA,
+			}).Info("pruned")
+		}
+		exit(err)
+	case "verify":
+		remove, _ := cacheFlags.GetBool("remove")
+		verifyCache(c, remove)
+	default:
+		fail(fmt.Errorf("unknown cache command %q, must be one of list, prune or verify", cacheFlags.Arg(0)))
+	}
+}
+
+// printCacheEntries writes a table of the cache entries.
+func printCacheEntries(w io.Writer, entries []*sfs.CacheEntry) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SHA\tDEPTH\tSIZE\tLAST USED\tREPO")
+
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", e.SHA, e.Depth, e.Size, e.LastUsed.Local().Format(time.RFC3339), e.Repo)
+	}
+
+	_ = tw.Flush()
+}
+
+// verifyCache verifies every entry of the cache, and exits with an error if
+// any were broken.
+func verifyCache(c *sfs.Cache, remove bool) {
+	entries, err := c.List()
+	exit(err)
+
+	broken := 0
+	for _, e := range entries {
+		fields := log.Fields{"repo": e.Repo, "sha": e.SHA}
+		if err := c.Verify(e); err != nil {
+			broken++
+			log.WithFields(fields).Errorln("broken:", err)
+
+			if remove {
+				if err := c.Remove(e); err != nil {
+					log.WithFields(fields).Errorln("unable to remove:", err)
+				}
+			}
+			continue
+		}
+		log.WithFields(fields).Info("ok")
+	}
+
+	if broken > 0 {
+		exit(fmt.Errorf("%d of %d cached commits are broken", broken, len(entries)))
+	}
+}
@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	sfs "github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+// Exit codes, one for each kind of error from the sfs package.
+const (
+	ExitFailure           = 1
+	ExitUsage             = 2
+	ExitAuth              = 3
+	ExitNotFound          = 4
+	ExitServerUnsupported = 5
+	ExitNetwork           = 6
+	ExitDirectoryNotEmpty = 7
+	// same as a shell's for SIGINT
+	ExitInterrupted = 130
+)
+
+var exitCodes = []struct {
+	err  error
+	code int
+	kind string
+}{
+	{context.Canceled, ExitInterrupted, "interrupted"},
+	{sfs.ErrValidation, ExitUsage, "validation"},
+	{sfs.ErrAuth, ExitAuth, "auth"},
+	{sfs.ErrNotFound, ExitNotFound, "not_found"},
+	{sfs.ErrServerUnsupported, ExitServerUnsupported, "server_unsupported"},
+	{sfs.ErrNetwork, ExitNetwork, "network"},
+	{sfs.ErrDirectoryNotEmpty, ExitDirectoryNotEmpty, "directory_not_empty"},
+}
+
+// ExitCode is the code to exit with for err, 0 when it is nil.
+func ExitCode(err error) int {
+	code, _ := classify(err)
+	return code
+}
+
+// classify is the exit code for err and the name of its kind, "unknown" for
+// errors of no kind.
+func classify(err error) (int, string) {
+	if err == nil {
+		return 0, ""
+	}
+
+	for _, e := range exitCodes {
+		if errors.Is(err, e.err) {
+			return e.code, e.kind
+		}
+	}
+	return ExitFailure, "unknown"
+}
+
+// exit logs the error of a run and exits with the code for it.
+func exit(err error) {
+	if err == nil {
+		return
+	}
+
+	log.Errorln(err)
+	os.Exit(ExitCode(err))
+}
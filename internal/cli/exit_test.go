@@ -0,0 +1,24 @@
+package cli_test
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/internal/cli"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+var _ = Describe("ExitCode", func() {
+	It("should exit with a code for each kind of error", func() {
+		Expect(cli.ExitCode(nil)).To(Equal(0))
+		Expect(cli.ExitCode(errors.New("something broke"))).To(Equal(cli.ExitFailure))
+		Expect(cli.ExitCode(&sfs.OptionError{Option: "depth", Reason: "must be at least 1"})).To(Equal(cli.ExitUsage))
+		Expect(cli.ExitCode(&sfs.Error{Op: sfs.OpAuth, Err: errors.New("bad key")})).To(Equal(cli.ExitAuth))
+		Expect(cli.ExitCode(&sfs.Error{Op: sfs.OpResolve, Err: transport.ErrRepositoryNotFound})).To(Equal(cli.ExitNotFound))
+		Expect(cli.ExitCode(&sfs.Error{Op: sfs.OpFetch, Err: context.DeadlineExceeded})).To(Equal(cli.ExitNetwork))
+		Expect(cli.ExitCode(&sfs.Error{Op: sfs.OpFetch, Err: context.Canceled})).To(Equal(cli.ExitInterrupted))
+	})
+})
@@ -0,0 +1,289 @@
+package cli
+
+import (
+	"github.com/spf13/pflag"
+
+	sfs "github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+// BindFlags sets the options from the flags added by AddFlags.
+func BindFlags(opts *sfs.Options, flags *pflag.FlagSet) error {
+	dir, err := flags.GetString("directory")
+	if err != nil {
+		return err
+	}
+	opts.Directory = dir
+
+	ifExists, err := flags.GetString("if-exists")
+	if err != nil {
+		return err
+	}
+	opts.IfExists = ifExists
+
+	keep, err := flags.GetBool("keep-on-failure")
+	if err != nil {
+		return err
+	}
+	opts.KeepOnFailure = keep
+
+	username, err := flags.GetString("username")
+	if err != nil {
+		return err
+	}
+	if username != "" {
+		if opts.BasicAuth == nil {
+			opts.BasicAuth = &sfs.BasicAuthOptions{}
+		}
+		opts.BasicAuth.Username = username
+	}
+
+	password, err := flags.GetString("password")
+	if err != nil {
+		return err
+	}
+	if password != "" {
+		if opts.BasicAuth == nil {
+			opts.BasicAuth = &sfs.BasicAuthOptions{}
+		}
+		opts.BasicAuth.Password = password
+	}
+
+	keyPath, err := flags.GetString("key-path")
+	if err != nil {
+		return err
+	}
+	if keyPath != "" {
+		if opts.SSHAuth == nil {
+			opts.SSHAuth = &sfs.SSHAuthOptions{}
+		}
+		opts.SSHAuth.PEMPath = keyPath
+	}
+
+	keyPhrase, err := flags.GetString("key-passphrase")
+	if err != nil {
+		return err
+	}
+	if keyPhrase != "" {
+		if opts.SSHAuth == nil {
+			opts.SSHAuth = &sfs.SSHAuthOptions{}
+		}
+		opts.SSHAuth.Passphrase = keyPhrase
+	}
+
+	keyCert, err := flags.GetString("key-cert")
+	if err != nil {
+		return err
+	}
+	if keyCert != "" {
+		if opts.SSHAuth == nil {
+			opts.SSHAuth = &sfs.SSHAuthOptions{}
+		}
+		opts.SSHAuth.CertPath = keyCert
+	}
+
+	sshAgent, err := flags.GetBool("ssh-agent")
+	if err != nil {
+		return err
+	}
+	if sshAgent {
+		if opts.SSHAuth == nil {
+			opts.SSHAuth = &sfs.SSHAuthOptions{}
+		}
+		opts.SSHAuth.Agent = true
+	}
+
+	agentKey, err := flags.GetString("agent-key")
+	if err != nil {
+		return err
+	}
+	if agentKey != "" {
+		if opts.SSHAuth == nil {
+			opts.SSHAuth = &sfs.SSHAuthOptions{}
+		}
+		opts.SSHAuth.AgentKey = agentKey
+	}
+
+	knownHosts, err := flags.GetStringArray("known-hosts")
+	if err != nil {
+		return err
+	}
+	if len(knownHosts) > 0 {
+		if opts.SSHAuth == nil {
+			opts.SSHAuth = &sfs.SSHAuthOptions{}
+		}
+		opts.SSHAuth.KnownHosts = knownHosts
+	}
+
+	fingerprints, err := flags.GetStringArray("host-key-fingerprint")
+	if err != nil {
+		return err
+	}
+	if len(fingerprints) > 0 {
+		if opts.SSHAuth == nil {
+			opts.SSHAuth = &sfs.SSHAuthOptions{}
+		}
+		opts.SSHAuth.HostKeyFingerprints = fingerprints
+	}
+
+	hostKeyPolicy, err := flags.GetString("host-key-policy")
+	if err != nil {
+		return err
+	}
+	if hostKeyPolicy != sfs.HostKeyStrict {
+		if opts.SSHAuth == nil {
+			opts.SSHAuth = &sfs.SSHAuthOptions{}
+		}
+		opts.SSHAuth.HostKeyPolicy = hostKeyPolicy
+	}
+
+	rmDotGit, err := flags.GetBool("rm-dotgit")
+	if err != nil {
+		return err
+	}
+	opts.RemoveDotGit = rmDotGit
+
+	expandSHA, err := flags.GetBool("expand-sha")
+	if err != nil {
+		return err
+	}
+	opts.ExpandSHA = expandSHA
+
+	fallbackDepth, err := flags.GetInt("fallback-depth")
+	if err != nil {
+		return err
+	}
+	opts.FallbackDepth = fallbackDepth
+
+	depth, err := flags.GetInt("depth")
+	if err != nil {
+		return err
+	}
+	opts.Depth = depth
+
+	deepen, err := flags.GetInt("deepen")
+	if err != nil {
+		return err
+	}
+	opts.Deepen = deepen
+
+	filter, err := flags.GetString("filter")
+	if err != nil {
+		return err
+	}
+	opts.Filter = filter
+
+	include, err := flags.GetStringArray("include")
+	if err != nil {
+		return err
+	}
+	opts.Include = include
+
+	exclude, err := flags.GetStringArray("exclude")
+	if err != nil {
+		return err
+	}
+	opts.Exclude = exclude
+
+	sparseFile, err := flags.GetString("sparse-file")
+	if err != nil {
+		return err
+	}
+	opts.SparseFile = sparseFile
+
+	recursive, err := flags.GetBool("recurse-submodules")
+	if err != nil {
+		return err
+	}
+	opts.Recursive = recursive
+
+	lfs, err := flags.GetBool("lfs")
+	if err != nil {
+		return err
+	}
+	opts.LFS = lfs
+
+	lfsInclude, err := flags.GetStringArray("lfs-include")
+	if err != nil {
+		return err
+	}
+	opts.LFSInclude = lfsInclude
+
+	lfsExclude, err := flags.GetStringArray("lfs-exclude")
+	if err != nil {
+		return err
+	}
+	opts.LFSExclude = lfsExclude
+
+	lfsMaxSize, err := flags.GetString("lfs-max-size")
+	if err != nil {
+		return err
+	}
+	if lfsMaxSize != "" {
+		if opts.LFSMaxSize, err = sfs.ParseSize(lfsMaxSize); err != nil {
+			return &sfs.OptionError{Option: "lfs-max-size", Reason: err.Error()}
+		}
+	}
+
+	archive, err := flags.GetString("archive")
+	if err != nil {
+		return err
+	}
+	opts.Archive = archive
+
+	format, err := flags.GetString("archive-format")
+	if err != nil {
+		return err
+	}
+	opts.ArchiveFormat = format
+
+	retries, err := flags.GetInt("retries")
+	if err != nil {
+		return err
+	}
+	opts.Retry.Retries = retries
+
+	backoff, err := flags.GetDuration("retry-backoff")
+	if err != nil {
+		return err
+	}
+	opts.Retry.Backoff = backoff
+
+	jitter, err := flags.GetFloat64("retry-jitter")
+	if err != nil {
+		return err
+	}
+	opts.Retry.Jitter = jitter
+
+	cacheDir, err := flags.GetString("cache-dir")
+	if err != nil {
+		return err
+	}
+	if cacheDir != "" {
+		maxSize, err := cacheMaxSize(flags)
+		if err != nil {
+			return err
+		}
+		opts.Cache = &sfs.Cache{Dir: cacheDir, MaxSize: maxSize}
+	}
+
+	objectStore, err := flags.GetString("object-store")
+	if err != nil {
+		return err
+	}
+	opts.ObjectStore = objectStore
+
+	return nil
+}
+
+func cacheMaxSize(flags *pflag.FlagSet) (int64, error) {
+	s, err := flags.GetString("cache-max-size")
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := sfs.ParseSize(s)
+	if err != nil {
+		return 0, &sfs.OptionError{Option: "cache-max-size", Reason: err.Error()}
+	}
+	return size, nil
+}
@@ -0,0 +1,263 @@
+package cli_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/internal/cli"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+
+	flag "github.com/spf13/pflag"
+)
+
+var _ = Describe("BindFlags", func() {
+	var (
+		options    sfs.Options
+		dummyFlags *flag.FlagSet
+	)
+
+	BeforeEach(func() {
+		options = sfs.Options{}
+		dummyFlags = flag.NewFlagSet("dummyflags", flag.ContinueOnError)
+		cli.AddFlags(dummyFlags)
+	})
+
+	It("should bind directory flag", func() {
+		directory := "./foo/bar"
+		_ = dummyFlags.Set("directory", directory)
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.Directory).To(Equal(directory))
+	})
+
+	It("should bind username flag", func() {
+		username := "bob"
+		_ = dummyFlags.Set("username", username)
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.BasicAuth.Username).To(Equal(username))
+	})
+
+	It("should bind password flag", func() {
+		password := "notpassword"
+		_ = dummyFlags.Set("password", password)
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.BasicAuth.Password).To(Equal(password))
+	})
+
+	It("should bind key-path flag", func() {
+		keypath := "/my/key.pem"
+		_ = dummyFlags.Set("key-path", keypath)
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.SSHAuth.PEMPath).To(Equal(keypath))
+	})
+
+	It("should bind key-passphrase flag", func() {
+		passphrase := "foo-bar-baz"
+		_ = dummyFlags.Set("key-passphrase", passphrase)
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.SSHAuth.Passphrase).To(Equal(passphrase))
+	})
+
+	It("should bind key-cert flag", func() {
+		_ = dummyFlags.Set("key-cert", "/my/key-cert.pub")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.SSHAuth.CertPath).To(Equal("/my/key-cert.pub"))
+	})
+
+	It("should bind ssh-agent flag", func() {
+		_ = dummyFlags.Set("ssh-agent", "true")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.SSHAuth.Agent).To(Equal(true))
+	})
+
+	It("should bind agent-key flag", func() {
+		_ = dummyFlags.Set("agent-key", "work")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.SSHAuth.AgentKey).To(Equal("work"))
+	})
+
+	It("should bind known-hosts flag", func() {
+		_ = dummyFlags.Set("known-hosts", "/etc/sfs/known_hosts")
+		_ = dummyFlags.Set("known-hosts", "/etc/ssh/ssh_known_hosts")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.SSHAuth.KnownHosts).To(Equal([]string{"/etc/sfs/known_hosts", "/etc/ssh/ssh_known_hosts"}))
+	})
+
+	It("should bind host-key-fingerprint flag", func() {
+		fingerprint := "SHA256:p2QAMXNIC1TJYWeIOttrVc98/R1BUFWu3/LiyKgUfQM"
+		_ = dummyFlags.Set("host-key-fingerprint", fingerprint)
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.SSHAuth.HostKeyFingerprints).To(Equal([]string{fingerprint}))
+	})
+
+	It("should bind host-key-policy flag", func() {
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.SSHAuth).To(BeNil())
+
+		_ = dummyFlags.Set("host-key-policy", sfs.HostKeyTOFU)
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.SSHAuth.HostKeyPolicy).To(Equal(sfs.HostKeyTOFU))
+	})
+
+	It("should bind expand-sha flag", func() {
+		_ = dummyFlags.Set("expand-sha", "true")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.ExpandSHA).To(Equal(true))
+	})
+
+	It("should bind fallback-depth flag", func() {
+		_ = dummyFlags.Set("fallback-depth", "32")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.FallbackDepth).To(Equal(32))
+	})
+
+	It("should bind depth flag", func() {
+		_ = dummyFlags.Set("depth", "5")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.Depth).To(Equal(5))
+	})
+
+	It("should bind deepen flag", func() {
+		_ = dummyFlags.Set("deepen", "3")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.Deepen).To(Equal(3))
+	})
+
+	It("should bind filter flag", func() {
+		_ = dummyFlags.Set("filter", "blob:none")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.Filter).To(Equal("blob:none"))
+	})
+
+	It("should bind include and exclude flags", func() {
+		_ = dummyFlags.Set("include", "deploy/")
+		_ = dummyFlags.Set("include", "*.md")
+		_ = dummyFlags.Set("exclude", "deploy/secrets/")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.Include).To(Equal([]string{"deploy/", "*.md"}))
+		Expect(options.Exclude).To(Equal([]string{"deploy/secrets/"}))
+	})
+
+	It("should bind sparse-file flag", func() {
+		_ = dummyFlags.Set("sparse-file", "./sparse-checkout")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.SparseFile).To(Equal("./sparse-checkout"))
+	})
+
+	It("should bind recurse-submodules flag", func() {
+		_ = dummyFlags.Set("recurse-submodules", "true")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.Recursive).To(BeTrue())
+	})
+
+	It("should bind lfs flags", func() {
+		_ = dummyFlags.Set("lfs", "true")
+		_ = dummyFlags.Set("lfs-include", "assets/")
+		_ = dummyFlags.Set("lfs-exclude", "*.mov")
+		_ = dummyFlags.Set("lfs-max-size", "10m")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.LFS).To(BeTrue())
+		Expect(options.LFSInclude).To(Equal([]string{"assets/"}))
+		Expect(options.LFSExclude).To(Equal([]string{"*.mov"}))
+		Expect(options.LFSMaxSize).To(Equal(int64(10 << 20)))
+	})
+
+	It("should fail to bind an invalid lfs-max-size flag", func() {
+		_ = dummyFlags.Set("lfs-max-size", "10t")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(Not(BeNil()))
+	})
+
+	It("should bind archive flags", func() {
+		_ = dummyFlags.Set("archive", "-")
+		_ = dummyFlags.Set("archive-format", "zip")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.Archive).To(Equal("-"))
+		Expect(options.ArchiveFormat).To(Equal("zip"))
+	})
+
+	It("should bind retry flags", func() {
+		_ = dummyFlags.Set("retries", "3")
+		_ = dummyFlags.Set("retry-backoff", "500ms")
+		_ = dummyFlags.Set("retry-jitter", "0.5")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.Retry.Retries).To(Equal(3))
+		Expect(options.Retry.Backoff).To(Equal(500 * time.Millisecond))
+		Expect(options.Retry.Jitter).To(Equal(0.5))
+	})
+
+	It("should bind cache flags", func() {
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.Cache).To(BeNil())
+
+		_ = dummyFlags.Set("cache-dir", "/var/cache/sfs")
+		_ = dummyFlags.Set("cache-max-size", "2g")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.Cache).To(Equal(&sfs.Cache{Dir: "/var/cache/sfs", MaxSize: 2 << 30}))
+
+		_ = dummyFlags.Set("cache-max-size", "lots")
+		Expect(cli.BindFlags(&options, dummyFlags)).To(MatchError(ContainSubstring("cache-max-size")))
+	})
+
+	It("should bind object store flag", func() {
+		_ = dummyFlags.Set("object-store", "/var/lib/sfs")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.ObjectStore).To(Equal("/var/lib/sfs"))
+	})
+
+	It("should bind if-exists flag", func() {
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.IfExists).To(Equal(sfs.IfExistsFail))
+
+		_ = dummyFlags.Set("if-exists", "merge")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.IfExists).To(Equal(sfs.IfExistsMerge))
+	})
+
+	It("should bind keep-on-failure flag", func() {
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.KeepOnFailure).To(Equal(false))
+
+		_ = dummyFlags.Set("keep-on-failure", "true")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.KeepOnFailure).To(Equal(true))
+	})
+
+	It("should bind rm-dotgit flag", func() {
+		_ = dummyFlags.Set("rm-dotgit", "true")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.RemoveDotGit).To(Equal(true))
+
+		_ = dummyFlags.Set("rm-dotgit", "false")
+
+		Expect(cli.BindFlags(&options, dummyFlags)).To(BeNil())
+		Expect(options.RemoveDotGit).To(Equal(false))
+	})
+})
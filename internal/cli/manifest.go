@@ -0,0 +1,116 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	sfs "github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+func runManifest() {
+	if len(flags.Args()) != 0 {
+		failWithUsage(errors.New("repo and sha arguments cannot be used with a manifest"))
+	}
+
+	m, err := sfs.LoadManifest(manifest)
+	if err != nil {
+		failWithUsage(err)
+	}
+
+	var results []sfs.ManifestResult
+	err = runContext(timeout, func(ctx context.Context) error {
+		var err error
+		results, err = sfs.FetchManifestContext(ctx, m, *opts, jobs)
+		return err
+	}, func(err error) {
+		if output != outputJSON {
+			return
+		}
+		// results are still being written, every entry gets the error
+		abandoned := make([]sfs.ManifestResult, 0, len(m.Repos))
+		for _, e := range m.Repos {
+			abandoned = append(abandoned, sfs.ManifestResult{
+				Entry:  e,
+				Err:    err,
+				Result: &sfs.Result{Repo: e.Repo, SHA: e.SHA, Directory: filepath.Join(opts.Directory, e.Directory)},
+			})
+		}
+		if err := writeManifestJSON(os.Stdout, abandoned); err != nil {
+			log.Errorln("unable to write results:", err)
+		}
+	})
+	if err != nil {
+		failWithUsage(err)
+	}
+
+	var failed int
+	if output == outputJSON {
+		for _, r := range results {
+			if r.Err != nil {
+				failed++
+			}
+		}
+		if err := writeManifestJSON(os.Stdout, results); err != nil {
+			log.Errorln("unable to write results:", err)
+		}
+	} else {
+		failed = printSummary(os.Stdout, results)
+	}
+	if failed == 0 {
+		return
+	}
+
+	log.Errorf("%d of %d repos failed to fetch", failed, len(results))
+	os.Exit(manifestExitCode(results))
+}
+
+// manifestExitCode is the exit code for the failed entries of a manifest: the
+// one they all have in common, or ExitFailure when they failed differently.
+// Being interrupted takes precedence over everything else.
+func manifestExitCode(results []sfs.ManifestResult) int {
+	code := 0
+	for _, r := range results {
+		c := ExitCode(r.Err)
+		switch {
+		case c == 0:
+		case c == ExitInterrupted:
+			return ExitInterrupted
+		case code == 0:
+			code = c
+		case code != c:
+			code = ExitFailure
+		}
+	}
+	return code
+}
+
+// printSummary writes a table with the outcome of every manifest entry and
+// returns how many failed.
+func printSummary(w io.Writer, results []sfs.ManifestResult) int {
+	failed := 0
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tDIRECTORY\tREPO\tSHA\tDURATION\tERROR")
+
+	for _, r := range results {
+		status := "ok"
+		errMsg := ""
+		if r.Err != nil {
+			failed++
+			status = "failed"
+			errMsg = r.Err.Error()
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", status, r.Entry.Directory, r.Entry.Repo, r.SHA, r.Duration.Round(time.Millisecond), errMsg)
+	}
+
+	_ = tw.Flush()
+	return failed
+}
@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	sfs "github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+type jsonResult struct {
+	Repo        string           `json:"repo"`
+	SHA         string           `json:"sha"`
+	Directory   string           `json:"directory,omitempty"`
+	Archive     string           `json:"archive,omitempty"`
+	Commit      *jsonCommit      `json:"commit"`
+	Cached      bool             `json:"cached"`
+	Transfer    jsonTransfer     `json:"transfer"`
+	DurationsMS map[string]int64 `json:"durations_ms"`
+	DurationMS  int64            `json:"duration_ms"`
+	Error       *jsonError       `json:"error"`
+}
+
+type jsonSignature struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Date  time.Time `json:"date"`
+}
+
+type jsonCommit struct {
+	Author    jsonSignature `json:"author"`
+	Committer jsonSignature `json:"committer"`
+	Message   string        `json:"message"`
+	Tree      string        `json:"tree"`
+}
+
+type jsonTransfer struct {
+	Bytes   int64       `json:"bytes"`
+	Objects jsonObjects `json:"objects"`
+}
+
+type jsonObjects struct {
+	Commits int `json:"commits"`
+	Trees   int `json:"trees"`
+	Blobs   int `json:"blobs"`
+	Tags    int `json:"tags"`
+	Total   int `json:"total"`
+}
+
+type jsonError struct {
+	Message  string `json:"message"`
+	Kind     string `json:"kind"`
+	Op       string `json:"op,omitempty"`
+	ExitCode int    `json:"exit_code"`
+}
+
+func signature(s object.Signature) jsonSignature {
+	return jsonSignature{Name: s.Name, Email: s.Email, Date: s.When}
+}
+
+// newJSONResult is the json output for the result of a fetch and its error.
+// res can be nil when the fetch never started.
+func newJSONResult(res *sfs.Result, err error) jsonResult {
+	out := jsonResult{DurationsMS: map[string]int64{}}
+
+	if res != nil {
+		out.Repo = res.Repo
+		out.SHA = res.SHA
+		out.Directory = res.Directory
+		out.Archive = res.Archive
+		out.Cached = res.Cached
+		out.Transfer = jsonTransfer{
+			Bytes: res.Bytes,
+			Objects: jsonObjects{
+				Commits: res.Objects.Commits,
+				Trees:   res.Objects.Trees,
+				Blobs:   res.Objects.Blobs,
+				Tags:    res.Objects.Tags,
+				Total:   res.Objects.Total(),
+			},
+		}
+		for op, d := range res.Durations {
+			out.DurationsMS[op] = d.Milliseconds()
+		}
+		out.DurationMS = res.Duration.Milliseconds()
+
+		if c := res.Commit; c != nil {
+			out.Commit = &jsonCommit{
+				Author:    signature(c.Author),
+				Committer: signature(c.Committer),
+				Message:   c.Message,
+				Tree:      c.Tree,
+			}
+		}
+	}
+
+	if err != nil {
+		code, kind := classify(err)
+		out.Error = &jsonError{Message: err.Error(), Kind: kind, ExitCode: code}
+
+		var fetchErr *sfs.Error
+		if errors.As(err, &fetchErr) {
+			out.Error.Op = fetchErr.Op
+		}
+	}
+
+	return out
+}
+
+// WriteJSON writes the result of a fetch and its error as json.
+func WriteJSON(w io.Writer, res *sfs.Result, err error) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(newJSONResult(res, err))
+}
+
+// writeManifestJSON writes the results of a manifest as a json array, in the
+// same format as WriteJSON.
+func writeManifestJSON(w io.Writer, results []sfs.ManifestResult) error {
+	out := make([]jsonResult, 0, len(results))
+	for _, r := range results {
+		out = append(out, newJSONResult(r.Result, r.Err))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
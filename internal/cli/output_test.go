@@ -0,0 +1,70 @@
+package cli_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/internal/cli"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+var _ = Describe("WriteJSON", func() {
+	decode := func(res *sfs.Result, err error) map[string]interface{} {
+		var buf bytes.Buffer
+		Expect(cli.WriteJSON(&buf, res, err)).To(BeNil())
+
+		var out map[string]interface{}
+		Expect(json.Unmarshal(buf.Bytes(), &out)).To(BeNil())
+		return out
+	}
+
+	It("should write a successful result", func() {
+		when := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+		out := decode(&sfs.Result{
+			Repo:      "https://github.com/org/app.git",
+			SHA:       "0f8b47384ea4cb9e58c7f3057ee17556b3e2a3e1",
+			Directory: "./app",
+			Commit: &sfs.CommitInfo{
+				Author:    object.Signature{Name: "a", Email: "a@example.com", When: when},
+				Committer: object.Signature{Name: "c", Email: "c@example.com", When: when},
+				Message:   "initial commit\n",
+				Tree:      "8608247007f22febdccea8ab65de115d08c28777",
+			},
+			Bytes:     436,
+			Objects:   sfs.ObjectCounts{Commits: 1, Trees: 3, Blobs: 4},
+			Durations: map[string]time.Duration{sfs.OpFetch: 1500 * time.Millisecond},
+			Duration:  2 * time.Second,
+		}, nil)
+
+		Expect(out["sha"]).To(Equal("0f8b47384ea4cb9e58c7f3057ee17556b3e2a3e1"))
+		Expect(out["error"]).To(BeNil())
+		Expect(out["duration_ms"]).To(BeEquivalentTo(2000))
+		Expect(out["durations_ms"]).To(HaveKeyWithValue("fetch", BeEquivalentTo(1500)))
+
+		commit := out["commit"].(map[string]interface{})
+		Expect(commit["message"]).To(Equal("initial commit\n"))
+		Expect(commit["author"]).To(HaveKeyWithValue("date", "2022-01-02T03:04:05Z"))
+
+		transfer := out["transfer"].(map[string]interface{})
+		Expect(transfer["bytes"]).To(BeEquivalentTo(436))
+		Expect(transfer["objects"]).To(HaveKeyWithValue("total", BeEquivalentTo(8)))
+	})
+
+	It("should write the error with its kind and exit code", func() {
+		out := decode(&sfs.Result{Repo: "https://github.com/org/app.git"}, &sfs.Error{Op: sfs.OpResolve, Err: transport.ErrRepositoryNotFound})
+		Expect(out["commit"]).To(BeNil())
+		Expect(out["error"]).To(HaveKeyWithValue("kind", "not_found"))
+		Expect(out["error"]).To(HaveKeyWithValue("op", "resolve"))
+		Expect(out["error"]).To(HaveKeyWithValue("exit_code", BeEquivalentTo(cli.ExitNotFound)))
+
+		out = decode(nil, errors.New("something broke"))
+		Expect(out["repo"]).To(Equal(""))
+		Expect(out["error"]).To(HaveKeyWithValue("kind", "unknown"))
+	})
+})
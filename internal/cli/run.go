@@ -1,22 +1,29 @@
 package cli
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 
-	sfs "github.com/robherley/shallow-fetch-sha/internal/sfs"
+	sfs "github.com/robherley/shallow-fetch-sha/pkg/sfs"
 )
 
 var (
-	opts    = &sfs.Options{}
-	flags   = pflag.NewFlagSet("shallow-fetch-sha", pflag.ContinueOnError)
-	silent  bool
-	verbose bool
-	help    bool
+	opts     = &sfs.Options{}
+	flags    = pflag.NewFlagSet("shallow-fetch-sha", pflag.ContinueOnError)
+	manifest string
+	jobs     int
+	timeout  time.Duration
+	output   string
+	silent   bool
+	verbose  bool
+	help     bool
 )
 
 const (
@@ -24,14 +31,92 @@ const (
 to save time and networking traffic. The resulting directory will not have any
 ref/object history beyond the specified commit sha.
 
-The repository can be specified as either SSH or HTTPS, but the commit must be
-the 40 digit hexadecimal SHA1 representation. Both SSH and Basic authentication
-are supported, granted the proper repository URLs are specified. This program
-does not honor git-config files or options.
+The repository can be specified as either SSH or HTTPS. The commit can be the
+40 digit hexadecimal SHA1 representation, or a ref (HEAD, refs/heads/main, or a
+bare branch/tag name) that is resolved against the remote's advertised refs.
+With --expand-sha, an abbreviated SHA1 is expanded by matching it against the
+last 50 commits of each branch and tag, and fails when more than one matches.
+Both SSH and Basic authentication are supported, granted the proper repository
+URLs are specified. This program does not honor git-config files or options.
+SSH keys come from --key-path, or with --ssh-agent from the running ssh-agent,
+where --agent-key picks one by fingerprint or comment, and sign with the user
+certificate of --key-cert, if any. SSH host keys are verified with known_hosts,
+or --known-hosts files, including host certificates of a @cert-authority, unless
+pinned with --host-key-fingerprint; --host-key-policy tofu adds unknown hosts on
+first use.
 
-Note: this is only compatible with Git servers >= 2.50, they must support and
-enable the 'uploadpack.allowReachableSHA1InWant' configuration option.`
-	usage = "sfs <repo> <sha> [flags]"
+Note: fetching is fastest with Git servers >= 2.50 that support and enable the
+'uploadpack.allowReachableSHA1InWant' configuration option. Otherwise, the
+advertised branches and tags are fetched with increasing depth (up to
+--fallback-depth) until the commit is found, then pruned to that commit.
+
+If the directory already has a checkout made by this program from the same
+remote, it is updated instead: only the new commit is fetched and checked out,
+files it doesn't have are removed and the old commit is pruned. Any other
+directory must be empty, unless --if-exists is clean, to replace everything in
+it, or merge, to check out over it and keep the files the commit doesn't
+have. A checkout with local changes, or with files it didn't check out, is
+left alone unless --if-exists is clean, which discards them, or merge, which
+keeps the files it didn't check out. The filesystem root and the home
+directory, or any directory above it, are never used.
+
+With --manifest, every repo listed in a YAML or JSON manifest is fetched in
+parallel into its directory (relative to --directory), followed by a summary.
+
+With --include, --exclude or --sparse-file, only the matching paths are checked
+out and the directory is set up as a git sparse checkout. Combined with --filter,
+only the blobs of those paths are fetched.
+
+With --recurse-submodules, each submodule in .gitmodules is shallow fetched at
+the exact sha pinned by its gitlink, using the same auth. Relative submodule
+urls are resolved against the repository url.
+
+With --lfs, git-lfs pointer files in the checkout are replaced with their
+content, downloaded from the remote's lfs server with the same credentials.
+
+With --archive, the files at the commit are written straight from the fetched
+objects to an archive, without a worktree. Paths with the export-ignore
+attribute in .gitattributes are left out.
+
+With --retries, network operations that fail with a transient error (a reset
+or timed out connection, or a 5xx response) are retried with exponential
+backoff, starting from an empty repository each time. Errors like failing to
+authenticate or a missing commit fail right away.
+
+With --cache-dir, commits fetched by sha are stored in a local cache and served
+from it the next time, without network access. Refs are still resolved against
+the remote. Once the cache is larger than --cache-max-size, the least recently
+used commits are evicted. See "sfs cache --help" to list, prune and verify it.
+
+With --object-store, every fetch of a remote goes into one bare repository per
+remote in that directory, so fetching another commit of it only transfers the
+objects that are missing. Checkouts read objects from the store through
+.git/objects/info/alternates, like git clone --reference, and break if it is
+removed, unless --rm-dotgit is used. Concurrent fetches take turns with a lock.
+
+With --output json, a single result object is written to stdout when done, on
+success or failure: the repo, resolved sha, directory, commit metadata, bytes and
+objects transferred, how long each step took and the error with its exit code.
+In manifest mode it is an array with one object per repo. Logs stay on stderr.
+
+The checkout is made in a staging directory next to the directory, which is
+only swapped into place once it is done. A fetch that fails, or is stopped by
+--timeout, SIGINT or SIGTERM, leaves the directory as it was: the staging
+directory, and any parent directories created for it, are removed, unless
+--keep-on-failure is used to debug it.
+
+Exit codes: 1 for an unexpected error, 2 for invalid usage, 3 for failing to
+authenticate, 4 for a repository, ref or commit that doesn't exist, 5 for
+something the server doesn't support, 6 for a network error or timeout, 7 for
+a directory that isn't empty, has a repository of another remote or local
+changes and 130 when interrupted.
+
+With --deepen, the history of an existing checkout made by this program (in
+--directory) is extended by that many commits, without fetching from scratch.`
+	usage = `sfs <repo> <sha|ref> [flags]
+  sfs --manifest <file> [flags]
+  sfs --deepen <n> [flags]
+  sfs cache <list|prune|verify> --cache-dir <dir> [flags]`
 )
 
 func helpme() {
@@ -43,23 +128,68 @@ func helpme() {
 
 func failWithUsage(err error) {
 	log.Errorln(err)
-	flags.Usage()
-	os.Exit(1)
+	if output == outputJSON {
+		if !errors.Is(err, sfs.ErrValidation) {
+			err = &sfs.OptionError{Reason: err.Error()}
+		}
+		_ = WriteJSON(os.Stdout, nil, err)
+	} else {
+		flags.Usage()
+	}
+	os.Exit(ExitUsage)
 }
 
 func AddFlags(flagset *pflag.FlagSet) {
 	flagset.StringP("directory", "d", ".", "working directory for the repository")
+	flagset.String("if-exists", sfs.IfExistsFail, "what to do with a directory that has files and no checkout of the repo to update: fail, clean or merge")
+	flagset.Bool("keep-on-failure", false, "keep the staging directory of a failed fetch, or the repository of a failed archive, to debug it")
 	flagset.StringP("username", "u", "", "username for basic authentication")
 	flagset.StringP("password", "p", "", "password for basic authentication")
 	flagset.StringP("key-path", "i", "", "pem encoded private key file for ssh authentication")
 	flagset.StringP("key-passphrase", "P", "", "private key passphrase for ssh authentication")
+	flagset.String("key-cert", "", "OpenSSH user certificate for the ssh key, default <key-path>-cert.pub when it exists")
+	flagset.Bool("ssh-agent", false, "authenticate to ssh repositories with the keys of the running ssh-agent (SSH_AUTH_SOCK)")
+	flagset.String("agent-key", "", "only use the ssh-agent key with this fingerprint (SHA256:...) or comment, implies --ssh-agent")
+	flagset.StringArray("known-hosts", nil, "known_hosts file to verify ssh host keys with, instead of ~/.ssh/known_hosts and /etc/ssh/ssh_known_hosts (repeatable)")
+	flagset.StringArray("host-key-fingerprint", nil, "only accept an ssh host key with this fingerprint (SHA256:...), instead of known_hosts (repeatable)")
+	flagset.String("host-key-policy", sfs.HostKeyStrict, "how to verify ssh host keys not in known_hosts: strict, tofu to trust and add them on first use, or insecure-ignore-host-key")
 	flagset.BoolP("rm-dotgit", "D", false, "remove the '.git' directory after pulling files")
+	flagset.Int("depth", 1, "number of commits of history to fetch")
+	flagset.Int("deepen", 0, "fetch this many more commits of history for an existing checkout")
+	flagset.String("filter", "", "partial clone filter (blob:none, blob:limit=<n>[kmg], tree:<depth>), http(s) only, go-git can't send one over ssh")
+	flagset.StringArray("include", nil, "only check out paths matching this gitignore-style pattern (repeatable)")
+	flagset.StringArray("exclude", nil, "don't check out paths matching this gitignore-style pattern (repeatable)")
+	flagset.String("sparse-file", "", "file of sparse-checkout patterns, in the same format as .git/info/sparse-checkout")
+	flagset.BoolP("recurse-submodules", "r", false, "shallow fetch submodules at the shas pinned by the commit, recursively")
+	flagset.Bool("lfs", false, "replace git-lfs pointer files with their content from the remote's lfs server")
+	flagset.StringArray("lfs-include", nil, "only fetch lfs objects for paths matching this gitignore-style pattern (repeatable)")
+	flagset.StringArray("lfs-exclude", nil, "don't fetch lfs objects for paths matching this gitignore-style pattern (repeatable)")
+	flagset.String("lfs-max-size", "", "leave pointers for lfs objects larger than this size (<n>[kmg])")
+	flagset.StringP("archive", "a", "", "write the commit's files to a .tar, .tar.gz, .tgz or .zip archive (or - for stdout) instead of a directory")
+	flagset.String("archive-format", "", "archive format (tar, tar.gz or zip), instead of going by the archive's extension")
+	flagset.BoolP("expand-sha", "x", false, "expand an abbreviated sha against the recent history of the remote's refs")
+	flagset.Int("fallback-depth", sfs.DefaultFallbackDepth, "max depth to search advertised refs when the server can't fetch by sha (0 to disable)")
+	flagset.Int("retries", 0, "retry network operations that fail with a transient error this many times")
+	flagset.Duration("retry-backoff", sfs.DefaultRetryBackoff, "wait before the first retry, doubled for each one after it")
+	flagset.Float64("retry-jitter", sfs.DefaultRetryJitter, "randomly spread retry waits by this fraction of the wait (0 to 1)")
+	flagset.String("cache-dir", "", "serve commits fetched before from a local cache in this directory, and cache new ones")
+	flagset.String("cache-max-size", defaultCacheMaxSize, "evict the least recently used commits once the cache is larger than this (<n>[kmg], 0 for no limit)")
+	flagset.String("object-store", "", "fetch into a bare repository per remote in this directory, shared with other fetches of it, and link checkouts to it")
+	flagset.DurationVar(&timeout, "timeout", 0, "give up after this long, like 30s or 5m (0 for no timeout)")
+	flagset.StringVarP(&output, "output", "o", outputText, "output format: text, or json for a result object on stdout")
+	flagset.StringVarP(&manifest, "manifest", "m", "", "yaml or json manifest of repos to fetch instead of <repo> <sha|ref>")
+	flagset.IntVarP(&jobs, "jobs", "j", 4, "max number of concurrent fetches in manifest mode")
 	flagset.BoolVarP(&silent, "silent", "s", false, "silent output (takes precedence over verbose)")
 	flagset.BoolVarP(&verbose, "verbose", "v", false, "verbose output")
 	flagset.BoolVarP(&help, "help", "h", false, "help for shallow-fetch-sha")
 }
 
 func Run() {
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		runCache(os.Args[2:])
+		return
+	}
+
 	AddFlags(flags)
 
 	flags.SortFlags = false
@@ -84,19 +214,74 @@ func Run() {
 		helpme()
 	}
 
-	if err := opts.BindArgs(flags.Args()); err != nil {
+	if err := BindFlags(opts, flags); err != nil {
 		failWithUsage(err)
 	}
 
-	if err := opts.BindFlags(flags); err != nil {
-		failWithUsage(err)
+	if output != outputText && output != outputJSON {
+		failWithUsage(&sfs.OptionError{Option: "output", Reason: "must be text or json"})
+	}
+	if output == outputJSON && opts.Archive == "-" {
+		failWithUsage(&sfs.OptionError{Reason: "json output and archiving to stdout both write to stdout"})
 	}
 
-	if err := opts.Validate(); err != nil {
-		failWithUsage(err)
+	if manifest != "" {
+		runManifest()
+		return
 	}
 
-	if err := sfs.ShallowFetchSHA(opts); err != nil {
-		log.Fatalln(err)
+	fetcher := sfs.New(sfs.WithOptions(*opts))
+	args := flags.Args()
+	var res *sfs.Result
+	var run func(ctx context.Context) error
+
+	switch {
+	case opts.Deepen > 0:
+		if len(args) != 0 {
+			failWithUsage(errors.New("repo and sha arguments cannot be used when deepening"))
+		}
+		run = func(ctx context.Context) (err error) {
+			res, err = fetcher.DeepenResult(ctx, opts.Directory, opts.Deepen)
+			return err
+		}
+	case len(args) != 2:
+		failWithUsage(errors.New("missing arguments: must specify both repo and sha (or ref) arguments"))
+	case opts.Archive != "":
+		run = func(ctx context.Context) (err error) {
+			res, err = fetcher.ArchiveResult(ctx, args[0], args[1], opts.Archive)
+			return err
+		}
+	default:
+		run = func(ctx context.Context) (err error) {
+			res, err = fetcher.FetchResult(ctx, args[0], args[1], opts.Directory)
+			return err
+		}
 	}
+
+	writeResult := func(res *sfs.Result, err error) {
+		if werr := WriteJSON(os.Stdout, res, err); werr != nil {
+			log.Errorln("unable to write result:", werr)
+		}
+	}
+	err := runContext(timeout, run, func(err error) {
+		if output == outputJSON {
+			// res belongs to the fetch still running, only what it was asked for is known
+			abandoned := &sfs.Result{Directory: opts.Directory, Archive: opts.Archive}
+			if len(args) == 2 {
+				abandoned.Repo = args[0]
+			}
+			writeResult(abandoned, err)
+		}
+	})
+	if output == outputJSON {
+		writeResult(res, err)
+		exit(err)
+		return
+	}
+
+	if errors.Is(err, sfs.ErrValidation) {
+		failWithUsage(err)
+	}
+
+	exit(err)
 }
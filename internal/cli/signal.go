@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	sfs "github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+const (
+	// how long a canceled fetch gets to stop and clean up before exiting anyway
+	stopGracePeriod = 10 * time.Second
+)
+
+// runContext calls fn with a context that is canceled on SIGINT or SIGTERM, or
+// once the timeout passes. Once canceled, fn gets stopGracePeriod to return and
+// clean up. If it's still stuck after that, what its fetches staged is rolled
+// back, abandon is called with the context's error, for the output fn would
+// have written, and the process exits without waiting any longer, so
+// runContext doesn't return.
+func runContext(timeout time.Duration, fn func(ctx context.Context) error, abandon func(err error)) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	// a second signal is handled as usual, killing the process right away
+	stop()
+	if errors.Is(ctx.Err(), context.Canceled) {
+		log.Warnln("interrupted, stopping")
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(stopGracePeriod):
+		log.Errorf("did not stop within %s", stopGracePeriod)
+		sfs.RollbackStaging()
+		abandon(ctx.Err())
+		exit(ctx.Err())
+		return nil
+	}
+}
@@ -0,0 +1,114 @@
+package sfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	sshagent "github.com/xanzy/ssh-agent"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshAgentAuth authenticates as user with the keys of the running ssh-agent,
+// or only the ones matching key, by fingerprint or comment, when it's set.
+// With the certificate at certPath, only its key is used, with it. The keys
+// sign through the connection to the agent, which is returned to be closed
+// once they're done being used.
+func sshAgentAuth(user, key, certPath string) (*gitssh.PublicKeysCallback, io.Closer, error) {
+	if !sshagent.Available() {
+		return nil, nil, errors.New("no ssh-agent to use, SSH_AUTH_SOCK isn't set")
+	}
+
+	ag, conn, err := sshagent.New()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to connect to ssh-agent: %s", err)
+	}
+
+	signers, err := agentSigners(ag, key)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	if certPath != "" {
+		cert, err := loadCertificate(certPath)
+		if err != nil {
+			_ = conn.Close()
+			return nil, nil, err
+		}
+		signer, err := certSigner(certPath, cert, signers)
+		if err != nil {
+			_ = conn.Close()
+			return nil, nil, err
+		}
+		signers = []cryptossh.Signer{signer}
+	}
+
+	return &gitssh.PublicKeysCallback{
+		User: user,
+		Callback: func() ([]cryptossh.Signer, error) {
+			return signers, nil
+		},
+	}, conn, nil
+}
+
+// agentSigners returns the signers of the keys in ag matching key, all of
+// them if it's empty.
+func agentSigners(ag agent.Agent, key string) ([]cryptossh.Signer, error) {
+	keys, err := ag.List()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list ssh-agent keys: %s", err)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("ssh-agent has no keys, add one with ssh-add")
+	}
+
+	signers, err := ag.Signers()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ssh-agent keys: %s", err)
+	}
+	if key == "" {
+		return signers, nil
+	}
+
+	var selected []cryptossh.Signer
+	for _, k := range keys {
+		if !MatchAgentKey(k, key) {
+			continue
+		}
+		for _, s := range signers {
+			if bytes.Equal(s.PublicKey().Marshal(), k.Marshal()) {
+				selected = append(selected, s)
+			}
+		}
+	}
+
+	if len(selected) == 0 {
+		have := make([]string, 0, len(keys))
+		for _, k := range keys {
+			have = append(have, fmt.Sprintf("%s (%s)", cryptossh.FingerprintSHA256(k), k.Comment))
+		}
+		return nil, fmt.Errorf("ssh-agent has no key %q, only %s", key, strings.Join(have, ", "))
+	}
+	return selected, nil
+}
+
+// MatchAgentKey reports whether the ssh-agent key k is the one key refers to:
+// its SHA256 fingerprint, like ssh-add -l shows it, its legacy MD5 one, with or
+// without the MD5: prefix, or its comment. The fingerprint of a certificate is
+// the one of its key.
+func MatchAgentKey(k *agent.Key, key string) bool {
+	if matchFingerprint(k, key) || key == k.Comment {
+		return true
+	}
+	pub, err := cryptossh.ParsePublicKey(k.Marshal())
+	if err != nil {
+		return false
+	}
+	cert, ok := pub.(*cryptossh.Certificate)
+	return ok && matchFingerprint(cert.Key, key)
+}
@@ -0,0 +1,171 @@
+package sfs_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agentConns is how many connections to the agents of startAgent are open.
+var agentConns int32
+
+// startAgent serves an ssh-agent holding a new key for each comment on a
+// socket, and points SSH_AUTH_SOCK at it. It returns the public keys, and a
+// func to stop it.
+func startAgent(comments ...string) ([]cryptossh.PublicKey, func()) {
+	keyring := agent.NewKeyring()
+	keys := make([]cryptossh.PublicKey, 0, len(comments))
+	for _, comment := range comments {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		plsno(err)
+		plsno(keyring.Add(agent.AddedKey{PrivateKey: priv, Comment: comment}))
+
+		key, err := cryptossh.NewPublicKey(pub)
+		plsno(err)
+		keys = append(keys, key)
+	}
+
+	sock := filepath.Join(makeTemp(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	plsno(err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&agentConns, 1)
+			go func() {
+				_ = agent.ServeAgent(keyring, conn)
+				atomic.AddInt32(&agentConns, -1)
+			}()
+		}
+	}()
+
+	plsno(os.Setenv("SSH_AUTH_SOCK", sock))
+	return keys, func() { _ = l.Close() }
+}
+
+// agentKeys returns the public keys an auth method made by Options.Auth signs
+// with.
+func agentKeys(options sfs.Options) []string {
+	auth, err := options.Auth()
+	Expect(err).To(BeNil())
+
+	callback, ok := auth.(*ssh.PublicKeysCallback)
+	Expect(ok).To(BeTrue())
+	Expect(callback.User).To(Equal("git"))
+
+	signers, err := callback.Callback()
+	Expect(err).To(BeNil())
+
+	keys := make([]string, 0, len(signers))
+	for _, s := range signers {
+		keys = append(keys, cryptossh.FingerprintSHA256(s.PublicKey()))
+	}
+	return keys
+}
+
+var _ = Describe("Agent", func() {
+	var (
+		options  sfs.Options
+		prevSock string
+		hadSock  bool
+	)
+
+	BeforeEach(func() {
+		options = sfs.Options{
+			Repo:      publicRepo.SSH,
+			SHA:       publicRepo.Commit,
+			Directory: makeTemp(),
+		}
+		prevSock, hadSock = os.LookupEnv("SSH_AUTH_SOCK")
+	})
+
+	AfterEach(func() {
+		if hadSock {
+			plsno(os.Setenv("SSH_AUTH_SOCK", prevSock))
+		} else {
+			plsno(os.Unsetenv("SSH_AUTH_SOCK"))
+		}
+	})
+
+	It("should use every key of the agent", func() {
+		keys, stop := startAgent("work", "personal")
+		defer stop()
+		options.SSHAuth = &sfs.SSHAuthOptions{Agent: true}
+
+		Expect(agentKeys(options)).To(ConsistOf(cryptossh.FingerprintSHA256(keys[0]), cryptossh.FingerprintSHA256(keys[1])))
+	})
+
+	It("should select an agent key by fingerprint", func() {
+		keys, stop := startAgent("work", "personal")
+		defer stop()
+
+		options.SSHAuth = &sfs.SSHAuthOptions{AgentKey: cryptossh.FingerprintSHA256(keys[1])}
+		Expect(agentKeys(options)).To(Equal([]string{cryptossh.FingerprintSHA256(keys[1])}))
+
+		options.SSHAuth = &sfs.SSHAuthOptions{AgentKey: "MD5:" + cryptossh.FingerprintLegacyMD5(keys[0])}
+		Expect(agentKeys(options)).To(Equal([]string{cryptossh.FingerprintSHA256(keys[0])}))
+	})
+
+	It("should select an agent key by comment", func() {
+		keys, stop := startAgent("work", "personal")
+		defer stop()
+		options.SSHAuth = &sfs.SSHAuthOptions{AgentKey: "personal"}
+
+		Expect(agentKeys(options)).To(Equal([]string{cryptossh.FingerprintSHA256(keys[1])}))
+	})
+
+	It("should fail for a key the agent doesn't have", func() {
+		keys, stop := startAgent("work")
+		defer stop()
+		options.SSHAuth = &sfs.SSHAuthOptions{AgentKey: "personal"}
+
+		_, err := options.Auth()
+		Expect(err).To(MatchError(ContainSubstring(cryptossh.FingerprintSHA256(keys[0]) + " (work)")))
+	})
+
+	It("should fail without an agent", func() {
+		plsno(os.Unsetenv("SSH_AUTH_SOCK"))
+		options.SSHAuth = &sfs.SSHAuthOptions{Agent: true}
+
+		_, err := options.Auth()
+		Expect(err).To(MatchError(ContainSubstring("SSH_AUTH_SOCK")))
+	})
+
+	It("should close the connection to the agent once the fetch is done", func() {
+		_, stop := startAgent("work")
+		defer stop()
+		url, stopServer := silentServer()
+		defer stopServer()
+		before := atomic.LoadInt32(&agentConns)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := sfs.New(sfs.WithSSHAgent(""), sfs.WithProgress(nil)).FetchContext(ctx, url, publicRepo.Commit, makeTemp())
+		Expect(err).ToNot(BeNil())
+
+		Eventually(func() int32 { return atomic.LoadInt32(&agentConns) }).Should(BeNumerically("<=", before))
+	})
+
+	It("should refuse both a key file and the agent", func() {
+		options.SSHAuth = &sfs.SSHAuthOptions{PEMPath: "/my/key.pem", Agent: true}
+		Expect(options.Validate()).To(Not(BeNil()))
+
+		options.SSHAuth = &sfs.SSHAuthOptions{AgentKey: "work"}
+		Expect(options.Validate()).To(BeNil())
+	})
+})
@@ -0,0 +1,507 @@
+package sfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/gitattributes"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	archiveTar   = "tar"
+	archiveTarGz = "tar.gz"
+	archiveZip   = "zip"
+
+	// writes the archive to stdout instead of a file
+	archiveStdout = "-"
+
+	// owner of every archived file, the same as git archive
+	archiveOwner = "root"
+	// os field in the gzip header, as gzip(1) on unix writes it
+	gzipOSUnix = 3
+
+	gitattributesFile = ".gitattributes"
+	exportIgnore      = "export-ignore"
+)
+
+// archiveFormat returns the explicit format if there is one, otherwise the
+// format matching the extension of the archive path. Archives written to
+// stdout default to tar.gz.
+func archiveFormat(archive, format string) (string, error) {
+	switch format {
+	case archiveTar, archiveTarGz, archiveZip:
+		return format, nil
+	case "tgz":
+		return archiveTarGz, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown archive format %q, must be one of tar, tar.gz or zip", format)
+	}
+
+	name := strings.ToLower(archive)
+	switch {
+	case archive == archiveStdout:
+		return archiveTarGz, nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return archiveTarGz, nil
+	case strings.HasSuffix(name, ".tar"):
+		return archiveTar, nil
+	case strings.HasSuffix(name, ".zip"):
+		return archiveZip, nil
+	default:
+		return "", fmt.Errorf("unable to tell the archive format of %q, must end in .tar, .tar.gz, .tgz or .zip", archive)
+	}
+}
+
+// archiveEntry is a file, symlink or directory in an archive. Symlinks store
+// their target as content, same as in a git tree.
+type archiveEntry struct {
+	name string
+	mode filemode.FileMode
+	size int64
+}
+
+type archiveWriter interface {
+	write(e archiveEntry, r io.Reader) error
+	Close() error
+}
+
+// newArchiveWriter returns a writer for the format that stamps every entry
+// with mtime and records the commit sha in the archive, like git archive does.
+// Compression settings are fixed so the same tree always gives the same bytes
+// (for a given version of Go's compress/flate).
+func newArchiveWriter(w io.Writer, format string, mtime time.Time, sha string) (archiveWriter, error) {
+	switch format {
+	case archiveZip:
+		zw := zip.NewWriter(w)
+		zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, flate.DefaultCompression)
+		})
+		if err := zw.SetComment(sha); err != nil {
+			return nil, err
+		}
+		return &zipArchive{zw: zw, mtime: mtime}, nil
+	case archiveTarGz:
+		gz, err := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		gz.Header = gzip.Header{OS: gzipOSUnix}
+		a := &tarArchive{tw: tar.NewWriter(gz), gz: gz, mtime: mtime}
+		return a, a.comment(sha)
+	default:
+		a := &tarArchive{tw: tar.NewWriter(w), mtime: mtime}
+		return a, a.comment(sha)
+	}
+}
+
+// osMode is the permissions of an entry when extracted, same as a checkout.
+func osMode(mode filemode.FileMode) os.FileMode {
+	switch mode {
+	case filemode.Dir, filemode.Submodule:
+		return os.ModeDir | 0755
+	case filemode.Executable:
+		return 0755
+	case filemode.Symlink:
+		return os.ModeSymlink | 0777
+	default:
+		return 0644
+	}
+}
+
+type tarArchive struct {
+	tw    *tar.Writer
+	gz    *gzip.Writer
+	mtime time.Time
+}
+
+// comment writes a pax global header with the commit sha, which is what
+// "git get-tar-commit-id" reads.
+func (a *tarArchive) comment(sha string) error {
+	return a.tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		Name:       "pax_global_header",
+		PAXRecords: map[string]string{"comment": sha},
+	})
+}
+
+func (a *tarArchive) write(e archiveEntry, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:    e.name,
+		Mode:    int64(osMode(e.mode).Perm()),
+		ModTime: a.mtime,
+		Uname:   archiveOwner,
+		Gname:   archiveOwner,
+	}
+
+	switch e.mode {
+	case filemode.Dir:
+		hdr.Typeflag = tar.TypeDir
+	case filemode.Symlink:
+		target, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = string(target)
+	default:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = e.size
+	}
+
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if hdr.Typeflag == tar.TypeReg {
+		_, err := io.Copy(a.tw, r)
+		return err
+	}
+	return nil
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.gz != nil {
+		return a.gz.Close()
+	}
+	return nil
+}
+
+type zipArchive struct {
+	zw    *zip.Writer
+	mtime time.Time
+}
+
+func (a *zipArchive) write(e archiveEntry, r io.Reader) error {
+	hdr := &zip.FileHeader{
+		Name:     e.name,
+		Method:   zip.Deflate,
+		Modified: a.mtime,
+	}
+	hdr.SetMode(osMode(e.mode))
+
+	if e.mode == filemode.Dir {
+		hdr.Method = zip.Store
+	}
+
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	// symlinks are stored with their target as content, same as Info-ZIP
+	if e.mode != filemode.Dir {
+		_, err = io.Copy(w, r)
+	}
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+// attributes is a stack of .gitattributes patterns, from the least to the most
+// specific, like gitattributes.NewMatcher expects.
+type attributes []gitattributes.MatchAttribute
+
+// readAttributes collects the patterns of every .gitattributes in a tree,
+// parents before their subdirectories.
+func readAttributes(tree *object.Tree, domain []string) (attributes, error) {
+	var attrs attributes
+
+	if f, err := tree.File(gitattributesFile); err == nil {
+		r, err := f.Reader()
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := gitattributes.ReadAttributes(r, domain, len(domain) == 0)
+		_ = r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in %q: %s", gitattributesFile, path.Join(domain...), err)
+		}
+		attrs = append(attrs, parsed...)
+	} else if !errors.Is(err, object.ErrFileNotFound) {
+		return nil, err
+	}
+
+	for _, entry := range tree.Entries {
+		if entry.Mode != filemode.Dir {
+			continue
+		}
+
+		subtree, err := tree.Tree(entry.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		sub, err := readAttributes(subtree, append(domain[:len(domain):len(domain)], entry.Name))
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, sub...)
+	}
+
+	return attrs, nil
+}
+
+// isSet reports whether an attribute is set for a path. The most specific
+// pattern mentioning the attribute decides, gitattributes.Matcher can't be used
+// for this as it lets the least specific pattern win.
+func (attrs attributes) isSet(name, attr string) bool {
+	p := strings.Split(name, "/")
+	for i := len(attrs) - 1; i >= 0; i-- {
+		if attrs[i].Pattern == nil || !attrs[i].Pattern.Match(p) {
+			continue
+		}
+
+		for _, a := range attrs[i].Attributes {
+			if a.Name() == attr {
+				return a.IsSet()
+			}
+		}
+	}
+	return false
+}
+
+// archiveFile is a path of the tree that goes in the archive.
+type archiveFile struct {
+	name  string
+	tree  *object.Tree
+	entry object.TreeEntry
+}
+
+// archiveFiles returns every path in the tree that goes in the archive,
+// leaving out export-ignore paths and the paths the sparse matcher doesn't
+// match.
+func archiveFiles(tree *object.Tree, dir string, attrs attributes, sparse *SparseMatcher) ([]archiveFile, error) {
+	var files []archiveFile
+
+	for _, entry := range tree.Entries {
+		name := path.Join(dir, entry.Name)
+		if attrs.isSet(name, exportIgnore) {
+			log.WithField("path", name).Debugln("skipping export-ignore path")
+			continue
+		}
+
+		if entry.Mode == filemode.Dir {
+			subtree, err := tree.Tree(entry.Name)
+			if err != nil {
+				return nil, err
+			}
+
+			sub, err := archiveFiles(subtree, name, attrs, sparse)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, sub...)
+			continue
+		}
+
+		if sparse.Match(name) {
+			files = append(files, archiveFile{name: name, tree: tree, entry: entry})
+		}
+	}
+
+	return files, nil
+}
+
+// writeArchiveFile writes a file or symlink from the tree to the archive.
+func writeArchiveFile(w archiveWriter, file archiveFile) error {
+	f, err := file.tree.TreeEntryFile(&file.entry)
+	if err != nil {
+		return err
+	}
+
+	r, err := f.Reader()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = r.Close() }()
+
+	return w.write(archiveEntry{name: file.name, mode: file.entry.Mode, size: f.Size}, r)
+}
+
+// WriteArchive writes the tree of a commit to w as a tar, tar.gz or zip
+// archive and returns how many files it holds. Paths with the export-ignore
+// attribute are left out, and so are the paths a non-nil sparse matcher
+// doesn't match.
+//
+// The same commit always gives the same bytes: entries are sorted by path,
+// stamped with the commit's committer time and owned by root, and compression
+// settings are fixed. Directories get an entry only if they hold something.
+func WriteArchive(w io.Writer, format string, commit *object.Commit, sparse *SparseMatcher) (int, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return 0, err
+	}
+
+	attrs, err := readAttributes(tree, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	files, err := archiveFiles(tree, "", attrs, sparse)
+	if err != nil {
+		return 0, err
+	}
+
+	// submodules are archived as an empty directory, same as git archive
+	entries := make(map[string]*archiveFile)
+	for i, file := range files {
+		name := file.name
+		if file.entry.Mode == filemode.Submodule {
+			name += "/"
+		}
+		entries[name] = &files[i]
+
+		for dir := path.Dir(file.name); dir != "."; dir = path.Dir(dir) {
+			entries[dir+"/"] = nil
+		}
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mtime := commit.Committer.When.UTC()
+	aw, err := newArchiveWriter(w, format, mtime, commit.Hash.String())
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, name := range names {
+		file := entries[name]
+		if file == nil || file.entry.Mode == filemode.Submodule {
+			err = aw.write(archiveEntry{name: name, mode: filemode.Dir}, nil)
+		} else {
+			err = writeArchiveFile(aw, *file)
+			count++
+		}
+
+		if err != nil {
+			_ = aw.Close()
+			return 0, fmt.Errorf("unable to archive %q: %s", strings.TrimSuffix(name, "/"), err)
+		}
+	}
+
+	return count, aw.Close()
+}
+
+// archive fetches opts.SHA into a temporary bare repository and writes its tree
+// to opts.Archive, without checking out a worktree.
+func archive(ctx context.Context, opts *Options, auth transport.AuthMethod, sparse *SparseMatcher, res *Result) (err error) {
+	format, err := archiveFormat(opts.Archive, opts.ArchiveFormat)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"sha":     opts.SHA,
+		"archive": opts.Archive,
+		"format":  format,
+	}).Info("archiving repository")
+
+	tmpDir, err := os.MkdirTemp("", "sfs-archive-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil && opts.KeepOnFailure {
+			log.WithField("dir", tmpDir).Warn("keeping the repository of the failed fetch")
+			return
+		}
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	strategy := strategyCache
+	phase := time.Now()
+	repo := fromCache(opts, tmpDir, tmpDir, true)
+	if repo == nil && opts.ObjectStore != "" {
+		// the commit is read straight from the store
+		repo, _, strategy, err = fetchToStore(ctx, opts, auth, res)
+	} else if repo == nil {
+		log.WithField("dir", tmpDir).Debugln("using temporary bare repository")
+		strategy, repo, err = fetchRepository(ctx, opts, auth, tmpDir, tmpDir, true, sparse)
+	}
+	res.phase(OpFetch, phase)
+	if err != nil {
+		return err
+	}
+	res.Cached = strategy == strategyCache
+	toCache(opts, tmpDir, strategy)
+
+	log.WithFields(log.Fields{
+		"sha":      opts.SHA,
+		"strategy": strategy,
+	}).Info("fetched commit")
+
+	commit, err := repo.CommitObject(plumbing.NewHash(opts.SHA))
+	if err != nil {
+		return err
+	}
+
+	res.setCommit(commit)
+	if !res.Cached && opts.ObjectStore == "" {
+		if err := res.setTransfer(repo, tmpDir, 0, ObjectCounts{}); err != nil {
+			log.Debugln("unable to count fetched objects:", err)
+		}
+	}
+
+	phase = time.Now()
+	defer res.phase(OpArchive, phase)
+
+	if opts.Archive == archiveStdout {
+		_, err := WriteArchive(os.Stdout, format, commit, sparse)
+		return err
+	}
+
+	path, err := filepath.Abs(opts.Archive)
+	if err != nil {
+		return fmt.Errorf("invalid archive path: %s", err)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	files, err := WriteArchive(f, format, commit, sparse)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		if !opts.KeepOnFailure {
+			_ = os.Remove(path)
+		}
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"archive": path,
+		"files":   files,
+	}).Info("wrote archive")
+	return nil
+}
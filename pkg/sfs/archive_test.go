@@ -0,0 +1,152 @@
+package sfs_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+var _ = Describe("WriteArchive", func() {
+	var (
+		commit    *object.Commit
+		committed = time.Date(2021, 1, 2, 3, 4, 5, 0, time.FixedZone("EST", -5*60*60))
+	)
+
+	BeforeEach(func() {
+		fs := memfs.New()
+		repo, err := git.Init(memory.NewStorage(), fs)
+		Expect(err).To(BeNil())
+
+		files := map[string]string{
+			"b.txt":           "b",
+			"a/z.txt":         "z",
+			"a/b/c.txt":       "c",
+			"docs/index.md":   "docs",
+			"secret.key":      "key",
+			".gitattributes":  "docs export-ignore\n*.key export-ignore\n",
+			"a-b/sibling.txt": "sibling",
+		}
+		for name, contents := range files {
+			Expect(util.WriteFile(fs, name, []byte(contents), 0644)).To(BeNil())
+		}
+
+		worktree, err := repo.Worktree()
+		Expect(err).To(BeNil())
+		Expect(worktree.AddGlob(".")).To(BeNil())
+
+		sig := &object.Signature{Name: "sfs", Email: "sfs@example.com", When: committed}
+		hash, err := worktree.Commit("archive me", &git.CommitOptions{Author: sig, Committer: sig})
+		Expect(err).To(BeNil())
+
+		commit, err = repo.CommitObject(hash)
+		Expect(err).To(BeNil())
+	})
+
+	// readTar returns the headers of the entries and the pax global header
+	readTar := func(data []byte) ([]*tar.Header, *tar.Header) {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		Expect(err).To(BeNil())
+
+		var headers []*tar.Header
+		var global *tar.Header
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return headers, global
+			}
+			Expect(err).To(BeNil())
+
+			if hdr.Typeflag == tar.TypeXGlobalHeader {
+				global = hdr
+				continue
+			}
+			headers = append(headers, hdr)
+		}
+	}
+
+	It("should write the same bytes every time", func() {
+		for _, format := range []string{"tar", "tar.gz", "zip"} {
+			first, second := &bytes.Buffer{}, &bytes.Buffer{}
+
+			_, err := sfs.WriteArchive(first, format, commit, nil)
+			Expect(err).To(BeNil())
+			_, err = sfs.WriteArchive(second, format, commit, nil)
+			Expect(err).To(BeNil())
+
+			Expect(first.Bytes()).To(Equal(second.Bytes()), format)
+		}
+	})
+
+	It("should write sorted tar entries with normalized metadata", func() {
+		buf := &bytes.Buffer{}
+		count, err := sfs.WriteArchive(buf, "tar.gz", commit, nil)
+		Expect(err).To(BeNil())
+		Expect(count).To(Equal(5))
+
+		headers, global := readTar(buf.Bytes())
+		Expect(global).ToNot(BeNil())
+		Expect(global.PAXRecords["comment"]).To(Equal(commit.Hash.String()))
+
+		var names []string
+		for _, hdr := range headers {
+			names = append(names, hdr.Name)
+			Expect(hdr.ModTime.Equal(committed)).To(BeTrue(), hdr.Name)
+			Expect(hdr.Uid).To(Equal(0))
+			Expect(hdr.Gid).To(Equal(0))
+			Expect(hdr.Uname).To(Equal("root"))
+			Expect(hdr.Gname).To(Equal("root"))
+		}
+
+		Expect(names).To(Equal([]string{
+			".gitattributes",
+			"a-b/",
+			"a-b/sibling.txt",
+			"a/",
+			"a/b/",
+			"a/b/c.txt",
+			"a/z.txt",
+			"b.txt",
+		}))
+	})
+
+	It("should only write paths matching the sparse matcher", func() {
+		buf := &bytes.Buffer{}
+		count, err := sfs.WriteArchive(buf, "tar.gz", commit, sfs.NewSparseMatcher([]string{"/a/b/"}))
+		Expect(err).To(BeNil())
+		Expect(count).To(Equal(1))
+
+		headers, _ := readTar(buf.Bytes())
+		var names []string
+		for _, hdr := range headers {
+			names = append(names, hdr.Name)
+		}
+		Expect(names).To(Equal([]string{"a/", "a/b/", "a/b/c.txt"}))
+	})
+
+	It("should write zip entries with the commit time", func() {
+		buf := &bytes.Buffer{}
+		_, err := sfs.WriteArchive(buf, "zip", commit, nil)
+		Expect(err).To(BeNil())
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		Expect(err).To(BeNil())
+		Expect(zr.Comment).To(Equal(commit.Hash.String()))
+		Expect(zr.File).To(HaveLen(8))
+		for _, f := range zr.File {
+			Expect(f.Modified.Equal(committed)).To(BeTrue(), f.Name)
+		}
+	})
+})
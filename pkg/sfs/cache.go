@@ -0,0 +1,582 @@
+package sfs
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/format/idxfile"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	cacheEntryFile = "entry.json"
+	cacheTmpDir    = "tmp"
+	shallowFile    = "shallow"
+)
+
+// ports that are left out of normalized urls
+var defaultPorts = map[string]int{
+	"ssh":   22,
+	"git":   9418,
+	"http":  80,
+	"https": 443,
+}
+
+// NormalizeURL is the part of a repository url that identifies it in the
+// cache and the object store: the host and path, without the scheme, user,
+// default port or .git suffix. The ssh and https urls of a repository
+// normalize the same.
+func NormalizeURL(url string) string {
+	ep, err := transport.NewEndpoint(strings.TrimSpace(url))
+	if err != nil {
+		return url
+	}
+
+	if ep.Protocol == "file" {
+		path, err := filepath.Abs(ep.Path)
+		if err != nil {
+			path = ep.Path
+		}
+		return "file://" + strings.TrimSuffix(filepath.ToSlash(path), ".git")
+	}
+
+	host := strings.ToLower(ep.Host)
+	if ep.Port != 0 && ep.Port != defaultPorts[ep.Protocol] {
+		host += ":" + strconv.Itoa(ep.Port)
+	}
+	return host + "/" + strings.TrimSuffix(strings.Trim(ep.Path, "/"), ".git")
+}
+
+// Cache is a local cache of fetched commits, keyed by normalized repository
+// url and sha. An entry is a bare repository with the packfile fetched for a
+// commit and its shallow history, so fetching the commit again doesn't touch
+// the network. Once the cache grows past MaxSize, the least recently used
+// entries are evicted.
+//
+// Refs are still resolved against the remote, only fetching by sha is cached.
+// Partial clones (with a filter) are never cached.
+type Cache struct {
+	Dir string
+	// MaxSize in bytes, 0 for no limit.
+	MaxSize int64
+}
+
+// CacheEntry is a cached commit.
+type CacheEntry struct {
+	Repo     string    `json:"repo"`
+	SHA      string    `json:"sha"`
+	Depth    int       `json:"depth"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+
+	dir string
+}
+
+// Dir is where the entry is stored.
+func (e *CacheEntry) Dir() string {
+	return e.dir
+}
+
+// repoKey is the name of the directory for a repository, in the cache and
+// the object store.
+func repoKey(url string) string {
+	key := sha256.Sum256([]byte(NormalizeURL(url)))
+	return hex.EncodeToString(key[:])
+}
+
+func (c *Cache) entryDir(repo, sha string) string {
+	return filepath.Join(c.Dir, repoKey(repo), sha)
+}
+
+func readCacheEntry(dir string) (*CacheEntry, error) {
+	bs, err := os.ReadFile(filepath.Join(dir, cacheEntryFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var e CacheEntry
+	if err := json.Unmarshal(bs, &e); err != nil {
+		return nil, fmt.Errorf("invalid cache entry %q: %s", dir, err)
+	}
+	e.dir = dir
+	return &e, nil
+}
+
+// write replaces the entry file in dir, atomically so concurrent readers
+// never see it half written.
+func (e *CacheEntry) write(dir string) error {
+	bs, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, cacheEntryFile+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(bs)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, cacheEntryFile))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// get returns the entry for the commit with at least depth commits of
+// history, nil if there is none.
+func (c *Cache) get(repo, sha string, depth int) *CacheEntry {
+	e, err := readCacheEntry(c.entryDir(repo, sha))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithField("sha", sha).Warnln("unable to read cache entry:", err)
+		}
+		return nil
+	}
+
+	if e.Depth < depth {
+		log.WithFields(log.Fields{
+			"sha":   sha,
+			"depth": e.Depth,
+		}).Debugln("cached history is too shallow")
+		return nil
+	}
+	return e
+}
+
+// restore copies the entry's objects and shallow history into gitDir, of a
+// repository that was just initialized.
+func (c *Cache) restore(e *CacheEntry, gitDir string) error {
+	packDir := filepath.Join(gitDir, "objects", "pack")
+	if err := os.MkdirAll(packDir, 0755); err != nil {
+		return err
+	}
+
+	packs, err := os.ReadDir(filepath.Join(e.dir, "objects", "pack"))
+	if err != nil {
+		return err
+	}
+	for _, p := range packs {
+		if err := copyFile(filepath.Join(e.dir, "objects", "pack", p.Name()), filepath.Join(packDir, p.Name())); err != nil {
+			return err
+		}
+	}
+
+	err = copyFile(filepath.Join(e.dir, shallowFile), filepath.Join(gitDir, shallowFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	e.LastUsed = time.Now().UTC()
+	if err := e.write(e.dir); err != nil {
+		log.WithField("dir", e.dir).Debugln("unable to update cache entry:", err)
+	}
+	return nil
+}
+
+// put stores the objects and shallow history of the repository in gitDir,
+// fetched for sha with depth commits of history, then evicts entries until
+// the cache fits in MaxSize.
+func (c *Cache) put(repo, sha string, depth int, gitDir string) error {
+	tmp := filepath.Join(c.Dir, cacheTmpDir)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp(tmp, sha+"-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	packDir := filepath.Join(dir, "objects", "pack")
+	if err := os.MkdirAll(packDir, 0755); err != nil {
+		return err
+	}
+
+	packs, err := filepath.Glob(filepath.Join(gitDir, "objects", "pack", "pack-*"))
+	if err != nil {
+		return err
+	}
+	for _, p := range packs {
+		if err := copyFile(p, filepath.Join(packDir, filepath.Base(p))); err != nil {
+			return err
+		}
+	}
+
+	err = copyFile(filepath.Join(gitDir, shallowFile), filepath.Join(dir, shallowFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// a detached HEAD makes the entry a bare repository git can read
+	if err := os.MkdirAll(filepath.Join(dir, "refs"), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "HEAD"), []byte(sha+"\n"), 0644); err != nil {
+		return err
+	}
+
+	size, err := dirSize(dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	e := &CacheEntry{Repo: repo, SHA: sha, Depth: depth, Size: size, Created: now, LastUsed: now}
+	if err := e.write(dir); err != nil {
+		return err
+	}
+
+	final := c.entryDir(repo, sha)
+	if err := os.MkdirAll(filepath.Dir(final), 0755); err != nil {
+		return err
+	}
+	// an entry with less history is replaced, one stored by a concurrent fetch
+	// is kept
+	if old, err := readCacheEntry(final); err == nil && old.Depth < depth {
+		_ = os.RemoveAll(final)
+	}
+	if err := os.Rename(dir, final); err != nil {
+		if _, statErr := os.Stat(final); statErr != nil {
+			return err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"sha":  sha,
+		"size": size,
+	}).Debugln("cached commit")
+
+	if c.MaxSize > 0 {
+		if _, err := c.Prune(c.MaxSize, 0); err != nil {
+			log.Warnln("unable to evict cache entries:", err)
+		}
+	}
+	return nil
+}
+
+// List returns every entry in the cache, most recently used first.
+func (c *Cache) List() ([]*CacheEntry, error) {
+	repos, err := os.ReadDir(c.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*CacheEntry
+	for _, r := range repos {
+		if !r.IsDir() || r.Name() == cacheTmpDir {
+			continue
+		}
+
+		shas, err := os.ReadDir(filepath.Join(c.Dir, r.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range shas {
+			dir := filepath.Join(c.Dir, r.Name(), s.Name())
+			e, err := readCacheEntry(dir)
+			if os.IsNotExist(err) {
+				// evicted since listing the directory
+				continue
+			}
+			if err != nil {
+				// report the broken entry rather than hiding it from prune
+				e = &CacheEntry{SHA: s.Name(), dir: dir}
+			}
+			entries = append(entries, e)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+	return entries, nil
+}
+
+// Remove deletes an entry from the cache.
+func (c *Cache) Remove(e *CacheEntry) error {
+	if err := os.RemoveAll(e.dir); err != nil {
+		return err
+	}
+
+	// the directory of the repo, once its last entry is gone
+	_ = os.Remove(filepath.Dir(e.dir))
+	return nil
+}
+
+// Prune removes the entries that weren't used within olderThan, then the
+// least recently used entries until the cache fits in maxSize, and returns the
+// removed entries. Zero values disable either.
+func (c *Cache) Prune(maxSize int64, olderThan time.Duration) ([]*CacheEntry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+
+	var removed []*CacheEntry
+	// least recently used first
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		tooOld := olderThan > 0 && time.Since(e.LastUsed) > olderThan
+		tooBig := maxSize > 0 && total > maxSize
+		if !tooOld && !tooBig {
+			break
+		}
+
+		if err := c.Remove(e); err != nil {
+			return removed, err
+		}
+		total -= e.Size
+		removed = append(removed, e)
+	}
+
+	return removed, nil
+}
+
+// Verify checks that the entry is intact: its packfiles match their
+// checksums, and every object of the commit and its history can be read and
+// hashes to its id.
+func (c *Cache) Verify(e *CacheEntry) error {
+	if e.Repo == "" {
+		return errors.New("missing or invalid " + cacheEntryFile)
+	}
+
+	packs, err := filepath.Glob(filepath.Join(e.dir, "objects", "pack", "*.pack"))
+	if err != nil {
+		return err
+	}
+	if len(packs) == 0 {
+		return errors.New("no packfiles")
+	}
+	for _, p := range packs {
+		if err := verifyPack(p); err != nil {
+			return fmt.Errorf("%s: %s", filepath.Base(p), err)
+		}
+	}
+
+	st := filesystem.NewStorage(osfs.New(e.dir), cache.NewObjectLRUDefault())
+	defer func() { _ = st.Close() }()
+
+	repo, err := git.Open(st, nil)
+	if err != nil {
+		return err
+	}
+
+	objects, _, err := reachableObjects(repo, plumbing.NewHash(e.SHA), e.Depth)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range objects {
+		obj, err := st.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return fmt.Errorf("object %s: %s", h, err)
+		}
+		if err := verifyObject(obj, h); err != nil {
+			return fmt.Errorf("object %s: %s", h, err)
+		}
+	}
+	return nil
+}
+
+// verifyPack checks the trailing checksum of a packfile, and that its index
+// is for it.
+func verifyPack(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < sha1.Size {
+		return errors.New("truncated")
+	}
+
+	h := sha1.New()
+	if _, err := io.CopyN(h, f, fi.Size()-sha1.Size); err != nil {
+		return err
+	}
+	trailer := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(f, trailer); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), trailer) {
+		return errors.New("checksum mismatch")
+	}
+
+	idxf, err := os.Open(strings.TrimSuffix(path, ".pack") + ".idx")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = idxf.Close() }()
+
+	idx := idxfile.NewMemoryIndex()
+	if err := idxfile.NewDecoder(idxf).Decode(idx); err != nil {
+		return fmt.Errorf("invalid index: %s", err)
+	}
+	if !bytes.Equal(idx.PackfileChecksum[:], trailer) {
+		return errors.New("index is for another packfile")
+	}
+	return nil
+}
+
+// verifyObject checks that the content of obj hashes to h.
+func verifyObject(obj plumbing.EncodedObject, h plumbing.Hash) error {
+	r, err := obj.Reader()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = r.Close() }()
+
+	hasher := plumbing.NewHasher(obj.Type(), obj.Size())
+	if _, err := io.Copy(hasher, r); err != nil {
+		return err
+	}
+	if sum := hasher.Sum(); sum != h {
+		return fmt.Errorf("content hashes to %s", sum)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// fromCache initializes a repository in dir with opts.SHA from the cache,
+// nil when it isn't cached or can't be restored.
+func fromCache(opts *Options, dir, gitDir string, bare bool) *git.Repository {
+	if opts.Cache == nil || opts.Filter != "" {
+		return nil
+	}
+
+	e := opts.Cache.get(opts.Repo, opts.SHA, opts.depth())
+	if e == nil {
+		return nil
+	}
+
+	repo, err := restoreRepository(opts.Cache, e, opts.Repo, dir, gitDir, bare, opts.depth())
+	if err != nil {
+		log.WithField("sha", opts.SHA).Warnln("unable to use cached commit, removing it:", err)
+		_ = os.RemoveAll(gitDir)
+		_ = opts.Cache.Remove(e)
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"sha":   opts.SHA,
+		"depth": e.Depth,
+	}).Info("using cached commit")
+	return repo
+}
+
+func restoreRepository(c *Cache, e *CacheEntry, url, dir, gitDir string, bare bool, depth int) (*git.Repository, error) {
+	if _, err := initRepository(dir, url, bare); err != nil {
+		return nil, err
+	}
+
+	if err := c.restore(e, gitDir); err != nil {
+		return nil, err
+	}
+
+	// reopened, so the packs copied in are seen
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := plumbing.NewHash(e.SHA)
+	if _, err := repo.CommitObject(hash); err != nil {
+		return nil, err
+	}
+
+	if e.Depth > depth {
+		// the same history a fetch with depth would have
+		_, shallow, _, err := walkHistory(repo, hash, depth)
+		if err != nil {
+			return nil, err
+		}
+		if err := repo.Storer.SetShallow(shallow); err != nil {
+			return nil, err
+		}
+	}
+
+	ref := plumbing.NewHashReference(plumbing.NewRemoteReferenceName(remoteName, e.SHA), hash)
+	return repo, repo.Storer.SetReference(ref)
+}
+
+// toCache stores opts.SHA, fetched into the repository in gitDir, in the
+// cache. Failing to is only logged, the fetch itself worked.
+func toCache(opts *Options, gitDir, strategy string) {
+	if opts.Cache == nil || strategy == strategyFilter || strategy == strategyCache {
+		return
+	}
+
+	if err := opts.Cache.put(opts.Repo, opts.SHA, opts.depth(), gitDir); err != nil {
+		log.WithField("sha", opts.SHA).Warnln("unable to cache commit:", err)
+	}
+}
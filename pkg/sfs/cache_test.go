@@ -0,0 +1,126 @@
+package sfs_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+// writeCacheEntry writes the entry file of a fake cache entry, without any
+// objects.
+func writeCacheEntry(dir string, e sfs.CacheEntry) {
+	entryDir := filepath.Join(dir, "repo", e.SHA)
+	plsno(os.MkdirAll(entryDir, 0755))
+
+	bs, err := json.Marshal(e)
+	plsno(err)
+	plsno(os.WriteFile(filepath.Join(entryDir, "entry.json"), bs, 0644))
+}
+
+var _ = Describe("Cache", func() {
+	It("should normalize repository urls", func() {
+		expected := "github.com/org/app"
+		Expect(sfs.NormalizeURL("https://github.com/org/app.git")).To(Equal(expected))
+		Expect(sfs.NormalizeURL("https://GitHub.com/org/app/")).To(Equal(expected))
+		Expect(sfs.NormalizeURL("https://token@github.com:443/org/app.git")).To(Equal(expected))
+		Expect(sfs.NormalizeURL("git@github.com:org/app.git")).To(Equal(expected))
+		Expect(sfs.NormalizeURL("ssh://git@github.com/org/app.git")).To(Equal(expected))
+
+		Expect(sfs.NormalizeURL("https://git.example.com:8443/org/app.git")).To(Equal("git.example.com:8443/org/app"))
+		Expect(sfs.NormalizeURL("https://github.com/org/other.git")).ToNot(Equal(expected))
+	})
+
+	It("should serve a commit fetched before from the cache", func() {
+		cacheDir := makeTemp()
+		fetcher := sfs.New(sfs.WithProgress(nil), sfs.WithCache(cacheDir, 0))
+
+		res, err := fetcher.FetchResult(context.Background(), publicRepo.HTTPS, publicRepo.Commit, makeTemp())
+		Expect(err).To(BeNil())
+		Expect(res.Cached).To(BeFalse())
+
+		// the same repo, by another url
+		tmpDir := makeTemp()
+		res, err = fetcher.FetchResult(context.Background(), "https://github.com/robherley/fixture-public-repo", publicRepo.Commit, tmpDir)
+		Expect(err).To(BeNil())
+		Expect(res.Cached).To(BeTrue())
+		Expect(res.Bytes).To(BeZero())
+		Expect(checkFiles(tmpDir, publicRepo.ExpectedFiles)).To(BeTrue())
+
+		c := &sfs.Cache{Dir: cacheDir}
+		entries, err := c.List()
+		Expect(err).To(BeNil())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].SHA).To(Equal(publicRepo.Commit))
+		Expect(c.Verify(entries[0])).To(BeNil())
+	})
+
+	It("should list entries most recently used first", func() {
+		dir := makeTemp()
+		now := time.Now()
+		writeCacheEntry(dir, sfs.CacheEntry{Repo: "a", SHA: "1111111111111111111111111111111111111111", Size: 10, LastUsed: now.Add(-time.Hour)})
+		writeCacheEntry(dir, sfs.CacheEntry{Repo: "b", SHA: "2222222222222222222222222222222222222222", Size: 10, LastUsed: now})
+
+		entries, err := (&sfs.Cache{Dir: dir}).List()
+		Expect(err).To(BeNil())
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0].Repo).To(Equal("b"))
+		Expect(entries[1].Repo).To(Equal("a"))
+
+		entries, err = (&sfs.Cache{Dir: filepath.Join(dir, "missing")}).List()
+		Expect(err).To(BeNil())
+		Expect(entries).To(BeEmpty())
+	})
+
+	It("should prune the least recently used entries", func() {
+		dir := makeTemp()
+		now := time.Now()
+		writeCacheEntry(dir, sfs.CacheEntry{Repo: "old", SHA: "1111111111111111111111111111111111111111", Size: 10, LastUsed: now.Add(-48 * time.Hour)})
+		writeCacheEntry(dir, sfs.CacheEntry{Repo: "older", SHA: "2222222222222222222222222222222222222222", Size: 10, LastUsed: now.Add(-72 * time.Hour)})
+		writeCacheEntry(dir, sfs.CacheEntry{Repo: "new", SHA: "3333333333333333333333333333333333333333", Size: 10, LastUsed: now})
+		c := &sfs.Cache{Dir: dir}
+
+		removed, err := c.Prune(25, 0)
+		Expect(err).To(BeNil())
+		Expect(removed).To(HaveLen(1))
+		Expect(removed[0].Repo).To(Equal("older"))
+
+		removed, err = c.Prune(0, 24*time.Hour)
+		Expect(err).To(BeNil())
+		Expect(removed).To(HaveLen(1))
+		Expect(removed[0].Repo).To(Equal("old"))
+
+		entries, err := c.List()
+		Expect(err).To(BeNil())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Repo).To(Equal("new"))
+	})
+
+	It("should fail to verify a broken entry", func() {
+		dir := makeTemp()
+		writeCacheEntry(dir, sfs.CacheEntry{Repo: "a", SHA: "1111111111111111111111111111111111111111", Depth: 1})
+		c := &sfs.Cache{Dir: dir}
+
+		entries, err := c.List()
+		Expect(err).To(BeNil())
+		Expect(c.Verify(entries[0])).To(MatchError(ContainSubstring("no packfiles")))
+
+		Expect(c.Remove(entries[0])).To(BeNil())
+		entries, err = c.List()
+		Expect(err).To(BeNil())
+		Expect(entries).To(BeEmpty())
+	})
+
+	It("should reject an invalid cache", func() {
+		_, err := sfs.New(sfs.WithCache("", 0)).Fetch(publicRepo.HTTPS, publicRepo.Commit, makeTemp())
+		var optErr *sfs.OptionError
+		Expect(errors.As(err, &optErr)).To(BeTrue())
+		Expect(optErr.Option).To(Equal("cache-dir"))
+	})
+})
@@ -0,0 +1,68 @@
+package sfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// loadCertificate reads the OpenSSH user certificate at path, like the
+// id_ed25519-cert.pub ssh-keygen -s writes, refusing one that isn't valid now.
+func loadCertificate(path string) (*cryptossh.Certificate, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _, _, _, err := cryptossh.ParseAuthorizedKey(bs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse certificate %q: %s", path, err)
+	}
+	cert, ok := key.(*cryptossh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%q is a public key, not a certificate", path)
+	}
+	if cert.CertType != cryptossh.UserCert {
+		return nil, fmt.Errorf("%q is a host certificate, not a user one", path)
+	}
+
+	now := time.Now()
+	if after := time.Unix(int64(cert.ValidAfter), 0); now.Before(after) {
+		return nil, fmt.Errorf("certificate %q isn't valid until %s", path, after.Format(time.RFC3339))
+	}
+	if cert.ValidBefore != cryptossh.CertTimeInfinity {
+		if before := time.Unix(int64(cert.ValidBefore), 0); !now.Before(before) {
+			return nil, fmt.Errorf("certificate %q expired at %s", path, before.Format(time.RFC3339))
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"id":         cert.KeyId,
+		"principals": cert.ValidPrincipals,
+		"expires":    certExpiry(cert),
+	}).Debugln("using ssh certificate")
+	return cert, nil
+}
+
+// certExpiry is when cert stops being valid, for logs.
+func certExpiry(cert *cryptossh.Certificate) string {
+	if cert.ValidBefore == cryptossh.CertTimeInfinity {
+		return "never"
+	}
+	return time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339)
+}
+
+// certSigner signs with cert, read from path, which must be for the key of one
+// of signers.
+func certSigner(path string, cert *cryptossh.Certificate, signers []cryptossh.Signer) (cryptossh.Signer, error) {
+	for _, s := range signers {
+		if bytes.Equal(s.PublicKey().Marshal(), cert.Key.Marshal()) {
+			return cryptossh.NewCertSigner(cert, s)
+		}
+	}
+	return nil, fmt.Errorf("certificate %q is for key %s, which isn't the one it's used with", path, cryptossh.FingerprintSHA256(cert.Key))
+}
@@ -0,0 +1,170 @@
+package sfs_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// newCA makes a new ed25519 certificate authority.
+func newCA() cryptossh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	plsno(err)
+	signer, err := cryptossh.NewSignerFromKey(priv)
+	plsno(err)
+	return signer
+}
+
+// signCert signs a certificate of certType for key with ca, valid for the
+// principals until validBefore.
+func signCert(ca cryptossh.Signer, key cryptossh.PublicKey, certType uint32, validBefore time.Time, principals ...string) *cryptossh.Certificate {
+	cert := &cryptossh.Certificate{
+		Key:             key,
+		KeyId:           "sfs-test",
+		CertType:        certType,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	plsno(cert.SignCert(rand.Reader, ca))
+	return cert
+}
+
+// writeUserKey writes a new unencrypted ed25519 private key to a file, and
+// returns its path and public key.
+func writeUserKey() (string, cryptossh.PublicKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	plsno(err)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	plsno(err)
+
+	path := filepath.Join(makeTemp(), "id_ed25519")
+	plsno(os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	key, err := cryptossh.NewPublicKey(pub)
+	plsno(err)
+	return path, key
+}
+
+// writeCert writes cert to path, like ssh-keygen -s does.
+func writeCert(path string, cert *cryptossh.Certificate) string {
+	plsno(os.WriteFile(path, cryptossh.MarshalAuthorizedKey(cert), 0644))
+	return path
+}
+
+var _ = Describe("Certificates", func() {
+	var (
+		options  sfs.Options
+		ca       cryptossh.Signer
+		keyPath  string
+		key      cryptossh.PublicKey
+		tomorrow = time.Now().Add(24 * time.Hour)
+	)
+
+	BeforeEach(func() {
+		options = sfs.Options{
+			Repo:      publicRepo.SSH,
+			SHA:       publicRepo.Commit,
+			Directory: makeTemp(),
+		}
+		ca = newCA()
+		keyPath, key = writeUserKey()
+	})
+
+	// signedWith returns the certificate the auth method of the options signs
+	// with.
+	signedWith := func() *cryptossh.Certificate {
+		auth, err := options.Auth()
+		Expect(err).To(BeNil())
+
+		keys, ok := auth.(*ssh.PublicKeys)
+		Expect(ok).To(BeTrue())
+		cert, ok := keys.Signer.PublicKey().(*cryptossh.Certificate)
+		Expect(ok).To(BeTrue())
+		return cert
+	}
+
+	It("should sign with the certificate of the key", func() {
+		cert := signCert(ca, key, cryptossh.UserCert, tomorrow, "git")
+		certPath := writeCert(filepath.Join(makeTemp(), "cert.pub"), cert)
+		options.SSHAuth = &sfs.SSHAuthOptions{PEMPath: keyPath, CertPath: certPath}
+
+		Expect(signedWith().Marshal()).To(Equal(cert.Marshal()))
+	})
+
+	It("should use the certificate next to the key", func() {
+		cert := signCert(ca, key, cryptossh.UserCert, tomorrow, "git")
+		writeCert(keyPath+"-cert.pub", cert)
+		options.SSHAuth = &sfs.SSHAuthOptions{PEMPath: keyPath}
+
+		Expect(signedWith().Marshal()).To(Equal(cert.Marshal()))
+	})
+
+	It("should refuse an expired certificate", func() {
+		cert := signCert(ca, key, cryptossh.UserCert, time.Now().Add(-time.Second), "git")
+		certPath := writeCert(filepath.Join(makeTemp(), "cert.pub"), cert)
+		options.SSHAuth = &sfs.SSHAuthOptions{PEMPath: keyPath, CertPath: certPath}
+
+		_, err := options.Auth()
+		Expect(err).To(MatchError(ContainSubstring("expired")))
+	})
+
+	It("should refuse a certificate of another key", func() {
+		_, other := writeUserKey()
+		cert := signCert(ca, other, cryptossh.UserCert, tomorrow, "git")
+		certPath := writeCert(filepath.Join(makeTemp(), "cert.pub"), cert)
+		options.SSHAuth = &sfs.SSHAuthOptions{PEMPath: keyPath, CertPath: certPath}
+
+		_, err := options.Auth()
+		Expect(err).To(MatchError(ContainSubstring(cryptossh.FingerprintSHA256(other))))
+	})
+
+	It("should refuse a host certificate", func() {
+		cert := signCert(ca, key, cryptossh.HostCert, tomorrow, "example.com")
+		certPath := writeCert(filepath.Join(makeTemp(), "cert.pub"), cert)
+		options.SSHAuth = &sfs.SSHAuthOptions{PEMPath: keyPath, CertPath: certPath}
+
+		_, err := options.Auth()
+		Expect(err).To(MatchError(ContainSubstring("not a user one")))
+	})
+
+	Context("with an agent", func() {
+		var (
+			prevSock string
+			hadSock  bool
+		)
+
+		BeforeEach(func() {
+			prevSock, hadSock = os.LookupEnv("SSH_AUTH_SOCK")
+		})
+
+		AfterEach(func() {
+			if hadSock {
+				plsno(os.Setenv("SSH_AUTH_SOCK", prevSock))
+			} else {
+				plsno(os.Unsetenv("SSH_AUTH_SOCK"))
+			}
+		})
+
+		It("should only sign with the certificate of the agent key", func() {
+			keys, stop := startAgent("work", "personal")
+			defer stop()
+
+			cert := signCert(ca, keys[1], cryptossh.UserCert, tomorrow, "git")
+			certPath := writeCert(filepath.Join(makeTemp(), "cert.pub"), cert)
+			options.SSHAuth = &sfs.SSHAuthOptions{Agent: true, CertPath: certPath}
+
+			Expect(agentKeys(options)).To(Equal([]string{cryptossh.FingerprintSHA256(cert)}))
+		})
+	})
+})
@@ -0,0 +1,142 @@
+package sfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	log "github.com/sirupsen/logrus"
+)
+
+// Deepen extends the history of a checkout made by ShallowFetchSHA in
+// opts.Directory by opts.Deepen commits, only fetching the missing commits.
+// The repo and sha are read from the existing checkout.
+func Deepen(opts *Options) error {
+	return DeepenContext(context.Background(), opts)
+}
+
+// DeepenContext is Deepen with a context. When the context is done the fetch
+// is stopped and the checkout is left as it was.
+func DeepenContext(ctx context.Context, opts *Options) error {
+	if opts == nil {
+		return errors.New("must initialize options")
+	}
+	return deepen(ctx, opts, newResult(opts))
+}
+
+// deepen is DeepenContext, recording what it did in res.
+func deepen(ctx context.Context, opts *Options, res *Result) error {
+	start := time.Now()
+	defer func() { res.Duration = time.Since(start) }()
+
+	absDir, err := filepath.Abs(opts.Directory)
+	if err != nil {
+		return fmt.Errorf("invalid directory: %s", err)
+	}
+
+	repo, err := git.PlainOpen(absDir)
+	if err != nil {
+		log.Debugln(err)
+		return opError(OpDeepen, "", fmt.Errorf("no repository to deepen in %q, was it fetched with --rm-dotgit?", absDir))
+	}
+
+	remote, err := repo.Remote(remoteName)
+	if err != nil {
+		return opError(OpDeepen, "", fmt.Errorf("unable to find remote %q: %s", remoteName, err))
+	}
+	opts.Repo = remote.Config().URLs[0]
+	res.Repo = opts.Repo
+
+	head, err := repo.Head()
+	if err != nil {
+		return opError(OpDeepen, opts.Repo, fmt.Errorf("unable to read HEAD: %s", err))
+	}
+	opts.SHA = head.Hash().String()
+
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return opError(OpDeepen, opts.Repo, err)
+	}
+	res.setCommit(commit)
+
+	current, err := historyDepth(repo, head.Hash())
+	if err != nil {
+		return opError(OpDeepen, opts.Repo, err)
+	}
+	opts.Depth = current + opts.Deepen
+
+	log.WithFields(log.Fields{
+		"sha":   opts.SHA,
+		"dir":   absDir,
+		"from":  current,
+		"depth": opts.Depth,
+	}).Info("deepening repository")
+
+	auth, closeAuth, err := opts.auth()
+	if err != nil {
+		return opError(OpAuth, opts.Repo, err)
+	}
+	defer closeAuth()
+
+	gitDir := filepath.Join(absDir, git.GitDirName)
+	size, counts, statsErr := storageStats(repo, gitDir)
+
+	phase := time.Now()
+	err = retry(ctx, opts.Retry, OpFetch, func() error {
+		return deepenHead(ctx, repo, opts, auth, head.Hash(), opts.progress())
+	})
+	res.phase(OpFetch, phase)
+	if err != nil {
+		return opError(OpFetch, opts.Repo, canceled(ctx, err))
+	}
+
+	if statsErr == nil {
+		statsErr = res.setTransfer(repo, gitDir, size, counts)
+	}
+	if statsErr != nil {
+		log.Debugln("unable to count fetched objects:", statsErr)
+	}
+
+	log.WithFields(log.Fields{
+		"sha":   opts.SHA,
+		"depth": opts.Depth,
+	}).Info("deepened history")
+
+	return nil
+}
+
+// deepenHead fetches the history of head down to opts.Depth commits. Fetching
+// head again would be skipped by go-git as it's already there, so it's asked
+// for with a deepen request and the current shallow commits. Servers that
+// only let ref tips be fetched get their advertised refs deepened instead, as
+// when fetching the commit.
+func deepenHead(ctx context.Context, repo *git.Repository, opts *Options, auth transport.AuthMethod, head plumbing.Hash, progress sideband.Progress) error {
+	ar, err := advertisedRefs(ctx, opts.Repo, auth)
+	if err != nil {
+		return err
+	}
+	haves, err := localHaves(repo)
+	if err != nil {
+		return err
+	}
+
+	err = uploadPack(ctx, repo, opts.Repo, auth, ar.Capabilities, []plumbing.Hash{head}, haves, opts.Depth, "", progress)
+	if err == nil || !wantUnsupported(err) || opts.FallbackDepth <= 0 {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"reason":    err,
+		"max-depth": opts.FallbackDepth,
+	}).Warn("server does not allow fetching by sha, falling back to deepening advertised refs")
+	if err := fetchDeepen(ctx, repo, opts, auth, progress); err != nil {
+		return err
+	}
+	return pruneHistory(repo, head, opts.Depth)
+}
@@ -0,0 +1,167 @@
+package sfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	log "github.com/sirupsen/logrus"
+)
+
+// What to do with a directory that isn't empty, and isn't a checkout of the
+// same repository to update.
+const (
+	// IfExistsFail refuses to fetch into it, the default.
+	IfExistsFail = "fail"
+	// IfExistsClean replaces everything in it with the checkout.
+	IfExistsClean = "clean"
+	// IfExistsMerge checks out over it, keeping the files the commit doesn't
+	// have.
+	IfExistsMerge = "merge"
+)
+
+// checkProtected refuses directories no checkout should ever be written to,
+// whatever opts.IfExists is: the filesystem root, and the home directory or
+// any directory above it.
+func checkProtected(dir string) error {
+	dir = resolvePath(dir)
+	if filepath.Dir(dir) == dir {
+		return invalid("directory", fmt.Sprintf("refusing to use the filesystem root %q", dir))
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return nil
+	}
+	home = resolvePath(home)
+
+	if dir == home {
+		return invalid("directory", fmt.Sprintf("refusing to use the home directory %q", dir))
+	}
+	if rel, err := filepath.Rel(dir, home); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return invalid("directory", fmt.Sprintf("refusing to use %q, which has the home directory in it", dir))
+	}
+	return nil
+}
+
+// resolvePath is the absolute path with symlinks resolved, or path as it is if
+// it doesn't exist.
+func resolvePath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	return abs
+}
+
+// prepareDirectory applies opts.IfExists to dir, which existed before the
+// fetch, without changing it. It returns the repository of a previous checkout
+// of opts.Repo in dir to update, or nil if the fetch starts from an empty
+// repository.
+func prepareDirectory(dir string, opts *Options) (*git.Repository, error) {
+	existing, err := openExisting(dir, opts.Repo)
+	if errors.Is(err, git.ErrRepositoryAlreadyExists) && opts.IfExists == IfExistsClean {
+		log.WithField("dir", dir).Warnln("replacing the repository of another remote:", err)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if existing != nil {
+		log.WithField("dir", dir).Info("updating existing checkout")
+		return existing, nil
+	}
+
+	empty, err := isEmpty(dir)
+	if err != nil || empty {
+		return nil, err
+	}
+
+	switch opts.IfExists {
+	case IfExistsClean:
+		log.WithField("dir", dir).Warn("replacing everything in the directory")
+		return nil, nil
+	case IfExistsMerge:
+		log.WithField("dir", dir).Info("checking out over the files in the directory")
+		return nil, nil
+	}
+	// there's no repository at all, which is mostly what --rm-dotgit leaves
+	return nil, fmt.Errorf("%q has files but no git repository to update, like a previous fetch with --rm-dotgit leaves it, use --if-exists clean to replace them: %w", dir, ErrDirectoryNotEmpty)
+}
+
+// prepareUpdate applies opts.IfExists to the previous checkout of repo in dir
+// and returns its index. Local changes are refused, or discarded when
+// cleaning. Files the checkout doesn't have are refused, kept when merging or
+// removed when cleaning, which is only done in staging.
+func prepareUpdate(repo *git.Repository, dir string, opts *Options) (*index.Index, error) {
+	if opts.IfExists == IfExistsClean {
+		stray, err := strayFiles(repo, dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range stray {
+			path := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			removeEmptyParents(dir, path)
+		}
+		return repo.Storer.Index()
+	}
+
+	idx, err := checkUnmodified(repo, dir)
+	if err != nil || opts.IfExists == IfExistsMerge {
+		return idx, err
+	}
+
+	stray, err := strayFiles(repo, dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(stray) > 0 {
+		return nil, fmt.Errorf("%q has %d files that aren't in its checkout, like %q: %w", dir, len(stray), stray[0], ErrDirectoryNotEmpty)
+	}
+	return idx, nil
+}
+
+// isEmpty reports whether dir has nothing in it.
+func isEmpty(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+// warnStray warns about the files in dir the checkout didn't write, which were
+// kept.
+func warnStray(repo *git.Repository, dir string) {
+	stray, err := strayFiles(repo, dir)
+	if err != nil {
+		log.Debugln("unable to list files that weren't checked out:", err)
+		return
+	}
+	if len(stray) == 0 {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"files": len(stray),
+		"first": stray[0],
+	}).Warn("kept files in the directory that aren't in the commit")
+}
@@ -0,0 +1,92 @@
+package sfs_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+var _ = Describe("Directory", func() {
+	It("should refuse a directory with files", func() {
+		dir := makeTemp()
+		plsno(os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("mine\n"), 0644))
+
+		_, err := sfs.New(sfs.WithProgress(nil)).Fetch("http://127.0.0.1:1/repo.git", publicRepo.Commit, dir)
+		Expect(errors.Is(err, sfs.ErrDirectoryNotEmpty)).To(BeTrue())
+
+		_, err = os.Stat(filepath.Join(dir, ".git"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should suggest cleaning a directory fetched with rm-dotgit", func() {
+		url, shas, stop := gitServer(2)
+		defer stop()
+
+		dir := makeTemp()
+		fetcher := sfs.New(sfs.WithProgress(nil), sfs.WithRemoveDotGit())
+		_, err := fetcher.Fetch(url, shas[0], dir)
+		Expect(err).To(BeNil())
+
+		_, err = fetcher.Fetch(url, shas[1], dir)
+		Expect(errors.Is(err, sfs.ErrDirectoryNotEmpty)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("--rm-dotgit")))
+		Expect(err).To(MatchError(ContainSubstring("--if-exists clean")))
+
+		_, err = sfs.New(sfs.WithProgress(nil), sfs.WithRemoveDotGit(), sfs.WithIfExists(sfs.IfExistsClean)).Fetch(url, shas[1], dir)
+		Expect(err).To(BeNil())
+		Expect(filepath.Join(dir, "2.txt")).ToNot(BeAnExistingFile())
+	})
+
+	It("should only replace the files in the directory once fetched when cleaning", func() {
+		dir := makeTemp()
+		plsno(os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+		plsno(os.WriteFile(filepath.Join(dir, "sub", "notes.txt"), []byte("mine\n"), 0644))
+
+		_, err := sfs.New(sfs.WithProgress(nil), sfs.WithIfExists(sfs.IfExistsClean)).Fetch("http://127.0.0.1:1/repo.git", publicRepo.Commit, dir)
+		Expect(errors.Is(err, sfs.ErrNetwork)).To(BeTrue())
+
+		contents, err := os.ReadFile(filepath.Join(dir, "sub", "notes.txt"))
+		Expect(err).To(BeNil())
+		Expect(string(contents)).To(Equal("mine\n"))
+	})
+
+	It("should fetch over the files in a directory when merging", func() {
+		dir := makeTemp()
+		plsno(os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("mine\n"), 0644))
+		plsno(os.WriteFile(filepath.Join(dir, "public.txt"), []byte("mine\n"), 0644))
+
+		_, err := sfs.New(sfs.WithProgress(nil), sfs.WithIfExists(sfs.IfExistsMerge)).FetchResult(context.Background(), publicRepo.HTTPS, publicRepo.Commit, dir)
+		Expect(err).To(BeNil())
+		Expect(checkFiles(dir, publicRepo.ExpectedFiles)).To(BeTrue())
+
+		contents, err := os.ReadFile(filepath.Join(dir, "notes.txt"))
+		Expect(err).To(BeNil())
+		Expect(string(contents)).To(Equal("mine\n"))
+
+		contents, err = os.ReadFile(filepath.Join(dir, "public.txt"))
+		Expect(err).To(BeNil())
+		Expect(string(contents)).ToNot(Equal("mine\n"))
+	})
+
+	It("should refuse the home directory and the filesystem root", func() {
+		home := makeTemp()
+		defer os.Setenv("HOME", os.Getenv("HOME"))
+		plsno(os.Setenv("HOME", home))
+
+		fetcher := sfs.New(sfs.WithProgress(nil), sfs.WithIfExists(sfs.IfExistsClean))
+		for _, dir := range []string{home, filepath.Dir(home), "/"} {
+			_, err := fetcher.Fetch("http://127.0.0.1:1/repo.git", publicRepo.Commit, dir)
+			var optErr *sfs.OptionError
+			Expect(errors.As(err, &optErr)).To(BeTrue())
+			Expect(optErr.Option).To(Equal("directory"))
+		}
+
+		_, err := os.Stat(home)
+		Expect(err).To(BeNil())
+	})
+})
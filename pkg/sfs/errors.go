@@ -0,0 +1,184 @@
+package sfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Kinds of failure, for errors.Is. Every *OptionError is an ErrValidation,
+// and an *Error is whichever its cause is, if any.
+var (
+	ErrValidation        = errors.New("invalid options")
+	ErrAuth              = errors.New("authentication failed")
+	ErrNotFound          = errors.New("not found")
+	ErrServerUnsupported = errors.New("not supported by the server")
+	ErrNetwork           = errors.New("network error")
+	ErrDirectoryNotEmpty = errors.New("directory not empty")
+)
+
+var (
+	authErrors = []error{
+		transport.ErrAuthenticationRequired,
+		transport.ErrAuthorizationFailed,
+		transport.ErrInvalidAuthMethod,
+	}
+
+	// x/crypto/ssh only reports failing to authenticate as a message
+	authMessages = []string{
+		"unable to authenticate",
+		"knownhosts:",
+		hostKeyFailed,
+	}
+
+	notFoundErrors = []error{
+		transport.ErrRepositoryNotFound,
+		transport.ErrEmptyRemoteRepository,
+		plumbing.ErrObjectNotFound,
+		errRefNotFound,
+		errCommitNotFound,
+	}
+)
+
+// Operations reported by Error, the step of a fetch that failed.
+const (
+	OpAuth      = "auth"
+	OpResolve   = "resolve"
+	OpInit      = "init"
+	OpFetch     = "fetch"
+	OpCheckout  = "checkout"
+	OpLFS       = "lfs"
+	OpSubmodule = "submodule"
+	OpArchive   = "archive"
+	OpDeepen    = "deepen"
+)
+
+// OptionError is returned by Validate when an option is invalid or conflicts
+// with another one.
+type OptionError struct {
+	// Option is the name of the invalid option, as its flag. It is empty when
+	// options conflict.
+	Option string
+	Reason string
+}
+
+func (e *OptionError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+func (e *OptionError) Error() string {
+	if e.Option == "" {
+		return e.Reason
+	}
+	return fmt.Sprintf("%q is invalid: %s", e.Option, e.Reason)
+}
+
+func invalid(key, msg string) error {
+	return &OptionError{Option: key, Reason: msg}
+}
+
+func conflict(msg string) error {
+	return &OptionError{Reason: msg}
+}
+
+// Error is returned when fetching a repository fails, with the step that
+// failed. The underlying error is available with errors.Unwrap, and what kind
+// of failure it is with errors.Is and the Err variables.
+type Error struct {
+	Op   string
+	Repo string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Repo == "" {
+		return fmt.Sprintf("%s: %s", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s %s: %s", e.Op, e.Repo, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	if e.Op == OpAuth {
+		return target == ErrAuth
+	}
+
+	k := kind(e.Err)
+	return k != nil && target == k
+}
+
+func isAny(err error, targets []error) bool {
+	for _, target := range targets {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasMessage(err error, msgs []string) bool {
+	s := err.Error()
+	for _, m := range msgs {
+		if strings.Contains(s, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// kind is the Err variable for the cause of a failed fetch, nil when it is
+// none of them.
+func kind(err error) error {
+	// go-git wraps transport errors in types without Unwrap
+	var unexpected *plumbing.UnexpectedError
+	if errors.As(err, &unexpected) {
+		if k := kind(unexpected.Err); k != nil {
+			return k
+		}
+	}
+
+	code, _ := statusCode(err)
+	var dnsErr *net.DNSError
+
+	switch {
+	case errors.Is(err, git.ErrRepositoryAlreadyExists), errors.Is(err, ErrDirectoryNotEmpty):
+		return ErrDirectoryNotEmpty
+	case isAny(err, authErrors), code == http.StatusUnauthorized, code == http.StatusForbidden, hasMessage(err, authMessages):
+		return ErrAuth
+	case isAny(err, notFoundErrors), code == http.StatusNotFound:
+		return ErrNotFound
+	case errors.Is(err, errLFSUnsupported), wantUnsupported(err), code == http.StatusNotImplemented:
+		return ErrServerUnsupported
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &dnsErr), IsRetryable(err):
+		return ErrNetwork
+	}
+	return nil
+}
+
+// opError wraps err in an Error for the op, unless it already is one, like
+// the errors of a nested fetch of a submodule.
+func opError(op, repo string, err error) error {
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return &Error{Op: op, Repo: repo, Err: err}
+}
+
+// canceled returns the context's error once it is done, which is what made
+// the operation fail rather than whatever error the transport reported.
+func canceled(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
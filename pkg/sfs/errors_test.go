@@ -0,0 +1,76 @@
+package sfs_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+var _ = Describe("Error", func() {
+	kinds := []error{
+		sfs.ErrValidation,
+		sfs.ErrAuth,
+		sfs.ErrNotFound,
+		sfs.ErrServerUnsupported,
+		sfs.ErrNetwork,
+		sfs.ErrDirectoryNotEmpty,
+	}
+
+	expectKind := func(err, kind error) {
+		for _, k := range kinds {
+			Expect(errors.Is(err, k)).To(Equal(k == kind), "%v is %v", err, k)
+		}
+	}
+
+	It("should be a validation error for invalid options", func() {
+		_, err := sfs.New().Fetch("", publicRepo.Commit, makeTemp())
+		expectKind(err, sfs.ErrValidation)
+	})
+
+	It("should classify the cause of a failed fetch", func() {
+		expectKind(&sfs.Error{Op: sfs.OpAuth, Err: errors.New("open key.pem: no such file or directory")}, sfs.ErrAuth)
+		expectKind(&sfs.Error{Op: sfs.OpResolve, Err: transport.ErrAuthenticationRequired}, sfs.ErrAuth)
+		expectKind(&sfs.Error{Op: sfs.OpFetch, Err: httpErr(http.StatusForbidden)}, sfs.ErrAuth)
+		expectKind(&sfs.Error{Op: sfs.OpResolve, Err: errors.New("ssh: handshake failed: ssh: unable to authenticate")}, sfs.ErrAuth)
+
+		expectKind(&sfs.Error{Op: sfs.OpResolve, Err: transport.ErrRepositoryNotFound}, sfs.ErrNotFound)
+		expectKind(&sfs.Error{Op: sfs.OpFetch, Err: fmt.Errorf("checking out: %w", plumbing.ErrObjectNotFound)}, sfs.ErrNotFound)
+
+		expectKind(&sfs.Error{Op: sfs.OpFetch, Err: git.ErrExactSHA1NotSupported}, sfs.ErrServerUnsupported)
+		expectKind(&sfs.Error{Op: sfs.OpFetch, Err: errors.New("unexpected client error: unexpected requesting \"...\": not our ref abc")}, sfs.ErrServerUnsupported)
+
+		expectKind(&sfs.Error{Op: sfs.OpFetch, Err: httpErr(http.StatusBadGateway)}, sfs.ErrNetwork)
+		expectKind(&sfs.Error{Op: sfs.OpResolve, Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}, sfs.ErrNetwork)
+		expectKind(&sfs.Error{Op: sfs.OpResolve, Err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}}, sfs.ErrNetwork)
+		expectKind(&sfs.Error{Op: sfs.OpFetch, Err: context.DeadlineExceeded}, sfs.ErrNetwork)
+
+		expectKind(&sfs.Error{Op: sfs.OpInit, Err: git.ErrRepositoryAlreadyExists}, sfs.ErrDirectoryNotEmpty)
+
+		expectKind(&sfs.Error{Op: sfs.OpCheckout, Err: errors.New("unknown working tree")}, nil)
+		expectKind(&sfs.Error{Op: sfs.OpFetch, Err: context.Canceled}, nil)
+	})
+
+	It("should fail with a directory that already has a repository", func() {
+		dir := makeTemp()
+		_, err := git.PlainInit(dir, false)
+		Expect(err).To(BeNil())
+
+		_, err = sfs.New(sfs.WithProgress(nil)).Fetch("http://127.0.0.1:1/repo.git", publicRepo.Commit, dir)
+		expectKind(err, sfs.ErrDirectoryNotEmpty)
+
+		var fetchErr *sfs.Error
+		Expect(errors.As(err, &fetchErr)).To(BeTrue())
+		Expect(fetchErr.Op).To(Equal(sfs.OpInit))
+		Expect(err.Error()).To(ContainSubstring("already has a repository"))
+	})
+})
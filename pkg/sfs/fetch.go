@@ -0,0 +1,354 @@
+package sfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	gitcfg "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// the sha is requested directly, needs uploadpack.allowReachableSHA1InWant
+	strategyWant = "want"
+	// advertised refs are fetched deeper and deeper until the sha shows up
+	strategyDeepen = "deepen"
+	// the sha is requested directly, with a partial clone filter
+	strategyFilter = "filter"
+	// the commit was fetched before, and is restored from the cache
+	strategyCache = "cache"
+	// the commit and its history were already in the object store
+	strategyStore = "store"
+)
+
+// wantUnsupported reports whether a fetch failed because the server refused
+// to let us ask for an arbitrary sha.
+func wantUnsupported(err error) bool {
+	if errors.Is(err, git.ErrExactSHA1NotSupported) {
+		return true
+	}
+
+	// servers that only allow tips in want either reply with "not our ref" or
+	// send nothing at all
+	msg := err.Error()
+	return strings.Contains(msg, "not our ref") || strings.Contains(msg, packfile.ErrEmptyPackfile.Error())
+}
+
+// fetchCommit gets opts.SHA into the repository, returning the strategy that
+// worked.
+func fetchCommit(ctx context.Context, repo *git.Repository, opts *Options, auth transport.AuthMethod, progress sideband.Progress) (string, error) {
+	hash := plumbing.NewHash(opts.SHA)
+
+	if opts.Filter != "" {
+		ar, err := advertisedRefs(ctx, opts.Repo, auth)
+		if err != nil {
+			return "", err
+		}
+
+		if ar.Capabilities.Supports(capability.Filter) {
+			err := fetchFiltered(ctx, repo, opts, auth, ar.Capabilities, progress)
+			if err == nil {
+				return strategyFilter, nil
+			}
+			if !wantUnsupported(err) {
+				return "", err
+			}
+		}
+
+		log.WithField("filter", opts.Filter).Warn("server does not support filtered fetches by sha, fetching every object")
+	}
+
+	err := fetchWant(ctx, repo, opts, auth, progress)
+	if err == nil || err == git.NoErrAlreadyUpToDate {
+		return strategyWant, nil
+	}
+
+	if !wantUnsupported(err) || opts.FallbackDepth <= 0 {
+		return "", err
+	}
+
+	log.WithFields(log.Fields{
+		"reason":    err,
+		"max-depth": opts.FallbackDepth,
+	}).Warn("server does not allow fetching by sha, falling back to deepening advertised refs")
+
+	if err := fetchDeepen(ctx, repo, opts, auth, progress); err != nil {
+		return "", err
+	}
+
+	if opts.ObjectStore != "" {
+		// the object store keeps everything, for the checkouts to come
+		return strategyDeepen, nil
+	}
+
+	log.WithFields(log.Fields{
+		"hash":  opts.SHA,
+		"depth": opts.depth(),
+	}).Debugln("pruning history to the fetched commit")
+	if err := pruneHistory(repo, hash, opts.depth()); err != nil {
+		return "", fmt.Errorf("unable to prune fetched history: %s", err)
+	}
+
+	return strategyDeepen, nil
+}
+
+func fetchWant(ctx context.Context, repo *git.Repository, opts *Options, auth transport.AuthMethod, progress sideband.Progress) error {
+	if isSSH(opts.Repo) {
+		return fetchWantSSH(ctx, repo, opts, auth, progress)
+	}
+
+	// exact sha refspec, requires the server to allow reachable sha1s in want
+	refspec := gitcfg.RefSpec(fmt.Sprintf("%s:%s", opts.SHA, plumbing.NewRemoteReferenceName(remoteName, opts.SHA)))
+
+	log.WithFields(log.Fields{
+		"remote":  remoteName,
+		"url":     opts.Repo,
+		"refspec": refspec,
+	}).Debugln("fetching ref")
+	fetchRepo, err := negotiating(repo)
+	if err != nil {
+		return err
+	}
+	return fetchRepo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: remoteName,
+		Depth:      opts.depth(),
+		RefSpecs: []gitcfg.RefSpec{
+			refspec,
+		},
+		Progress: progress,
+		Auth:     auth,
+	})
+}
+
+// fetchWantSSH is fetchWant over ssh. go-git's ssh transport can't be stopped
+// while it connects, so the sha is asked for with uploadPack instead, like
+// go-git would: only once the server says it can be, and not at all when the
+// commit is already there.
+func fetchWantSSH(ctx context.Context, repo *git.Repository, opts *Options, auth transport.AuthMethod, progress sideband.Progress) error {
+	hash := plumbing.NewHash(opts.SHA)
+	ref := plumbing.NewHashReference(plumbing.NewRemoteReferenceName(remoteName, opts.SHA), hash)
+	if hasObject(repo, hash) {
+		if err := repo.Storer.SetReference(ref); err != nil {
+			return err
+		}
+		return git.NoErrAlreadyUpToDate
+	}
+
+	ar, err := advertisedRefs(ctx, opts.Repo, auth)
+	if err != nil {
+		return err
+	}
+	if !ar.Capabilities.Supports(capability.AllowReachableSHA1InWant) && !ar.Capabilities.Supports(capability.AllowTipSHA1InWant) {
+		return git.ErrExactSHA1NotSupported
+	}
+	haves, err := localHaves(repo)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"url": opts.Repo,
+		"sha": opts.SHA,
+	}).Debugln("fetching sha")
+	if err := uploadPack(ctx, repo, opts.Repo, auth, ar.Capabilities, []plumbing.Hash{hash}, haves, opts.depth(), "", progress); err != nil {
+		return err
+	}
+	return repo.Storer.SetReference(ref)
+}
+
+// fetchDeepen fetches every advertised branch and tag, doubling the depth
+// until the wanted commit and enough of its history is in the object store, or
+// FallbackDepth is reached. Every step after the first asks for refs that are
+// already there, which go-git won't fetch, so each one is sent as a deepen
+// request with the shallow commits of the one before.
+func fetchDeepen(ctx context.Context, repo *git.Repository, opts *Options, auth transport.AuthMethod, progress sideband.Progress) error {
+	hash := plumbing.NewHash(opts.SHA)
+
+	ar, err := advertisedRefs(ctx, opts.Repo, auth)
+	if err != nil {
+		return err
+	}
+
+	refs := fallbackRefs(ar)
+	if len(refs) == 0 {
+		return fmt.Errorf("%w: %s, the remote advertises no branches or tags to search", errCommitNotFound, opts.SHA)
+	}
+	wants := make([]plumbing.Hash, 0, len(refs))
+	for _, ref := range refs {
+		wants = append(wants, ref.Hash())
+	}
+	wants = dedupe(wants)
+
+	for d := opts.depth(); ; d *= 2 {
+		if d > opts.FallbackDepth {
+			d = opts.FallbackDepth
+		}
+
+		haves, err := localHaves(repo)
+		if err != nil {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"remote": remoteName,
+			"url":    opts.Repo,
+			"depth":  d,
+		}).Debugln("deepening advertised refs")
+		if err := uploadPack(ctx, repo, opts.Repo, auth, ar.Capabilities, wants, haves, d, "", progress); err != nil {
+			return err
+		}
+
+		for _, ref := range refs {
+			if err := repo.Storer.SetReference(ref); err != nil {
+				return err
+			}
+		}
+
+		found := false
+		if _, err := repo.CommitObject(hash); err == nil {
+			found = true
+			_, _, complete, err := walkHistory(repo, hash, opts.depth())
+			if err != nil {
+				return err
+			}
+			if complete {
+				return nil
+			}
+		}
+
+		if d >= opts.FallbackDepth {
+			if found {
+				log.WithField("depth", opts.FallbackDepth).Warn("commit found but its history is truncated by the fallback depth")
+				return nil
+			}
+			return fmt.Errorf("%w: %s is not within %d commits of any advertised ref", errCommitNotFound, opts.SHA, opts.FallbackDepth)
+		}
+	}
+}
+
+// fallbackRefs are the local refs fetching every advertised branch and tag
+// leaves, like the refspecs of git clone do.
+func fallbackRefs(ar *packp.AdvRefs) []*plumbing.Reference {
+	var refs []*plumbing.Reference
+	for name, h := range ar.References {
+		switch {
+		case strings.HasPrefix(name, "refs/heads/"):
+			refs = append(refs, plumbing.NewHashReference(plumbing.NewRemoteReferenceName(remoteName, strings.TrimPrefix(name, "refs/heads/")), h))
+		case strings.HasPrefix(name, "refs/tags/"):
+			refs = append(refs, plumbing.NewHashReference(plumbing.ReferenceName(name), h))
+		}
+	}
+	return refs
+}
+
+// localHaves are the objects the refs of repo point to, for the server to
+// leave out what they already bring, down to the shallow commits.
+func localHaves(repo *git.Repository) ([]plumbing.Hash, error) {
+	refs, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+	defer refs.Close()
+
+	var haves []plumbing.Hash
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && hasObject(repo, ref.Hash()) {
+			haves = append(haves, ref.Hash())
+		}
+		return nil
+	})
+	return dedupe(haves), err
+}
+
+// negotiating returns repo as go-git should see it when fetching, with the
+// parents of its shallow commits grafted away, see graftedStorage.
+func negotiating(repo *git.Repository) (*git.Repository, error) {
+	st, ok := repo.Storer.(*filesystem.Storage)
+	if !ok {
+		return repo, nil
+	}
+
+	grafted, err := newGraftedStorage(st)
+	if err != nil {
+		return nil, err
+	}
+	return git.Open(grafted, nil)
+}
+
+// graftedStorage is the storage of an object store with the parents of its
+// shallow commits hidden, the way git treats them. When fetching, go-git walks
+// the history of every ref for haves and fails on the first parent it doesn't
+// have, which a shallow repository always has.
+type graftedStorage struct {
+	*filesystem.Storage
+	shallow map[plumbing.Hash]bool
+}
+
+func newGraftedStorage(st *filesystem.Storage) (*graftedStorage, error) {
+	shallow, err := st.Shallow()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &graftedStorage{Storage: st}
+	s.graft(shallow)
+	return s, nil
+}
+
+func (s *graftedStorage) graft(commits []plumbing.Hash) {
+	s.shallow = make(map[plumbing.Hash]bool, len(commits))
+	for _, h := range commits {
+		s.shallow[h] = true
+	}
+}
+
+// SetShallow also grafts the commits, a fetch that deepens step by step adds
+// shallow commits between steps.
+func (s *graftedStorage) SetShallow(commits []plumbing.Hash) error {
+	if err := s.Storage.SetShallow(commits); err != nil {
+		return err
+	}
+	s.graft(commits)
+	return nil
+}
+
+func (s *graftedStorage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	obj, err := s.Storage.EncodedObject(t, h)
+	if err != nil || !s.shallow[h] || obj.Type() != plumbing.CommitObject {
+		return obj, err
+	}
+
+	var commit object.Commit
+	if err := commit.Decode(obj); err != nil {
+		return nil, err
+	}
+	commit.ParentHashes = nil
+
+	grafted := &plumbing.MemoryObject{}
+	if err := commit.Encode(grafted); err != nil {
+		return nil, err
+	}
+	return &graftedObject{EncodedObject: grafted, hash: h}, nil
+}
+
+// graftedObject is a commit rewritten without its parents, still known by the
+// hash of the original.
+type graftedObject struct {
+	plumbing.EncodedObject
+	hash plumbing.Hash
+}
+
+func (o *graftedObject) Hash() plumbing.Hash {
+	return o.hash
+}
@@ -0,0 +1,162 @@
+package sfs_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	neturl "net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+// gitServer serves a new repository of n commits, the i-th adding file i.txt,
+// with git http-backend. Like most servers it doesn't let commits that aren't
+// ref tips be fetched by sha, but it allows partial clone filters. It returns
+// the url of the repository, its commits, newest first, and a func to stop it.
+func gitServer(n int) (string, []string, func()) {
+	root, shas := gitRepo(n)
+	url, stop := serveRepo(root)
+	return url, shas, stop
+}
+
+// gitRepo makes the repository of gitServer, root/repo.git, and returns root
+// and its commits, newest first.
+func gitRepo(n int) (string, []string) {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		Skip("git is not installed")
+	}
+
+	root := makeTemp()
+	work := filepath.Join(root, "work")
+	run := func(dir string, args ...string) string {
+		cmd := exec.Command(gitPath, append([]string{"-c", "user.name=sfs", "-c", "user.email=sfs@example.com"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			panic(fmt.Sprintf("git %s: %s: %s", strings.Join(args, " "), err, out))
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	run(root, "init", "-q", work)
+	shas := make([]string, n)
+	for i := 1; i <= n; i++ {
+		plsno(os.WriteFile(filepath.Join(work, fmt.Sprintf("%d.txt", i)), []byte(fmt.Sprintln(i)), 0644))
+		run(work, "add", ".")
+		run(work, "commit", "-q", "-m", fmt.Sprintf("commit %d", i))
+		shas[n-i] = run(work, "rev-parse", "HEAD")
+	}
+	run(root, "clone", "-q", "--bare", work, filepath.Join(root, "repo.git"))
+	run(filepath.Join(root, "repo.git"), "config", "uploadpack.allowfilter", "true")
+	return root, shas
+}
+
+// serveRepo serves root/repo.git made by gitRepo, and returns its url and a
+// func to stop serving it.
+func serveRepo(root string) (string, func()) {
+	srv := httptest.NewServer(gitHandler(root))
+	return srv.URL + "/repo.git", srv.Close
+}
+
+// gitHandler serves the repositories in root with git http-backend.
+func gitHandler(root string) http.Handler {
+	gitPath, err := exec.LookPath("git")
+	plsno(err)
+
+	return &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+}
+
+// hostTransport sends requests for host to the server at addr instead, and
+// fails the rest.
+type hostTransport struct {
+	host, addr string
+}
+
+func (t hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host {
+		return nil, fmt.Errorf("unexpected request to %s", req.URL.Host)
+	}
+	req = req.Clone(req.Context())
+	req.URL.Host = t.addr
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// commitCount is how many commits of history the checkout in dir has.
+func commitCount(dir string) int {
+	out, err := exec.Command("git", "-C", dir, "rev-list", "--count", "HEAD").Output()
+	plsno(err)
+	n, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	plsno(err)
+	return n
+}
+
+var _ = Describe("Fetch", func() {
+	It("should deepen advertised refs to fetch a commit the server won't give by sha", func() {
+		url, shas, stop := gitServer(10)
+		defer stop()
+
+		dir := makeTemp()
+		options := sfs.Options{
+			Repo:          url,
+			SHA:           shas[5],
+			Directory:     dir,
+			FallbackDepth: 16,
+			Silent:        true,
+		}
+		Expect(sfs.ShallowFetchSHA(&options)).To(BeNil())
+
+		Expect(filepath.Join(dir, "5.txt")).To(BeAnExistingFile())
+		Expect(filepath.Join(dir, "6.txt")).ToNot(BeAnExistingFile())
+		Expect(commitCount(dir)).To(Equal(1))
+	})
+
+	It("should fail for a commit deeper than the fallback depth", func() {
+		url, shas, stop := gitServer(10)
+		defer stop()
+
+		options := sfs.Options{
+			Repo:          url,
+			SHA:           shas[9],
+			Directory:     makeTemp(),
+			FallbackDepth: 4,
+			Silent:        true,
+		}
+		err := sfs.ShallowFetchSHA(&options)
+		Expect(err).To(MatchError(ContainSubstring("not within 4 commits")))
+	})
+
+	It("should send filtered fetches through the http client", func() {
+		url, shas, stop := gitServer(3)
+		defer stop()
+
+		// the repo's host only resolves through the client
+		u, err := neturl.Parse(url)
+		plsno(err)
+		sfs.SetHTTPClient(&http.Client{Transport: hostTransport{host: "sfs.test", addr: u.Host}})
+		defer sfs.SetHTTPClient(nil)
+
+		dir := makeTemp()
+		options := sfs.Options{
+			Repo:      "http://sfs.test" + u.Path,
+			SHA:       shas[0],
+			Directory: dir,
+			Filter:    "blob:none",
+			Silent:    true,
+		}
+		Expect(sfs.ShallowFetchSHA(&options)).To(BeNil())
+		Expect(checkFiles(dir, []string{"1.txt", "2.txt", "3.txt"})).To(BeTrue())
+	})
+})
@@ -0,0 +1,328 @@
+package sfs
+
+import (
+	"context"
+	"io"
+)
+
+// Fetcher shallow fetches commits of repositories with a set of options that
+// apply to every fetch. It can be used for many repositories, and by many
+// goroutines at once.
+type Fetcher struct {
+	opts Options
+}
+
+// Option configures a Fetcher.
+type Option func(*Options)
+
+// New returns a Fetcher with the options applied in order. Without options it
+// fetches a single commit with no auth, and writes progress to stderr.
+func New(options ...Option) *Fetcher {
+	f := &Fetcher{
+		opts: Options{FallbackDepth: DefaultFallbackDepth},
+	}
+	for _, o := range options {
+		o(&f.opts)
+	}
+	return f
+}
+
+// WithOptions starts from a complete set of options, like ones bound from the
+// command line. The repo, commit and directory of opts are ignored, those are
+// given to each fetch.
+func WithOptions(opts Options) Option {
+	return func(o *Options) {
+		*o = opts
+	}
+}
+
+// WithBasicAuth authenticates to http(s) repositories with a username and
+// password. When using a token, the username can be anything but empty.
+func WithBasicAuth(username, password string) Option {
+	return func(o *Options) {
+		o.BasicAuth = &BasicAuthOptions{Username: username, Password: password}
+		o.SSHAuth = nil
+	}
+}
+
+// WithSSHKey authenticates to ssh repositories with a pem encoded private key
+// file, and its passphrase if it has one.
+func WithSSHKey(path, passphrase string) Option {
+	return func(o *Options) {
+		o.SSHAuth = &SSHAuthOptions{PEMPath: path, Passphrase: passphrase}
+		o.BasicAuth = nil
+	}
+}
+
+// WithSSHAgent authenticates to ssh repositories with the keys of the running
+// ssh-agent, found through SSH_AUTH_SOCK. A key, its fingerprint or comment,
+// only uses the matching one when the agent holds several, "" uses them all.
+func WithSSHAgent(key string) Option {
+	return func(o *Options) {
+		o.SSHAuth = &SSHAuthOptions{Agent: true, AgentKey: key}
+		o.BasicAuth = nil
+	}
+}
+
+// WithSSHCertificate signs with the OpenSSH user certificate at path, for the
+// key of WithSSHKey or WithSSHAgent, which it must come after. Without it, the
+// -cert.pub file next to the key file is used when there is one.
+func WithSSHCertificate(path string) Option {
+	return func(o *Options) {
+		if o.SSHAuth == nil {
+			o.SSHAuth = &SSHAuthOptions{}
+		}
+		o.SSHAuth.CertPath = path
+		o.BasicAuth = nil
+	}
+}
+
+// WithDepth fetches n commits of history instead of one.
+func WithDepth(n int) Option {
+	return func(o *Options) {
+		o.Depth = n
+	}
+}
+
+// WithFilter fetches with a partial clone filter, like blob:none. Filters are
+// only sent to http(s) repositories.
+func WithFilter(filter string) Option {
+	return func(o *Options) {
+		o.Filter = filter
+	}
+}
+
+// WithInclude only checks out paths matching the gitignore-style patterns.
+func WithInclude(patterns ...string) Option {
+	return func(o *Options) {
+		o.Include = append(o.Include, patterns...)
+	}
+}
+
+// WithExclude doesn't check out paths matching the gitignore-style patterns.
+func WithExclude(patterns ...string) Option {
+	return func(o *Options) {
+		o.Exclude = append(o.Exclude, patterns...)
+	}
+}
+
+// WithSparseFile checks out the paths matching the patterns in a file, in the
+// same format as .git/info/sparse-checkout.
+func WithSparseFile(path string) Option {
+	return func(o *Options) {
+		o.SparseFile = path
+	}
+}
+
+// WithSubmodules fetches submodules at the shas pinned by the commit,
+// recursively.
+func WithSubmodules() Option {
+	return func(o *Options) {
+		o.Recursive = true
+	}
+}
+
+// WithLFS replaces git-lfs pointer files with their content. Only paths
+// matching include and not matching exclude are fetched, and objects larger
+// than maxSize are left as pointers. Empty patterns and a maxSize of 0 mean
+// no limit.
+func WithLFS(include, exclude []string, maxSize int64) Option {
+	return func(o *Options) {
+		o.LFS = true
+		o.LFSInclude = include
+		o.LFSExclude = exclude
+		o.LFSMaxSize = maxSize
+	}
+}
+
+// WithArchiveFormat sets the format of archives (tar, tar.gz or zip), instead
+// of going by the archive's extension.
+func WithArchiveFormat(format string) Option {
+	return func(o *Options) {
+		o.ArchiveFormat = format
+	}
+}
+
+// WithRemoveDotGit removes the .git directory after checking out.
+func WithRemoveDotGit() Option {
+	return func(o *Options) {
+		o.RemoveDotGit = true
+	}
+}
+
+// WithExpandSHA expands abbreviated shas against the remote's refs and recent
+// history.
+func WithExpandSHA() Option {
+	return func(o *Options) {
+		o.ExpandSHA = true
+	}
+}
+
+// WithFallbackDepth is the max depth to search advertised refs for a commit
+// when the server can't fetch it by sha, 0 disables the search.
+func WithFallbackDepth(n int) Option {
+	return func(o *Options) {
+		o.FallbackDepth = n
+	}
+}
+
+// WithRetry retries network operations that fail with a transient error, see
+// IsRetryable, with the policy.
+func WithRetry(policy RetryPolicy) Option {
+	return func(o *Options) {
+		o.Retry = policy
+	}
+}
+
+// WithCache serves fetches of commits by sha from a local cache in dir when
+// they were fetched before, and caches the ones that weren't. The least
+// recently used commits are evicted once the cache is larger than maxSize
+// bytes, 0 for no limit.
+func WithCache(dir string, maxSize int64) Option {
+	return func(o *Options) {
+		o.Cache = &Cache{Dir: dir, MaxSize: maxSize}
+	}
+}
+
+// WithObjectStore fetches into a bare repository per remote in dir, shared by
+// every fetch of the remote, so fetching another commit only transfers the
+// objects the store doesn't have yet. Checkouts read their objects from the
+// store through .git/objects/info/alternates, so they break if it's removed.
+func WithObjectStore(dir string) Option {
+	return func(o *Options) {
+		o.ObjectStore = dir
+	}
+}
+
+// WithIfExists sets what to do with a directory that isn't empty, and isn't
+// a checkout of the same repository to update: IfExistsFail, IfExistsClean or
+// IfExistsMerge.
+func WithIfExists(policy string) Option {
+	return func(o *Options) {
+		o.IfExists = policy
+	}
+}
+
+// WithKeepOnFailure keeps what a fetch that fails wrote, in its staging
+// directory next to the target, to debug it. By default it's removed, along
+// with the parent directories created for it.
+func WithKeepOnFailure() Option {
+	return func(o *Options) {
+		o.KeepOnFailure = true
+	}
+}
+
+// WithProgress writes the remote's progress to w, nil discards it.
+func WithProgress(w io.Writer) Option {
+	return func(o *Options) {
+		o.Progress = w
+		o.Silent = w == nil
+	}
+}
+
+// options returns a copy of the fetcher's options for a single call.
+func (f *Fetcher) options() Options {
+	opts := f.opts
+	opts.Repo = ""
+	opts.SHA = ""
+	opts.Ref = ""
+	opts.Directory = ""
+	opts.Deepen = 0
+	opts.Archive = ""
+	return opts
+}
+
+// Fetch checks out rev of repo in dir and returns the sha of the commit. The
+// rev is either a full sha or a ref (or, with WithExpandSHA, an abbreviated
+// sha) to resolve on the remote. Invalid options are reported as an
+// *OptionError, and failures while fetching as an *Error.
+func (f *Fetcher) Fetch(repo, rev, dir string) (string, error) {
+	return f.FetchContext(context.Background(), repo, rev, dir)
+}
+
+// FetchContext is Fetch with a context. When the context is done the fetch is
+// stopped, dir is left as it was and the error wraps the context's error.
+func (f *Fetcher) FetchContext(ctx context.Context, repo, rev, dir string) (string, error) {
+	res, err := f.FetchResult(ctx, repo, rev, dir)
+	if err != nil {
+		return "", err
+	}
+	return res.SHA, nil
+}
+
+// FetchResult is FetchContext, returning what the fetch did. The result is
+// never nil, on failure it has what was done before failing.
+func (f *Fetcher) FetchResult(ctx context.Context, repo, rev, dir string) (*Result, error) {
+	opts := f.options()
+	opts.Repo = repo
+	opts.SetRev(rev)
+	opts.Directory = dir
+	opts.ArchiveFormat = ""
+
+	res := newResult(&opts)
+	if err := opts.Validate(); err != nil {
+		return res, err
+	}
+
+	return res, shallowFetchSHA(ctx, &opts, res)
+}
+
+// Archive writes the files of rev of repo to an archive at path, or stdout
+// for "-", and returns the sha of the commit.
+func (f *Fetcher) Archive(repo, rev, path string) (string, error) {
+	return f.ArchiveContext(context.Background(), repo, rev, path)
+}
+
+// ArchiveContext is Archive with a context. When the context is done the
+// fetch is stopped and a partially written archive file is removed.
+func (f *Fetcher) ArchiveContext(ctx context.Context, repo, rev, path string) (string, error) {
+	res, err := f.ArchiveResult(ctx, repo, rev, path)
+	if err != nil {
+		return "", err
+	}
+	return res.SHA, nil
+}
+
+// ArchiveResult is ArchiveContext, returning what the fetch did like
+// FetchResult.
+func (f *Fetcher) ArchiveResult(ctx context.Context, repo, rev, path string) (*Result, error) {
+	opts := f.options()
+	opts.Repo = repo
+	opts.SetRev(rev)
+	opts.Archive = path
+
+	res := newResult(&opts)
+	if err := opts.Validate(); err != nil {
+		return res, err
+	}
+
+	return res, shallowFetchSHA(ctx, &opts, res)
+}
+
+// Deepen fetches n more commits of history for a checkout made by Fetch in
+// dir.
+func (f *Fetcher) Deepen(dir string, n int) error {
+	return f.DeepenContext(context.Background(), dir, n)
+}
+
+// DeepenContext is Deepen with a context. When the context is done the fetch
+// is stopped and the checkout is left as it was.
+func (f *Fetcher) DeepenContext(ctx context.Context, dir string, n int) error {
+	_, err := f.DeepenResult(ctx, dir, n)
+	return err
+}
+
+// DeepenResult is DeepenContext, returning what the fetch did like
+// FetchResult.
+func (f *Fetcher) DeepenResult(ctx context.Context, dir string, n int) (*Result, error) {
+	opts := f.options()
+	opts.Directory = dir
+	opts.Deepen = n
+
+	res := newResult(&opts)
+	if err := opts.Validate(); err != nil {
+		return res, err
+	}
+
+	return res, deepen(ctx, &opts, res)
+}
@@ -0,0 +1,115 @@
+package sfs_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+var _ = Describe("Fetcher", func() {
+	It("should fetch a public repo via https", func() {
+		tmpDir := makeTemp()
+		fetcher := sfs.New(sfs.WithProgress(nil))
+
+		sha, err := fetcher.Fetch(publicRepo.HTTPS, publicRepo.Commit, tmpDir)
+		Expect(err).To(BeNil())
+		Expect(sha).To(Equal(publicRepo.Commit))
+
+		seenAllFiles := checkFiles(tmpDir, publicRepo.ExpectedFiles)
+		Expect(seenAllFiles).To(BeTrue())
+	})
+
+	It("should return what was fetched", func() {
+		tmpDir := makeTemp()
+		fetcher := sfs.New(sfs.WithProgress(nil))
+
+		res, err := fetcher.FetchResult(context.Background(), publicRepo.HTTPS, publicRepo.Commit, tmpDir)
+		Expect(err).To(BeNil())
+		Expect(res.SHA).To(Equal(publicRepo.Commit))
+		Expect(res.Commit).ToNot(BeNil())
+		Expect(res.Commit.Tree).To(HaveLen(40))
+		Expect(res.Bytes).To(BeNumerically(">", 0))
+		Expect(res.Objects.Commits).To(Equal(1))
+		Expect(res.Objects.Total()).To(BeNumerically(">", 1))
+		Expect(res.Durations).To(HaveKey(sfs.OpFetch))
+		Expect(res.Durations).To(HaveKey(sfs.OpCheckout))
+	})
+
+	It("should return what was done before failing", func() {
+		dir := makeTemp()
+		res, err := sfs.New(sfs.WithProgress(nil)).FetchResult(context.Background(), "http://127.0.0.1:1/repo.git", "main", dir)
+		Expect(err).ToNot(BeNil())
+		Expect(res).ToNot(BeNil())
+		Expect(res.Repo).To(Equal("http://127.0.0.1:1/repo.git"))
+		Expect(res.Directory).To(Equal(dir))
+		Expect(res.Commit).To(BeNil())
+		Expect(res.Durations).To(HaveKey(sfs.OpResolve))
+
+		res, err = sfs.New().FetchResult(context.Background(), "", "main", dir)
+		Expect(errors.Is(err, sfs.ErrValidation)).To(BeTrue())
+		Expect(res).ToNot(BeNil())
+	})
+
+	It("should fail with an option error for invalid options", func() {
+		var optErr *sfs.OptionError
+
+		_, err := sfs.New().Fetch("", publicRepo.Commit, makeTemp())
+		Expect(errors.As(err, &optErr)).To(BeTrue())
+		Expect(optErr.Option).To(Equal("repo"))
+
+		_, err = sfs.New(sfs.WithBasicAuth("token", "")).Fetch(publicRepo.HTTPS, publicRepo.Commit, makeTemp())
+		Expect(errors.As(err, &optErr)).To(BeTrue())
+		Expect(optErr.Option).To(Equal("password"))
+
+		_, err = sfs.New(sfs.WithArchiveFormat("rar")).Archive(publicRepo.HTTPS, publicRepo.Commit, "-")
+		Expect(errors.As(err, &optErr)).To(BeTrue())
+		Expect(optErr.Option).To(Equal("archive"))
+	})
+
+	It("should report conflicting options without an option name", func() {
+		err := sfs.New(sfs.WithRemoveDotGit()).Deepen(makeTemp(), 1)
+
+		var optErr *sfs.OptionError
+		Expect(errors.As(err, &optErr)).To(BeTrue())
+		Expect(optErr.Option).To(BeEmpty())
+		Expect(err.Error()).To(ContainSubstring("deepening"))
+	})
+
+	It("should fail with the failed operation", func() {
+		err := sfs.New().Deepen(makeTemp(), 1)
+
+		var fetchErr *sfs.Error
+		Expect(errors.As(err, &fetchErr)).To(BeTrue())
+		Expect(fetchErr.Op).To(Equal(sfs.OpDeepen))
+		Expect(errors.Unwrap(err)).To(Not(BeNil()))
+	})
+
+	It("should stop and clean up when canceled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		dir := filepath.Join(makeTemp(), "repo")
+		_, err := sfs.New(sfs.WithProgress(nil)).FetchContext(ctx, "http://127.0.0.1:1/repo.git", publicRepo.Commit, dir)
+		Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+
+		var fetchErr *sfs.Error
+		Expect(errors.As(err, &fetchErr)).To(BeTrue())
+		Expect(fetchErr.Op).To(Equal(sfs.OpFetch))
+		Expect(dir).ToNot(BeAnExistingFile())
+	})
+
+	It("should only remove the .git directory of an existing directory when canceled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		dir := makeTemp()
+		_, err := sfs.New(sfs.WithProgress(nil)).FetchContext(ctx, "http://127.0.0.1:1/repo.git", publicRepo.Commit, dir)
+		Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+		Expect(dir).To(BeADirectory())
+		Expect(filepath.Join(dir, ".git")).ToNot(BeAnExistingFile())
+	})
+})
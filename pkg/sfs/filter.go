@@ -0,0 +1,390 @@
+package sfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	log "github.com/sirupsen/logrus"
+)
+
+// filter used when fetching trees that a partial fetch left out
+const treesOnlyFilter = "blob:none"
+
+var (
+	regFilter = regexp.MustCompile(`^(blob:none|blob:limit=[0-9]+[kmg]?|tree:[0-9]+)$`)
+)
+
+func isHTTP(url string) bool {
+	ep, err := transport.NewEndpoint(url)
+	return err == nil && (ep.Protocol == "http" || ep.Protocol == "https")
+}
+
+// uploadPack sends a single upload-pack request for the wanted objects, with
+// the haves, down to depth commits of history from the wants, and writes what
+// it gets back to the repository. Unlike a go-git fetch, it can ask for objects
+// that are already there to deepen their history, and send a partial clone
+// filter. Filters are only sent over smart http, other transports go through
+// go-git's. Filtered and missing objects are fetched without haves, so the
+// server doesn't skip objects it assumes we already have.
+func uploadPack(ctx context.Context, repo *git.Repository, url string, auth transport.AuthMethod, caps *capability.List, wants, haves []plumbing.Hash, depth int, filter string, progress sideband.Progress) error {
+	req := packp.NewUploadPackRequestFromCapabilities(caps)
+	req.Wants = wants
+	req.Haves = haves
+	// go-git writes packs as they come, it can't complete a thin pack with
+	// the objects of the haves
+	req.Capabilities.Delete(capability.ThinPack)
+
+	if depth > 0 {
+		req.Depth = packp.DepthCommits(depth)
+		if err := req.Capabilities.Set(capability.Shallow); err != nil {
+			return err
+		}
+
+		var err error
+		req.Shallows, err = repo.Storer.Shallow()
+		if err != nil {
+			return err
+		}
+	}
+
+	if progress == nil && caps.Supports(capability.NoProgress) {
+		if err := req.Capabilities.Set(capability.NoProgress); err != nil {
+			return err
+		}
+	}
+
+	if filter != "" {
+		if err := req.Capabilities.Set(capability.Filter); err != nil {
+			return err
+		}
+	}
+
+	if err := req.Validate(); err != nil {
+		return err
+	}
+
+	var resp *packp.UploadPackResponse
+	var err error
+	switch {
+	case isHTTP(url):
+		resp, err = uploadPackHTTP(ctx, url, auth, req, filter)
+	case filter != "":
+		return fmt.Errorf("partial clone filters are only supported for http(s) repositories")
+	default:
+		resp, err = uploadPackSession(ctx, url, auth, req)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Close() }()
+
+	if depth > 0 {
+		if err := updateShallow(repo, resp.ShallowUpdate); err != nil {
+			return err
+		}
+	}
+
+	var pack io.Reader = resp
+	switch {
+	case req.Capabilities.Supports(capability.Sideband64k):
+		d := sideband.NewDemuxer(sideband.Sideband64k, resp)
+		d.Progress = progress
+		pack = d
+	case req.Capabilities.Supports(capability.Sideband):
+		d := sideband.NewDemuxer(sideband.Sideband, resp)
+		d.Progress = progress
+		pack = d
+	}
+
+	return packfile.UpdateObjectStorage(repo.Storer, pack)
+}
+
+// uploadPackSession sends req through the transport newClient picks for url,
+// which only takes requests for objects that are all haves with shallow
+// commits. Closing the response ends the session.
+func uploadPackSession(ctx context.Context, url string, auth transport.AuthMethod, req *packp.UploadPackRequest) (*packp.UploadPackResponse, error) {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newClient(ep)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := c.NewUploadPackSession(ep, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := session.UploadPack(ctx, req)
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// uploadPackHTTP sends req over smart http, with a partial clone filter if
+// filter is set.
+func uploadPackHTTP(ctx context.Context, url string, auth transport.AuthMethod, req *packp.UploadPackRequest, filter string) (*packp.UploadPackResponse, error) {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, err
+	}
+
+	body := &bytes.Buffer{}
+	if err := req.UploadRequest.Encode(body); err != nil {
+		return nil, fmt.Errorf("unable to encode upload-pack request: %s", err)
+	}
+
+	enc := pktline.NewEncoder(body)
+	if filter != "" {
+		// the request ends with a flush-pkt, the filter has to go right before it
+		body.Truncate(body.Len() - len(pktline.FlushPkt))
+		if err := enc.EncodeString(fmt.Sprintf("filter %s\n", filter)); err != nil {
+			return nil, err
+		}
+		if err := enc.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := req.UploadHaves.Encode(body, false); err != nil {
+		return nil, fmt.Errorf("unable to encode upload-pack haves: %s", err)
+	}
+	if err := enc.EncodeString("done\n"); err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/%s", ep.String(), transport.UploadPackServiceName), body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", fmt.Sprintf("application/x-%s-request", transport.UploadPackServiceName))
+	httpReq.Header.Set("Accept", fmt.Sprintf("application/x-%s-result", transport.UploadPackServiceName))
+	httpReq.Header.Set("User-Agent", capability.DefaultAgent)
+	if a, ok := auth.(githttp.AuthMethod); ok {
+		a.SetAuth(httpReq)
+	}
+
+	res, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := githttp.NewErr(res); err != nil {
+		_ = res.Body.Close()
+		return nil, err
+	}
+
+	resp := packp.NewUploadPackResponse(req)
+	if err := resp.Decode(res.Body); err != nil {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("unable to decode upload-pack response: %s", err)
+	}
+	return resp, nil
+}
+
+func updateShallow(repo *git.Repository, update packp.ShallowUpdate) error {
+	current, err := repo.Storer.Shallow()
+	if err != nil {
+		return err
+	}
+
+	unshallow := make(map[plumbing.Hash]bool, len(update.Unshallows))
+	for _, h := range update.Unshallows {
+		unshallow[h] = true
+	}
+
+	var shallow []plumbing.Hash
+	for _, h := range append(current, update.Shallows...) {
+		if !unshallow[h] {
+			shallow = append(shallow, h)
+		}
+	}
+
+	return repo.Storer.SetShallow(dedupe(shallow))
+}
+
+// fetchFiltered fetches opts.SHA with the partial clone filter in opts.Filter.
+// Whatever the filter leaves out is fetched by fetchMissingObjects.
+func fetchFiltered(ctx context.Context, repo *git.Repository, opts *Options, auth transport.AuthMethod, caps *capability.List, progress sideband.Progress) error {
+	log.WithFields(log.Fields{
+		"url":    opts.Repo,
+		"filter": opts.Filter,
+	}).Debugln("fetching commit with filter")
+
+	hash := plumbing.NewHash(opts.SHA)
+	err := uploadPack(ctx, repo, opts.Repo, auth, caps, []plumbing.Hash{hash}, nil, opts.depth(), opts.Filter, progress)
+	if err != nil {
+		return err
+	}
+
+	ref := plumbing.NewHashReference(plumbing.NewRemoteReferenceName(remoteName, opts.SHA), hash)
+	return repo.Storer.SetReference(ref)
+}
+
+// markPartialClone configures the repository the way git does after a partial
+// clone, so git knows objects left out by the filter (or a sparse checkout) can
+// be fetched from the remote on demand instead of reporting them as missing.
+func markPartialClone(repo *git.Repository, dir, filter string) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+
+	// extensions are only read by git from repository format version 1
+	cfg.Raw.Section("core").SetOption("repositoryformatversion", "1")
+	cfg.Raw.Section("extensions").SetOption("partialclone", remoteName)
+	remote := cfg.Raw.Section("remote").Subsection(remoteName)
+	remote.SetOption("promisor", "true")
+	remote.SetOption("partialclonefilter", filter)
+	if err := repo.SetConfig(cfg); err != nil {
+		return err
+	}
+
+	packs, err := filepath.Glob(filepath.Join(dir, git.GitDirName, "objects", "pack", "pack-*.pack"))
+	if err != nil {
+		return err
+	}
+
+	for _, pack := range packs {
+		promisor := strings.TrimSuffix(pack, ".pack") + ".promisor"
+		if err := os.WriteFile(promisor, nil, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isPartialClone reports whether markPartialClone was called on repo, so it
+// can be missing objects.
+func isPartialClone(repo *git.Repository) bool {
+	cfg, err := repo.Config()
+	if err != nil {
+		return false
+	}
+	return cfg.Raw.Section("extensions").Option("partialclone") != ""
+}
+
+func hasObject(repo *git.Repository, h plumbing.Hash) bool {
+	_, err := repo.Storer.EncodedObject(plumbing.AnyObject, h)
+	return err == nil
+}
+
+// missingObjects walks the tree of a commit and returns the trees and blobs
+// left out of a partial fetch. Trees that are missing can't be walked, so
+// their contents only show up once the trees themselves are fetched. Blobs
+// that won't be checked out by the sparse matcher aren't needed.
+func missingObjects(repo *git.Repository, tree plumbing.Hash, dir string, sparse *SparseMatcher) (trees, blobs []plumbing.Hash, err error) {
+	if !hasObject(repo, tree) {
+		return []plumbing.Hash{tree}, nil, nil
+	}
+
+	t, err := object.GetTree(repo.Storer, tree)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, entry := range t.Entries {
+		name := path.Join(dir, entry.Name)
+		switch entry.Mode {
+		case filemode.Submodule:
+			continue
+		case filemode.Dir:
+			subtrees, subblobs, err := missingObjects(repo, entry.Hash, name, sparse)
+			if err != nil {
+				return nil, nil, err
+			}
+			trees = append(trees, subtrees...)
+			blobs = append(blobs, subblobs...)
+		default:
+			if sparse.Match(name) && !hasObject(repo, entry.Hash) {
+				blobs = append(blobs, entry.Hash)
+			}
+		}
+	}
+
+	return trees, blobs, nil
+}
+
+// fetchMissingObjects fills in whatever a filter left out of the trees of the
+// commits so they can be checked out: first any missing trees (without their
+// blobs), then the missing blobs of the files being checked out.
+func fetchMissingObjects(ctx context.Context, repo *git.Repository, commits []plumbing.Hash, opts *Options, auth transport.AuthMethod, sparse *SparseMatcher, progress sideband.Progress) error {
+	var roots []plumbing.Hash
+	for _, h := range commits {
+		commit, err := repo.CommitObject(h)
+		if err != nil {
+			return err
+		}
+		roots = append(roots, commit.TreeHash)
+	}
+
+	var caps *capability.List
+	for {
+		var trees, blobs []plumbing.Hash
+		for _, root := range roots {
+			t, b, err := missingObjects(repo, root, "", sparse)
+			if err != nil {
+				return err
+			}
+			trees = append(trees, t...)
+			blobs = append(blobs, b...)
+		}
+
+		if len(trees) == 0 && len(blobs) == 0 {
+			return nil
+		}
+
+		if caps == nil {
+			ar, err := advertisedRefs(ctx, opts.Repo, auth)
+			if err != nil {
+				return err
+			}
+			caps = ar.Capabilities
+		}
+
+		wants, filter := dedupe(blobs), ""
+		if len(trees) > 0 {
+			// blobs can't be known until the trees holding them are here
+			wants, filter = dedupe(trees), treesOnlyFilter
+		}
+
+		log.WithFields(log.Fields{
+			"trees": len(trees),
+			"blobs": len(blobs),
+		}).Debugln("fetching objects left out by filter")
+		if err := uploadPack(ctx, repo, opts.Repo, auth, caps, wants, nil, 0, filter, progress); err != nil {
+			return err
+		}
+
+		for _, h := range wants {
+			if !hasObject(repo, h) {
+				return fmt.Errorf("server did not send object %s", h)
+			}
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package sfs
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// How the host keys of ssh servers are verified.
+const (
+	// HostKeyStrict only accepts host keys in known_hosts, the default.
+	HostKeyStrict = "strict"
+	// HostKeyTOFU trusts the key of a host that isn't in known_hosts yet on
+	// first use, adding it to the first known_hosts file, and then verifies it
+	// like HostKeyStrict. A host with another key is still refused.
+	HostKeyTOFU = "tofu"
+	// HostKeyInsecure accepts any host key, so the connection can be
+	// intercepted. Only meant for testing.
+	HostKeyInsecure = "insecure-ignore-host-key"
+)
+
+// host key failures are only reported as a message by x/crypto/ssh
+const hostKeyFailed = "host key verification failed"
+
+// hostKeyVerifier verifies the host keys of ssh servers with the known_hosts
+// files, the pinned fingerprints and the policy of SSHAuthOptions. known_hosts
+// is read again for every connection, to see what an earlier one added.
+type hostKeyVerifier struct {
+	files  []string
+	pins   []string
+	policy string
+}
+
+func newHostKeyVerifier(o *SSHAuthOptions) *hostKeyVerifier {
+	v := &hostKeyVerifier{
+		files:  o.KnownHosts,
+		pins:   o.HostKeyFingerprints,
+		policy: o.HostKeyPolicy,
+	}
+	if v.policy == HostKeyInsecure {
+		log.Warn("NOT verifying ssh host keys, anyone on the network can intercept the connection and its credentials")
+	}
+	return v
+}
+
+func (v *hostKeyVerifier) check(hostname string, remote net.Addr, key cryptossh.PublicKey) error {
+	// a host certificate is pinned, and trusted on first use, by its key
+	plain := key
+	cert, isCert := key.(*cryptossh.Certificate)
+	if isCert {
+		plain = cert.Key
+	}
+	fingerprint := cryptossh.FingerprintSHA256(plain)
+
+	switch {
+	case v.policy == HostKeyInsecure:
+		log.WithFields(log.Fields{
+			"host":        hostname,
+			"fingerprint": fingerprint,
+		}).Warn("accepting ssh host key without verifying it")
+		return nil
+	case len(v.pins) > 0:
+		for _, pin := range v.pins {
+			if matchFingerprint(plain, pin) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: %s has host key %s, which isn't one of the pinned fingerprints", hostKeyFailed, hostname, fingerprint)
+	}
+
+	files, err := knownHostsFiles(v.files, v.policy == HostKeyTOFU)
+	if err != nil {
+		return fmt.Errorf("%s: %s", hostKeyFailed, err)
+	}
+
+	var existing []string
+	for _, f := range files {
+		if _, err := os.Stat(f); err == nil || v.policy != HostKeyTOFU {
+			existing = append(existing, f)
+		}
+	}
+
+	// host certificates are verified with the @cert-authority lines
+	callback, err := knownhosts.New(existing...)
+	if err != nil {
+		return fmt.Errorf("%s: unable to read known_hosts: %s", hostKeyFailed, err)
+	}
+
+	err = callback(hostname, remote, key)
+	if isCert && err != nil {
+		// x/crypto/ssh only tells a certificate of an unknown authority
+		// apart by its message
+		if !strings.Contains(err.Error(), "no authorities for hostname") {
+			return fmt.Errorf("%s: host certificate %s of %s isn't valid: %s", hostKeyFailed, cert.KeyId, hostname, err)
+		}
+
+		// like ssh, fall back to the key of the certificate
+		log.WithFields(log.Fields{
+			"host":        hostname,
+			"fingerprint": cryptossh.FingerprintSHA256(cert.SignatureKey),
+		}).Debugln("no @cert-authority for the host certificate, verifying its key")
+		err = callback(hostname, remote, plain)
+	}
+
+	var keyErr *knownhosts.KeyError
+	var revokedErr *knownhosts.RevokedError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &revokedErr):
+		return fmt.Errorf("%s: host key %s of %s is revoked in %s:%d", hostKeyFailed, fingerprint, hostname, revokedErr.Revoked.Filename, revokedErr.Revoked.Line)
+	case errors.As(err, &keyErr) && len(keyErr.Want) > 0:
+		want := keyErr.Want[0]
+		return fmt.Errorf("%s: %s has host key %s, but %s:%d has %s for it, the key changed or the connection is intercepted", hostKeyFailed, hostname, fingerprint, want.Filename, want.Line, cryptossh.FingerprintSHA256(want.Key))
+	case errors.As(err, &keyErr) && v.policy == HostKeyTOFU:
+		return trustHostKey(files[0], hostname, remote, plain)
+	case errors.As(err, &keyErr) && isCert:
+		return fmt.Errorf("%s: %s has a host certificate signed by %s, which isn't a @cert-authority in known_hosts (%s), and its key %s isn't there either", hostKeyFailed, hostname, cryptossh.FingerprintSHA256(cert.SignatureKey), strings.Join(existing, ", "), fingerprint)
+	case errors.As(err, &keyErr):
+		return fmt.Errorf("%s: %s, with host key %s, isn't in known_hosts (%s), add it with ssh-keyscan or pin its fingerprint", hostKeyFailed, hostname, fingerprint, strings.Join(existing, ", "))
+	}
+	return fmt.Errorf("%s: %s", hostKeyFailed, err)
+}
+
+// trustHostKey adds the key of a host seen for the first time to the
+// known_hosts file at path.
+func trustHostKey(path, hostname string, remote net.Addr, key cryptossh.PublicKey) error {
+	log.WithFields(log.Fields{
+		"host":        hostname,
+		"fingerprint": cryptossh.FingerprintSHA256(key),
+		"known_hosts": path,
+	}).Warn("trusting ssh host key on first use")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("%s: %s", hostKeyFailed, err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("%s: %s", hostKeyFailed, err)
+	}
+
+	addresses := []string{knownhosts.Normalize(hostname)}
+	if ip := knownhosts.Normalize(remote.String()); ip != addresses[0] {
+		addresses = append(addresses, ip)
+	}
+	_, err = fmt.Fprintln(f, knownhosts.Line(addresses, key))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: unable to add host key to %s: %s", hostKeyFailed, path, err)
+	}
+	return nil
+}
+
+// knownHostsFiles are the known_hosts files to verify host keys with: files
+// if any, else those of $SSH_KNOWN_HOSTS, else ~/.ssh/known_hosts and
+// /etc/ssh/ssh_known_hosts, like git does. Missing default files are left
+// out, unless keep is set to add keys to the first one.
+func knownHostsFiles(files []string, keep bool) ([]string, error) {
+	if len(files) > 0 {
+		return files, nil
+	}
+
+	defaults := filepath.SplitList(os.Getenv("SSH_KNOWN_HOSTS"))
+	if len(defaults) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		defaults = []string{filepath.Join(home, ".ssh", "known_hosts"), "/etc/ssh/ssh_known_hosts"}
+	}
+	if keep {
+		return defaults, nil
+	}
+
+	var found []string
+	for _, f := range defaults {
+		if _, err := os.Stat(f); err == nil {
+			found = append(found, f)
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no known_hosts file, looked for %s", strings.Join(defaults, ", "))
+	}
+	return found, nil
+}
+
+// matchFingerprint reports whether fingerprint is the one of key: SHA256:
+// followed by base64, like ssh-keygen -l shows it, or the legacy MD5 one with
+// or without the MD5: prefix.
+func matchFingerprint(key cryptossh.PublicKey, fingerprint string) bool {
+	if fingerprint == cryptossh.FingerprintSHA256(key) {
+		return true
+	}
+	return strings.TrimPrefix(fingerprint, "MD5:") == cryptossh.FingerprintLegacyMD5(key)
+}
+
+// validFingerprint reports whether fingerprint looks like one matchFingerprint
+// takes.
+func validFingerprint(fingerprint string) bool {
+	if strings.HasPrefix(fingerprint, "SHA256:") {
+		return len(fingerprint) > len("SHA256:")
+	}
+	md5 := strings.TrimPrefix(fingerprint, "MD5:")
+	return len(md5) == 47 && strings.Count(md5, ":") == 15
+}
@@ -0,0 +1,172 @@
+package sfs_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newHostKey makes a new ed25519 host key.
+func newHostKey() cryptossh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	plsno(err)
+	key, err := cryptossh.NewPublicKey(pub)
+	plsno(err)
+	return key
+}
+
+var _ = Describe("Host keys", func() {
+	var (
+		options  sfs.Options
+		hostKey  cryptossh.PublicKey
+		remote   = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+		stop     func()
+		prevSock string
+		hadSock  bool
+	)
+
+	BeforeEach(func() {
+		options = sfs.Options{
+			Repo:      publicRepo.SSH,
+			SHA:       publicRepo.Commit,
+			Directory: makeTemp(),
+		}
+		hostKey = newHostKey()
+		prevSock, hadSock = os.LookupEnv("SSH_AUTH_SOCK")
+		_, stop = startAgent("work")
+	})
+
+	AfterEach(func() {
+		stop()
+		if hadSock {
+			plsno(os.Setenv("SSH_AUTH_SOCK", prevSock))
+		} else {
+			plsno(os.Unsetenv("SSH_AUTH_SOCK"))
+		}
+	})
+
+	// check verifies key as the host key of example.com with the options.
+	check := func(key cryptossh.PublicKey) error {
+		Expect(options.Validate()).To(BeNil())
+		auth, err := options.Auth()
+		Expect(err).To(BeNil())
+
+		callback, ok := auth.(*ssh.PublicKeysCallback)
+		Expect(ok).To(BeTrue())
+		return callback.HostKeyCallback("example.com:22", remote, key)
+	}
+
+	knownHosts := func(keys ...cryptossh.PublicKey) string {
+		path := filepath.Join(makeTemp(), "known_hosts")
+		contents := ""
+		for _, key := range keys {
+			contents += knownhosts.Line([]string{"example.com"}, key) + "\n"
+		}
+		plsno(os.WriteFile(path, []byte(contents), 0644))
+		return path
+	}
+
+	It("should accept a host key in known_hosts", func() {
+		options.SSHAuth = &sfs.SSHAuthOptions{KnownHosts: []string{knownHosts(), knownHosts(hostKey)}}
+		Expect(check(hostKey)).To(BeNil())
+	})
+
+	It("should refuse a host key that changed", func() {
+		path := knownHosts(hostKey)
+		options.SSHAuth = &sfs.SSHAuthOptions{KnownHosts: []string{path}}
+
+		err := check(newHostKey())
+		Expect(err).To(MatchError(ContainSubstring(path + ":1 has " + cryptossh.FingerprintSHA256(hostKey))))
+	})
+
+	It("should refuse a host that isn't in known_hosts", func() {
+		options.SSHAuth = &sfs.SSHAuthOptions{KnownHosts: []string{knownHosts()}}
+
+		err := check(hostKey)
+		Expect(err).To(MatchError(ContainSubstring("isn't in known_hosts")))
+
+		// x/crypto/ssh only keeps the message
+		err = &sfs.Error{Op: sfs.OpFetch, Err: fmt.Errorf("ssh: handshake failed: %v", err)}
+		Expect(errors.Is(err, sfs.ErrAuth)).To(BeTrue())
+	})
+
+	It("should only accept pinned host keys", func() {
+		options.SSHAuth = &sfs.SSHAuthOptions{HostKeyFingerprints: []string{cryptossh.FingerprintSHA256(hostKey)}}
+		Expect(check(hostKey)).To(BeNil())
+		Expect(check(newHostKey())).To(MatchError(ContainSubstring("pinned")))
+
+		options.SSHAuth = &sfs.SSHAuthOptions{HostKeyFingerprints: []string{"MD5:" + cryptossh.FingerprintLegacyMD5(hostKey)}}
+		Expect(check(hostKey)).To(BeNil())
+	})
+
+	It("should trust a new host key on first use", func() {
+		path := filepath.Join(makeTemp(), "ssh", "known_hosts")
+		options.SSHAuth = &sfs.SSHAuthOptions{KnownHosts: []string{path}, HostKeyPolicy: sfs.HostKeyTOFU}
+
+		Expect(check(hostKey)).To(BeNil())
+		contents, err := os.ReadFile(path)
+		Expect(err).To(BeNil())
+		Expect(string(contents)).To(ContainSubstring(knownhosts.Line([]string{"example.com", "127.0.0.1"}, hostKey)))
+
+		Expect(check(hostKey)).To(BeNil())
+		Expect(check(newHostKey())).To(MatchError(ContainSubstring("the key changed")))
+	})
+
+	It("should accept a host certificate of a known authority", func() {
+		ca := newCA()
+		path := filepath.Join(makeTemp(), "known_hosts")
+		line := "@cert-authority *.com " + string(cryptossh.MarshalAuthorizedKey(ca.PublicKey()))
+		plsno(os.WriteFile(path, []byte(line), 0644))
+		options.SSHAuth = &sfs.SSHAuthOptions{KnownHosts: []string{path}}
+
+		tomorrow := time.Now().Add(24 * time.Hour)
+		Expect(check(signCert(ca, hostKey, cryptossh.HostCert, tomorrow, "example.com"))).To(BeNil())
+
+		err := check(signCert(ca, hostKey, cryptossh.HostCert, tomorrow, "example.org"))
+		Expect(err).To(MatchError(ContainSubstring("host certificate sfs-test of example.com:22 isn't valid")))
+
+		err = check(signCert(ca, hostKey, cryptossh.HostCert, time.Now().Add(-time.Second), "example.com"))
+		Expect(err).To(MatchError(ContainSubstring("isn't valid")))
+	})
+
+	It("should verify the key of a host certificate of an unknown authority", func() {
+		cert := signCert(newCA(), hostKey, cryptossh.HostCert, time.Now().Add(24*time.Hour), "example.com")
+
+		options.SSHAuth = &sfs.SSHAuthOptions{KnownHosts: []string{knownHosts(hostKey)}}
+		Expect(check(cert)).To(BeNil())
+
+		options.SSHAuth = &sfs.SSHAuthOptions{KnownHosts: []string{knownHosts()}}
+		Expect(check(cert)).To(MatchError(ContainSubstring("isn't a @cert-authority")))
+	})
+
+	It("should accept any host key when ignoring them", func() {
+		options.SSHAuth = &sfs.SSHAuthOptions{HostKeyPolicy: sfs.HostKeyInsecure}
+		Expect(check(hostKey)).To(BeNil())
+	})
+
+	It("should fail for invalid host key options", func() {
+		options.SSHAuth = &sfs.SSHAuthOptions{HostKeyPolicy: "ask"}
+		Expect(options.Validate()).To(Not(BeNil()))
+
+		options.SSHAuth = &sfs.SSHAuthOptions{HostKeyFingerprints: []string{"p2QAMXNIC1TJYWeIOttrVc98"}}
+		Expect(options.Validate()).To(Not(BeNil()))
+
+		options.SSHAuth = &sfs.SSHAuthOptions{
+			HostKeyFingerprints: []string{cryptossh.FingerprintSHA256(hostKey)},
+			HostKeyPolicy:       sfs.HostKeyInsecure,
+		}
+		Expect(options.Validate()).To(Not(BeNil()))
+	})
+})
@@ -0,0 +1,26 @@
+package sfs
+
+import (
+	"net/http"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// httpClient sends the http(s) requests go-git can't make for us, upload-pack
+// requests with a filter and lfs batch and object requests. It's the client
+// go-git's http transport is installed with.
+var httpClient = http.DefaultClient
+
+// SetHTTPClient sends every http(s) request through c, go-git's and the ones
+// for partial clone filters and lfs objects alike, e.g. for a proxy or custom
+// TLS config. nil restores http.DefaultClient. Like go-git's InstallProtocol,
+// it must not be called while fetching.
+func SetHTTPClient(c *http.Client) {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	httpClient = c
+	client.InstallProtocol("http", githttp.NewClient(c))
+	client.InstallProtocol("https", githttp.NewClient(c))
+}
@@ -0,0 +1,537 @@
+package sfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	lfsVersion = "https://git-lfs.github.com/spec/v1"
+	// pointer files are always smaller than this, see the git-lfs spec
+	lfsMaxPointerSize = 1024
+	lfsMediaType      = "application/vnd.git-lfs+json"
+	// objects per batch api request, same as git-lfs
+	lfsBatchSize = 100
+)
+
+var errLFSUnsupported = errors.New("lfs is not supported")
+
+// LFSPointer is the content of a git-lfs pointer file.
+type LFSPointer struct {
+	OID  string
+	Size int64
+}
+
+// ParseLFSPointer parses a git-lfs pointer file, returning false if the data
+// isn't one.
+func ParseLFSPointer(data []byte) (*LFSPointer, bool) {
+	if len(data) >= lfsMaxPointerSize {
+		return nil, false
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() || scanner.Text() != "version "+lfsVersion {
+		return nil, false
+	}
+
+	pointer := &LFSPointer{Size: -1}
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), " ", 2)
+		if len(kv) != 2 {
+			return nil, false
+		}
+
+		key, value := kv[0], kv[1]
+		switch key {
+		case "oid":
+			oid := strings.TrimPrefix(value, "sha256:")
+			if len(oid) != 64 || oid == value || !regHex.MatchString(oid) {
+				return nil, false
+			}
+			pointer.OID = oid
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return nil, false
+			}
+			pointer.Size = size
+		}
+	}
+
+	if pointer.OID == "" || pointer.Size < 0 {
+		return nil, false
+	}
+	return pointer, true
+}
+
+// lfsFile is an lfs object and the checked out paths that point to it.
+type lfsFile struct {
+	pointer *LFSPointer
+	paths   []string
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type lfsObject struct {
+	OID     string               `json:"oid"`
+	Size    int64                `json:"size"`
+	Actions map[string]lfsAction `json:"actions,omitempty"`
+	Error   *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+type lfsBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers"`
+	Objects   []lfsObject `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Objects []lfsObject `json:"objects"`
+}
+
+// lfsPointers finds the pointer files among the checked out files of a commit
+// that match the lfs include/exclude patterns, grouped by object.
+func lfsPointers(commit *object.Commit, sparse, lfs *SparseMatcher) ([]*lfsFile, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	byOID := make(map[string]*lfsFile)
+	var files []*lfsFile
+
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if f.Mode != filemode.Regular && f.Mode != filemode.Executable {
+			return nil
+		}
+
+		if f.Size >= lfsMaxPointerSize || !sparse.Match(f.Name) || !lfs.Match(f.Name) {
+			return nil
+		}
+
+		contents, err := f.Contents()
+		if err != nil {
+			return err
+		}
+
+		pointer, ok := ParseLFSPointer([]byte(contents))
+		if !ok {
+			return nil
+		}
+
+		file, ok := byOID[pointer.OID]
+		if !ok {
+			file = &lfsFile{pointer: pointer}
+			byOID[pointer.OID] = file
+			files = append(files, file)
+		}
+		file.paths = append(file.paths, f.Name)
+		return nil
+	})
+
+	return files, err
+}
+
+// lfsClient talks to the lfs server of a repository.
+type lfsClient struct {
+	endpoint string
+	header   map[string]string
+	auth     githttp.AuthMethod
+}
+
+// newLFSClient finds the lfs endpoint of a repository the same way git-lfs
+// does: <repo>.git/info/lfs for http(s) repos, and git-lfs-authenticate for
+// ssh repos, falling back to the https url of the repo if that fails.
+func newLFSClient(ctx context.Context, url string, auth transport.AuthMethod) (*lfsClient, error) {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, err
+	}
+
+	switch ep.Protocol {
+	case "http", "https":
+		client := &lfsClient{endpoint: lfsEndpoint(url)}
+		client.auth, _ = auth.(githttp.AuthMethod)
+		return client, nil
+	case "ssh":
+		client, err := sshLFSAuthenticate(ctx, ep, auth)
+		if err == nil {
+			return client, nil
+		}
+
+		log.WithField("host", ep.Host).Debugln("git-lfs-authenticate failed, using https:", err)
+		return &lfsClient{endpoint: lfsEndpoint("https://" + ep.Host + "/" + strings.TrimPrefix(ep.Path, "/"))}, nil
+	default:
+		return nil, fmt.Errorf("%w for %s urls", errLFSUnsupported, ep.Protocol)
+	}
+}
+
+func lfsEndpoint(url string) string {
+	url = strings.TrimSuffix(url, "/")
+	if !strings.HasSuffix(url, ".git") {
+		url += ".git"
+	}
+	return url + "/info/lfs"
+}
+
+// sshLFSAuthenticate runs git-lfs-authenticate on the ssh server of the repo,
+// which replies with the lfs endpoint and the headers to authenticate with.
+func sshLFSAuthenticate(ctx context.Context, ep *transport.Endpoint, auth transport.AuthMethod) (*lfsClient, error) {
+	sshAuth, err := sshAuthMethod(ep, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := sshAuth.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialSSH(ctx, sshAddr(ep), config)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = session.Close() }()
+
+	out, err := session.Output(fmt.Sprintf("git-lfs-authenticate '%s' download", ep.Path))
+	if err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		Href   string            `json:"href"`
+		Header map[string]string `json:"header"`
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return nil, fmt.Errorf("invalid git-lfs-authenticate response: %s", err)
+	}
+
+	return &lfsClient{endpoint: res.Href, header: res.Header}, nil
+}
+
+// authorize sets the endpoint's credentials on a request, unless the request
+// already carries its own or is to another host.
+func (c *lfsClient) authorize(req *http.Request, header map[string]string) {
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	if req.Header.Get("Authorization") != "" {
+		return
+	}
+
+	endpoint, err := neturl.Parse(c.endpoint)
+	if err != nil || endpoint.Host != req.URL.Host {
+		return
+	}
+
+	for k, v := range c.header {
+		req.Header.Set(k, v)
+	}
+	if c.auth != nil {
+		c.auth.SetAuth(req)
+	}
+}
+
+func (c *lfsClient) batch(ctx context.Context, objects []lfsObject) ([]lfsObject, error) {
+	body, err := json.Marshal(lfsBatchRequest{
+		Operation: "download",
+		Transfers: []string{"basic"},
+		Objects:   objects,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+	c.authorize(req, nil)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &statusError{msg: "lfs batch request failed", status: res.Status, code: res.StatusCode}
+	}
+
+	var batch lfsBatchResponse
+	if err := json.NewDecoder(res.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("invalid lfs batch response: %s", err)
+	}
+	return batch.Objects, nil
+}
+
+// download fetches an object into a temporary file next to dest, checks it
+// against the pointer and then replaces dest with it.
+func (c *lfsClient) download(ctx context.Context, action lfsAction, pointer *LFSPointer, dest string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, action.Href, nil)
+	if err != nil {
+		return err
+	}
+	c.authorize(req, action.Header)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode != http.StatusOK {
+		return &statusError{msg: "download failed", status: res.Status, code: res.StatusCode}
+	}
+
+	return replaceFile(dest, io.LimitReader(res.Body, pointer.Size+1), pointer)
+}
+
+// replaceFile writes r to a temporary file next to dest, checks the content
+// matches the pointer and then renames it over dest, keeping its mode.
+func replaceFile(dest string, r io.Reader, pointer *LFSPointer) error {
+	info, err := os.Lstat(dest)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".sfs-lfs-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if n != pointer.Size {
+		return fmt.Errorf("expected %d bytes, got %d", pointer.Size, n)
+	}
+	if oid := hex.EncodeToString(hash.Sum(nil)); oid != pointer.OID {
+		return fmt.Errorf("content doesn't match oid, got sha256:%s", oid)
+	}
+
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// fetchLFS replaces the git-lfs pointer files in the checkout of opts.SHA with
+// the content they point to, downloaded with the lfs batch api.
+func fetchLFS(ctx context.Context, repo *git.Repository, dir string, opts *Options, auth transport.AuthMethod, sparse *SparseMatcher) error {
+	commit, err := repo.CommitObject(plumbing.NewHash(opts.SHA))
+	if err != nil {
+		return err
+	}
+
+	var lfs *SparseMatcher
+	if patterns := includeExclude(nil, opts.LFSInclude, opts.LFSExclude); len(patterns) > 0 {
+		lfs = NewSparseMatcher(patterns)
+	}
+
+	files, err := lfsPointers(commit, sparse, lfs)
+	if err != nil {
+		return err
+	}
+
+	wanted := files[:0]
+	for _, file := range files {
+		if opts.LFSMaxSize > 0 && file.pointer.Size > opts.LFSMaxSize {
+			log.WithFields(log.Fields{
+				"paths": file.paths,
+				"size":  file.pointer.Size,
+			}).Warnln("lfs object is larger than max size, leaving pointer")
+			continue
+		}
+		wanted = append(wanted, file)
+	}
+
+	if len(wanted) == 0 {
+		log.Debugln("no lfs objects to fetch")
+		return nil
+	}
+
+	client, err := newLFSClient(ctx, opts.Repo, auth)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"objects":  len(wanted),
+		"endpoint": client.endpoint,
+	}).Info("fetching lfs objects")
+
+	var fetched, failed []string
+	for start := 0; start < len(wanted); start += lfsBatchSize {
+		end := start + lfsBatchSize
+		if end > len(wanted) {
+			end = len(wanted)
+		}
+		chunk := wanted[start:end]
+
+		objects := make([]lfsObject, 0, len(chunk))
+		byOID := make(map[string]*lfsFile, len(chunk))
+		for _, file := range chunk {
+			objects = append(objects, lfsObject{OID: file.pointer.OID, Size: file.pointer.Size})
+			byOID[file.pointer.OID] = file
+		}
+
+		var results []lfsObject
+		err := retry(ctx, opts.Retry, OpLFS, func() (err error) {
+			results, err = client.batch(ctx, objects)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, result := range results {
+			file, ok := byOID[result.OID]
+			if !ok {
+				continue
+			}
+			delete(byOID, result.OID)
+
+			if err := fetchLFSFile(ctx, client, opts.Retry, dir, file, result); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				log.WithFields(log.Fields{
+					"oid":   result.OID,
+					"paths": file.paths,
+				}).Errorln(err)
+				failed = append(failed, file.paths...)
+				continue
+			}
+			fetched = append(fetched, file.paths...)
+		}
+
+		for _, file := range byOID {
+			log.WithField("oid", file.pointer.OID).Errorln("lfs server did not return object")
+			failed = append(failed, file.paths...)
+		}
+	}
+
+	if len(fetched) > 0 {
+		if err := refreshIndex(repo, dir, fetched); err != nil {
+			return err
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to fetch lfs objects for: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// fetchLFSFile downloads one object to its first path and copies it to the
+// other paths pointing to the same object.
+func fetchLFSFile(ctx context.Context, client *lfsClient, policy RetryPolicy, dir string, file *lfsFile, result lfsObject) error {
+	if result.Error != nil {
+		return fmt.Errorf("lfs server error %d: %s", result.Error.Code, result.Error.Message)
+	}
+
+	action, ok := result.Actions["download"]
+	if !ok {
+		return fmt.Errorf("lfs server returned no download action")
+	}
+
+	first := filepath.Join(dir, filepath.FromSlash(file.paths[0]))
+	err := retry(ctx, policy, OpLFS, func() error {
+		return client.download(ctx, action, file.pointer, first)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, path := range file.paths[1:] {
+		if err := copyLFSFile(first, filepath.Join(dir, filepath.FromSlash(path)), file.pointer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshIndex updates the stat info of the index entries of files replaced
+// by their lfs objects, so they aren't taken for local changes on the next
+// update. The entries keep the hash of the pointer, like git lfs leaves them.
+func refreshIndex(repo *git.Repository, dir string, paths []string) error {
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return err
+	}
+
+	replaced := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		replaced[path] = true
+	}
+
+	for _, e := range idx.Entries {
+		if !replaced[e.Name] {
+			continue
+		}
+
+		info, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(e.Name)))
+		if err != nil {
+			return err
+		}
+		e.CreatedAt = info.ModTime()
+		e.ModifiedAt = info.ModTime()
+		e.Size = uint32(info.Size())
+	}
+
+	return writeIndex(filepath.Join(dir, git.GitDirName, "index"), idx.Entries)
+}
+
+func copyLFSFile(src, dest string, pointer *LFSPointer) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	return replaceFile(dest, f, pointer)
+}
@@ -0,0 +1,141 @@
+package sfs_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+var _ = Describe("ParseLFSPointer", func() {
+	oid := "439a555851e0a2161739739ce37b569505f25133d8bba50043f15722fcf1e510"
+
+	It("should parse pointer files", func() {
+		pointer, ok := sfs.ParseLFSPointer([]byte("version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\nsize 13\n"))
+		Expect(ok).To(BeTrue())
+		Expect(pointer.OID).To(Equal(oid))
+		Expect(pointer.Size).To(Equal(int64(13)))
+	})
+
+	It("should ignore extension keys", func() {
+		pointer, ok := sfs.ParseLFSPointer([]byte("version https://git-lfs.github.com/spec/v1\next-0-foo sha256:" + oid + "\noid sha256:" + oid + "\nsize 0\n"))
+		Expect(ok).To(BeTrue())
+		Expect(pointer.Size).To(Equal(int64(0)))
+	})
+
+	It("should not parse other files", func() {
+		for _, data := range []string{
+			"",
+			"hello world\n",
+			"version https://git-lfs.github.com/spec/v1\nsize 13\n",
+			"version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\n",
+			"version https://git-lfs.github.com/spec/v1\noid md5:" + oid + "\nsize 13\n",
+			"version https://git-lfs.github.com/spec/v1\noid sha256:abc\nsize 13\n",
+			"version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\nsize -1\n",
+			"version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\nsize 13\n" + strings.Repeat("x", 1024),
+		} {
+			_, ok := sfs.ParseLFSPointer([]byte(data))
+			Expect(ok).To(BeFalse(), data)
+		}
+	})
+})
+
+// lfsServer serves root/repo.git, made by gitRepo, along with an lfs server
+// that has the given objects, by oid. It returns the url of the repository
+// and a func to stop serving it.
+func lfsServer(root string, objects map[string][]byte) (string, func()) {
+	mux := http.NewServeMux()
+	mux.Handle("/", gitHandler(root))
+
+	var srv *httptest.Server
+	mux.HandleFunc("/repo.git/info/lfs/objects/batch", func(w http.ResponseWriter, r *http.Request) {
+		var batch struct {
+			Objects []map[string]interface{} `json:"objects"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, obj := range batch.Objects {
+			obj["actions"] = map[string]interface{}{
+				"download": map[string]string{"href": srv.URL + "/lfs/" + obj["oid"].(string)},
+			}
+		}
+		w.Header().Set("Content-Type", "application/vnd.git-lfs+json")
+		plsno(json.NewEncoder(w).Encode(batch))
+	})
+	mux.HandleFunc("/lfs/", func(w http.ResponseWriter, r *http.Request) {
+		data, ok := objects[strings.TrimPrefix(r.URL.Path, "/lfs/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	})
+
+	srv = httptest.NewServer(mux)
+	return srv.URL + "/repo.git", srv.Close
+}
+
+// commitFile commits a file to the branch of HEAD in root/repo.git, made by
+// gitRepo, and returns the new commit.
+func commitFile(root, name string, data []byte) string {
+	work := filepath.Join(root, "work")
+	plsno(os.WriteFile(filepath.Join(work, name), data, 0644))
+	for _, args := range [][]string{
+		{"add", name},
+		{"-c", "user.name=sfs", "-c", "user.email=sfs@example.com", "commit", "-q", "-m", "add " + name},
+		{"push", "-q", filepath.Join(root, "repo.git"), "HEAD"},
+	} {
+		out, err := exec.Command("git", append([]string{"-C", work}, args...)...).CombinedOutput()
+		if err != nil {
+			panic(fmt.Sprintf("git %s: %s: %s", strings.Join(args, " "), err, out))
+		}
+	}
+
+	out, err := exec.Command("git", "-C", work, "rev-parse", "HEAD").Output()
+	plsno(err)
+	return strings.TrimSpace(string(out))
+}
+
+var _ = Describe("LFS", func() {
+	It("should update a checkout with lfs objects", func() {
+		root, _ := gitRepo(1)
+		content := []byte("large file content\n")
+		sum := sha256.Sum256(content)
+		oid := hex.EncodeToString(sum[:])
+		pointer := fmt.Sprintf("version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n", oid, len(content))
+		sha := commitFile(root, "big.bin", []byte(pointer))
+
+		url, stop := lfsServer(root, map[string][]byte{oid: content})
+		defer stop()
+
+		dir := makeTemp()
+		options := sfs.Options{
+			Repo:          url,
+			SHA:           sha,
+			Directory:     dir,
+			LFS:           true,
+			FallbackDepth: 1,
+			Silent:        true,
+		}
+		Expect(sfs.ShallowFetchSHA(&options)).To(BeNil())
+		Expect(os.ReadFile(filepath.Join(dir, "big.bin"))).To(Equal(content))
+
+		// the replaced pointer isn't a local change
+		options.SHA = commitFile(root, "2.txt", []byte("2\n"))
+		Expect(sfs.ShallowFetchSHA(&options)).To(BeNil())
+		Expect(os.ReadFile(filepath.Join(dir, "big.bin"))).To(Equal(content))
+		Expect(filepath.Join(dir, "2.txt")).To(BeAnExistingFile())
+	})
+})
@@ -0,0 +1,271 @@
+package sfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Manifest is a list of repositories to fetch, along with named credentials
+// they can reference. Both YAML and JSON manifests are supported, and values
+// can reference environment variables with ${VAR} so secrets stay out of the
+// file.
+type Manifest struct {
+	Auth  map[string]ManifestAuth `yaml:"auth"`
+	Repos []ManifestEntry         `yaml:"repos"`
+}
+
+type ManifestAuth struct {
+	Username      string `yaml:"username"`
+	Password      string `yaml:"password"`
+	KeyPath       string `yaml:"key-path"`
+	KeyPassphrase string `yaml:"key-passphrase"`
+	SSHAgent      bool   `yaml:"ssh-agent"`
+	AgentKey      string `yaml:"agent-key"`
+	KeyCert       string `yaml:"key-cert"`
+	// host key verification, the flags' when not set
+	KnownHosts          []string `yaml:"known-hosts"`
+	HostKeyFingerprints []string `yaml:"host-key-fingerprints"`
+	HostKeyPolicy       string   `yaml:"host-key-policy"`
+}
+
+type ManifestEntry struct {
+	Repo      string `yaml:"repo"`
+	SHA       string `yaml:"sha"`
+	Ref       string `yaml:"ref"`
+	Directory string `yaml:"directory"`
+	Auth      string `yaml:"auth"`
+}
+
+type ManifestResult struct {
+	Entry     ManifestEntry
+	SHA       string
+	Directory string
+	Duration  time.Duration
+	Err       error
+	Result    *Result
+}
+
+func LoadManifest(path string) (*Manifest, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	// yaml is a superset of json, so this handles both
+	if err := yaml.UnmarshalStrict(bs, m); err != nil {
+		return nil, fmt.Errorf("unable to parse manifest %q: %s", path, err)
+	}
+	m.expandEnv()
+
+	if len(m.Repos) == 0 {
+		return nil, fmt.Errorf("manifest %q has no repos", path)
+	}
+
+	return m, nil
+}
+
+// regEnv matches the ${VAR} references to environment variables of manifest
+// values. Any other $, like in a password, is left as is.
+var regEnv = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+func expandEnv(s string) string {
+	return regEnv.ReplaceAllStringFunc(s, func(ref string) string {
+		return os.Getenv(ref[2 : len(ref)-1])
+	})
+}
+
+func expandEnvAll(ss []string) {
+	for i := range ss {
+		ss[i] = expandEnv(ss[i])
+	}
+}
+
+// expandEnv replaces the ${VAR} references in every string of the manifest
+// with the value of VAR, once it's parsed so that values can't change its
+// structure.
+func (m *Manifest) expandEnv() {
+	for name, a := range m.Auth {
+		a.Username = expandEnv(a.Username)
+		a.Password = expandEnv(a.Password)
+		a.KeyPath = expandEnv(a.KeyPath)
+		a.KeyPassphrase = expandEnv(a.KeyPassphrase)
+		a.AgentKey = expandEnv(a.AgentKey)
+		a.KeyCert = expandEnv(a.KeyCert)
+		expandEnvAll(a.KnownHosts)
+		expandEnvAll(a.HostKeyFingerprints)
+		a.HostKeyPolicy = expandEnv(a.HostKeyPolicy)
+		m.Auth[name] = a
+	}
+
+	for i := range m.Repos {
+		e := &m.Repos[i]
+		e.Repo = expandEnv(e.Repo)
+		e.SHA = expandEnv(e.SHA)
+		e.Ref = expandEnv(e.Ref)
+		e.Directory = expandEnv(e.Directory)
+		e.Auth = expandEnv(e.Auth)
+	}
+}
+
+func (a ManifestAuth) apply(opts *Options) {
+	var hostKey SSHAuthOptions
+	if opts.SSHAuth != nil {
+		hostKey = SSHAuthOptions{
+			KnownHosts:          opts.SSHAuth.KnownHosts,
+			HostKeyFingerprints: opts.SSHAuth.HostKeyFingerprints,
+			HostKeyPolicy:       opts.SSHAuth.HostKeyPolicy,
+		}
+	}
+	if len(a.KnownHosts) > 0 || len(a.HostKeyFingerprints) > 0 {
+		hostKey.KnownHosts = a.KnownHosts
+		hostKey.HostKeyFingerprints = a.HostKeyFingerprints
+	}
+	if a.HostKeyPolicy != "" {
+		hostKey.HostKeyPolicy = a.HostKeyPolicy
+	}
+
+	opts.BasicAuth = nil
+	opts.SSHAuth = nil
+
+	if a.Username != "" || a.Password != "" {
+		opts.BasicAuth = &BasicAuthOptions{
+			Username: a.Username,
+			Password: a.Password,
+		}
+	}
+
+	verifying := len(hostKey.KnownHosts) > 0 || len(hostKey.HostKeyFingerprints) > 0 || hostKey.HostKeyPolicy != ""
+	if a.KeyPath != "" || a.KeyPassphrase != "" || a.SSHAgent || a.AgentKey != "" || a.KeyCert != "" || (verifying && opts.BasicAuth == nil) {
+		hostKey.PEMPath = a.KeyPath
+		hostKey.Passphrase = a.KeyPassphrase
+		hostKey.Agent = a.SSHAgent
+		hostKey.AgentKey = a.AgentKey
+		hostKey.CertPath = a.KeyCert
+		opts.SSHAuth = &hostKey
+	}
+}
+
+// Options builds validated options for every entry in the manifest. Flags
+// that aren't set per entry are copied from base, and entry directories are
+// relative to base.Directory.
+func (m *Manifest) Options(base Options) ([]*Options, error) {
+	// every entry would write the same archive, or deepen the same directory
+	if base.Archive != "" || base.Deepen > 0 {
+		return nil, conflict("cannot archive or deepen with a manifest")
+	}
+
+	all := make([]*Options, 0, len(m.Repos))
+	seen := make(map[string]int)
+
+	for i, entry := range m.Repos {
+		if entry.Directory == "" {
+			return nil, fmt.Errorf("repo #%d: %w", i+1, invalid("directory", "it is required"))
+		}
+
+		opts := base
+		opts.Repo = entry.Repo
+		opts.SHA = entry.SHA
+		opts.Ref = entry.Ref
+		opts.Directory = filepath.Join(base.Directory, entry.Directory)
+
+		if entry.Auth != "" {
+			auth, ok := m.Auth[entry.Auth]
+			if !ok {
+				return nil, fmt.Errorf("repo #%d: %w", i+1, invalid("auth", fmt.Sprintf("no auth named %q in manifest", entry.Auth)))
+			}
+			auth.apply(&opts)
+		}
+
+		if err := opts.Validate(); err != nil {
+			return nil, fmt.Errorf("repo #%d: %w", i+1, err)
+		}
+
+		if j, ok := seen[opts.Directory]; ok {
+			return nil, fmt.Errorf("repo #%d: %w", i+1, conflict(fmt.Sprintf("directory %q is already used by repo #%d", entry.Directory, j)))
+		}
+		seen[opts.Directory] = i + 1
+
+		all = append(all, &opts)
+	}
+
+	return all, nil
+}
+
+// FetchManifest runs ShallowFetchSHA for every entry in the manifest with at
+// most jobs fetches in flight. Progress of each fetch is written to stderr one
+// line at a time, prefixed with the entry's directory. Results are in the same
+// order as the manifest entries.
+func FetchManifest(m *Manifest, base Options, jobs int) ([]ManifestResult, error) {
+	return FetchManifestContext(context.Background(), m, base, jobs)
+}
+
+// FetchManifestContext is FetchManifest with a context. When the context is
+// done, fetches in flight are stopped and the rest fail without starting.
+func FetchManifestContext(ctx context.Context, m *Manifest, base Options, jobs int) ([]ManifestResult, error) {
+	if jobs < 1 {
+		return nil, errors.New("must run at least one job")
+	}
+
+	all, err := m.Options(base)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]ManifestResult, len(all))
+	queue := make(chan int)
+	wg := sync.WaitGroup{}
+
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				results[i] = fetchEntry(ctx, m.Repos[i], all[i])
+			}
+		}()
+	}
+
+	for i := range all {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	return results, nil
+}
+
+func fetchEntry(ctx context.Context, entry ManifestEntry, opts *Options) ManifestResult {
+	progress := newPrefixWriter(os.Stderr, fmt.Sprintf("[%s] ", entry.Directory))
+	opts.Progress = progress
+
+	start := time.Now()
+	res := newResult(opts)
+	err := shallowFetchSHA(ctx, opts, res)
+	_ = progress.Flush()
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"repo": entry.Repo,
+			"dir":  opts.Directory,
+		}).Errorln(err)
+	}
+
+	return ManifestResult{
+		Entry:     entry,
+		SHA:       opts.SHA,
+		Directory: opts.Directory,
+		Duration:  time.Since(start),
+		Err:       err,
+		Result:    res,
+	}
+}
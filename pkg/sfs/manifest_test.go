@@ -0,0 +1,176 @@
+package sfs_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+func writeManifest(contents string) string {
+	fp := filepath.Join(makeTemp(), "manifest.yaml")
+	plsno(os.WriteFile(fp, []byte(contents), 0600))
+	return fp
+}
+
+var _ = Describe("Manifest", func() {
+	var (
+		base = sfs.Options{
+			Directory:     "/tmp/sfs-manifest",
+			FallbackDepth: 8,
+		}
+	)
+
+	Describe("LoadManifest", func() {
+		It("should load yaml manifests", func() {
+			m, err := sfs.LoadManifest(writeManifest(`
+repos:
+  - repo: ` + publicRepo.HTTPS + `
+    sha: ` + publicRepo.Commit + `
+    directory: public
+`))
+			Expect(err).To(BeNil())
+			Expect(m.Repos).To(HaveLen(1))
+			Expect(m.Repos[0].Repo).To(Equal(publicRepo.HTTPS))
+			Expect(m.Repos[0].SHA).To(Equal(publicRepo.Commit))
+			Expect(m.Repos[0].Directory).To(Equal("public"))
+		})
+
+		It("should load json manifests", func() {
+			m, err := sfs.LoadManifest(writeManifest(`{
+  "repos": [
+    {"repo": "` + publicRepo.HTTPS + `", "ref": "main", "directory": "public"}
+  ]
+}`))
+			Expect(err).To(BeNil())
+			Expect(m.Repos).To(HaveLen(1))
+			Expect(m.Repos[0].Ref).To(Equal("main"))
+		})
+
+		It("should expand environment variables", func() {
+			plsno(os.Setenv("SFS_TEST_PASSWORD", "notpassword"))
+			defer func() { _ = os.Unsetenv("SFS_TEST_PASSWORD") }()
+
+			m, err := sfs.LoadManifest(writeManifest(`
+auth:
+  bot:
+    username: token
+    password: ${SFS_TEST_PASSWORD}
+repos:
+  - repo: ` + privateRepo.HTTPS + `
+    sha: ` + privateRepo.Commit + `
+    directory: private
+    auth: bot
+`))
+			Expect(err).To(BeNil())
+			Expect(m.Auth["bot"].Password).To(Equal("notpassword"))
+		})
+
+		It("should keep a literal $ in values", func() {
+			plsno(os.Setenv("SFS_TEST_USER", "bot"))
+			defer func() { _ = os.Unsetenv("SFS_TEST_USER") }()
+
+			m, err := sfs.LoadManifest(writeManifest(`
+auth:
+  bot:
+    username: ${SFS_TEST_USER}
+    password: pa$word
+repos:
+  - repo: ` + privateRepo.HTTPS + `
+    sha: ` + privateRepo.Commit + `
+    directory: private
+    auth: bot
+`))
+			Expect(err).To(BeNil())
+			Expect(m.Auth["bot"].Username).To(Equal("bot"))
+			Expect(m.Auth["bot"].Password).To(Equal("pa$word"))
+		})
+
+		It("should fail for unknown fields", func() {
+			_, err := sfs.LoadManifest(writeManifest(`
+repos:
+  - repository: ` + publicRepo.HTTPS + `
+`))
+			Expect(err).To(Not(BeNil()))
+		})
+
+		It("should fail for empty manifests", func() {
+			_, err := sfs.LoadManifest(writeManifest(`repos: []`))
+			Expect(err).To(Not(BeNil()))
+		})
+	})
+
+	Describe("Options", func() {
+		var m *sfs.Manifest
+
+		BeforeEach(func() {
+			m = &sfs.Manifest{
+				Auth: map[string]sfs.ManifestAuth{
+					"bot": {Username: "token", Password: "notpassword"},
+					"key": {KeyPath: sshKeyWithPassPath, KeyPassphrase: sshPassphrase},
+				},
+				Repos: []sfs.ManifestEntry{
+					{Repo: privateRepo.HTTPS, SHA: privateRepo.Commit, Directory: "private", Auth: "bot"},
+					{Repo: privateRepo.SSH, Ref: "main", Directory: "private-ssh", Auth: "key"},
+					{Repo: publicRepo.HTTPS, SHA: publicRepo.Commit, Directory: "public"},
+				},
+			}
+		})
+
+		It("should build options for every entry", func() {
+			all, err := m.Options(base)
+			Expect(err).To(BeNil())
+			Expect(all).To(HaveLen(3))
+
+			Expect(all[0].Directory).To(Equal("/tmp/sfs-manifest/private"))
+			Expect(all[0].BasicAuth.Password).To(Equal("notpassword"))
+			Expect(all[0].SSHAuth).To(BeNil())
+			Expect(all[0].FallbackDepth).To(Equal(base.FallbackDepth))
+
+			Expect(all[1].Ref).To(Equal("main"))
+			Expect(all[1].SSHAuth.PEMPath).To(Equal(sshKeyWithPassPath))
+			Expect(all[1].BasicAuth).To(BeNil())
+
+			Expect(all[2].BasicAuth).To(BeNil())
+			Expect(all[2].SSHAuth).To(BeNil())
+		})
+
+		It("should fail for unknown auth", func() {
+			m.Repos[2].Auth = "nope"
+			_, err := m.Options(base)
+			Expect(err).To(Not(BeNil()))
+		})
+
+		It("should fail for missing directories", func() {
+			m.Repos[2].Directory = ""
+			_, err := m.Options(base)
+			Expect(err).To(Not(BeNil()))
+		})
+
+		It("should fail for duplicate directories", func() {
+			m.Repos[2].Directory = "./private"
+			_, err := m.Options(base)
+			Expect(err).To(Not(BeNil()))
+		})
+
+		It("should fail when archiving or deepening", func() {
+			archive := base
+			archive.Archive = "/tmp/sfs-manifest.tar.gz"
+			_, err := m.Options(archive)
+			Expect(err).To(MatchError(ContainSubstring("cannot archive or deepen")))
+
+			deepen := base
+			deepen.Deepen = 10
+			_, err = m.Options(deepen)
+			Expect(err).To(MatchError(ContainSubstring("cannot archive or deepen")))
+		})
+
+		It("should fail for invalid entries", func() {
+			m.Repos[2].SHA = "deadbeef"
+			_, err := m.Options(base)
+			Expect(err).To(Not(BeNil()))
+		})
+	})
+})
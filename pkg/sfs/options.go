@@ -0,0 +1,427 @@
+package sfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+var (
+	regHex  = regexp.MustCompile("^[0-9a-fA-F]+$")
+	regSize = regexp.MustCompile("^([0-9]+)([kmg]?)$")
+)
+
+type Options struct {
+	Repo          string
+	SHA           string
+	Ref           string
+	Directory     string
+	RemoveDotGit  bool
+	BasicAuth     *BasicAuthOptions
+	SSHAuth       *SSHAuthOptions
+	Silent        bool
+	ExpandSHA     bool
+	FallbackDepth int
+	Progress      io.Writer
+	Depth         int
+	Deepen        int
+	Filter        string
+	Include       []string
+	Exclude       []string
+	SparseFile    string
+	Recursive     bool
+	LFS           bool
+	LFSInclude    []string
+	LFSExclude    []string
+	LFSMaxSize    int64
+	Archive       string
+	ArchiveFormat string
+	Retry         RetryPolicy
+	Cache         *Cache
+	ObjectStore   string
+	IfExists      string
+	KeepOnFailure bool
+}
+
+type SSHAuthOptions struct {
+	PEMPath    string
+	Passphrase string
+	// CertPath is an OpenSSH user certificate for the key of PEMPath, or of
+	// the ssh-agent, signed by a certificate authority the server trusts. Like
+	// ssh, PEMPath-cert.pub is used when it's empty and that file exists.
+	CertPath string
+	// Agent authenticates with the keys of the running ssh-agent instead of
+	// a key file, which is also what happens without PEMPath, like git does.
+	// AgentKey, a fingerprint or comment, selects one of them.
+	Agent    bool
+	AgentKey string
+	// KnownHosts are the known_hosts files host keys are verified with, by
+	// default those of $SSH_KNOWN_HOSTS, or ~/.ssh/known_hosts and
+	// /etc/ssh/ssh_known_hosts.
+	KnownHosts []string
+	// HostKeyFingerprints pins the host key to one of these fingerprints,
+	// instead of known_hosts.
+	HostKeyFingerprints []string
+	// HostKeyPolicy is HostKeyStrict, the default, HostKeyTOFU or
+	// HostKeyInsecure.
+	HostKeyPolicy string
+}
+
+// useAgent reports whether the keys of the ssh-agent are used.
+func (o *SSHAuthOptions) useAgent() bool {
+	return o.Agent || o.AgentKey != "" || (o.PEMPath == "" && o.Passphrase == "")
+}
+
+// hasCredentials reports whether a key, certificate or the ssh-agent was asked
+// for, rather than only how host keys are verified.
+func (o *SSHAuthOptions) hasCredentials() bool {
+	return o.PEMPath != "" || o.Passphrase != "" || o.CertPath != "" || o.Agent || o.AgentKey != ""
+}
+
+// certPath is the certificate to sign with, CertPath or the -cert.pub file
+// next to PEMPath, "" without one.
+func (o *SSHAuthOptions) certPath() string {
+	if o.CertPath != "" || o.PEMPath == "" {
+		return o.CertPath
+	}
+	if _, err := os.Stat(o.PEMPath + "-cert.pub"); err != nil {
+		return ""
+	}
+	return o.PEMPath + "-cert.pub"
+}
+
+type BasicAuthOptions struct {
+	Username string
+	Password string
+}
+
+func (opts *Options) progress() sideband.Progress {
+	if opts.Silent {
+		return nil
+	}
+
+	if opts.Progress != nil {
+		return opts.Progress
+	}
+
+	// most normal git commands output to stderr
+	return os.Stderr
+}
+
+// depth is how many commits of history to fetch, at least one
+func (opts *Options) depth() int {
+	if opts.Depth < 1 {
+		return defaultDepth
+	}
+	return opts.Depth
+}
+
+// ParseSize parses a size in bytes with an optional k, m or g suffix.
+func ParseSize(s string) (int64, error) {
+	m := regSize.FindStringSubmatch(strings.ToLower(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q, must be a number with an optional k, m or g suffix", s)
+	}
+
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	switch m[2] {
+	case "k":
+		n <<= 10
+	case "m":
+		n <<= 20
+	case "g":
+		n <<= 30
+	}
+	return n, nil
+}
+
+func isFullSHA(s string) bool {
+	return len(s) == 40 && regHex.MatchString(s)
+}
+
+// SetRev sets the commit to fetch, a full sha is used as is and anything else
+// is treated as a ref to resolve on the remote.
+func (opts *Options) SetRev(rev string) {
+	if isFullSHA(rev) {
+		opts.SHA = rev
+		opts.Ref = ""
+	} else {
+		opts.SHA = ""
+		opts.Ref = rev
+	}
+}
+
+// Auth is the auth method for opts.Repo, nil when there's none. With an
+// ssh-agent, its connection to the agent is left open for as long as the
+// process runs, fetches open their own and close it when they're done.
+func (opts *Options) Auth() (transport.AuthMethod, error) {
+	auth, _, err := opts.auth()
+	return auth, err
+}
+
+// auth is Auth, and a func to close what the auth method keeps open once the
+// fetch is done with it, the connection to the ssh-agent.
+func (opts *Options) auth() (transport.AuthMethod, func(), error) {
+	// ssh options, like known_hosts files, can be set for many repos, not
+	// all of them ssh
+	if opts.SSHAuth != nil && !isHTTP(opts.Repo) {
+		// default user to 'git'
+		user := "git"
+
+		// if different user specified in ssh url, ssh://user@host/repo or
+		// user@host:repo, which certificates have to be valid for
+		if ep, err := transport.NewEndpoint(opts.Repo); err == nil && ep.User != "" {
+			user = ep.User
+		}
+
+		verifier := newHostKeyVerifier(opts.SSHAuth)
+		if opts.SSHAuth.useAgent() {
+			auth, conn, err := sshAgentAuth(user, opts.SSHAuth.AgentKey, opts.SSHAuth.CertPath)
+			if err != nil {
+				return nil, noClose, err
+			}
+			auth.HostKeyCallback = verifier.check
+			return auth, func() { _ = conn.Close() }, nil
+		}
+
+		auth, err := ssh.NewPublicKeysFromFile(user, opts.SSHAuth.PEMPath, opts.SSHAuth.Passphrase)
+		if err != nil {
+			return nil, noClose, err
+		}
+		if certPath := opts.SSHAuth.certPath(); certPath != "" {
+			cert, err := loadCertificate(certPath)
+			if err != nil {
+				return nil, noClose, err
+			}
+			if auth.Signer, err = certSigner(certPath, cert, []cryptossh.Signer{auth.Signer}); err != nil {
+				return nil, noClose, err
+			}
+		}
+		auth.HostKeyCallback = verifier.check
+		return auth, noClose, nil
+	}
+
+	if opts.BasicAuth != nil {
+		user := opts.BasicAuth.Username
+		if user == "" {
+			// when using a token, username doesn't matter, but it can't be empty
+			user = "token"
+		}
+
+		return &http.BasicAuth{
+			Username: user,
+			Password: opts.BasicAuth.Password,
+		}, noClose, nil
+	}
+
+	return nil, noClose, nil
+}
+
+// noClose is the close func of an auth method that keeps nothing open.
+func noClose() {}
+
+func (opts *Options) Validate() error {
+	if opts.Deepen < 0 {
+		return invalid("deepen", "must not be negative")
+	}
+
+	if opts.Deepen > 0 {
+		// deepen works on an existing checkout, repo and sha come from it
+		if opts.Repo != "" || opts.SHA != "" || opts.Ref != "" {
+			return conflict("cannot specify repo, sha or ref when deepening")
+		}
+
+		if opts.RemoveDotGit {
+			return conflict("cannot remove the '.git' directory when deepening")
+		}
+	} else {
+		if opts.Repo == "" {
+			return invalid("repo", "it is required")
+		}
+
+		if opts.Ref != "" {
+			if opts.SHA != "" {
+				return conflict("cannot specify both sha and ref")
+			}
+		} else if !isFullSHA(opts.SHA) {
+			return invalid("sha", "must be full 40 hexadecimal character SHA1")
+		}
+	}
+
+	if opts.Depth < 0 {
+		return invalid("depth", "must not be negative")
+	}
+
+	if opts.Filter != "" {
+		if !regFilter.MatchString(opts.Filter) {
+			return invalid("filter", "must be one of blob:none, blob:limit=<n>[kmg] or tree:<depth>")
+		}
+
+		if opts.Repo != "" && !isHTTP(opts.Repo) {
+			return invalid("filter", "only supported for http(s) repositories, go-git's ssh transport can't send one")
+		}
+	}
+
+	if opts.Deepen > 0 && (len(opts.Include) > 0 || len(opts.Exclude) > 0 || opts.SparseFile != "") {
+		return conflict("cannot specify sparse checkout patterns when deepening")
+	}
+
+	if opts.Deepen > 0 && opts.Recursive {
+		return conflict("cannot recurse into submodules when deepening")
+	}
+
+	if opts.Archive != "" {
+		if _, err := archiveFormat(opts.Archive, opts.ArchiveFormat); err != nil {
+			return invalid("archive", err.Error())
+		}
+
+		if opts.Deepen > 0 || opts.RemoveDotGit || opts.Recursive || opts.LFS {
+			return conflict("cannot deepen, remove the '.git' directory, recurse into submodules or fetch lfs objects with an archive")
+		}
+	} else if opts.ArchiveFormat != "" {
+		return invalid("archive-format", "requires an archive")
+	}
+
+	if !opts.LFS && (len(opts.LFSInclude) > 0 || len(opts.LFSExclude) > 0 || opts.LFSMaxSize != 0) {
+		return conflict("lfs options require lfs to be enabled")
+	}
+
+	if opts.Deepen > 0 && opts.LFS {
+		return conflict("cannot fetch lfs objects when deepening")
+	}
+
+	if opts.LFSMaxSize < 0 {
+		return invalid("lfs-max-size", "must not be negative")
+	}
+
+	for _, pattern := range opts.Include {
+		if strings.TrimSpace(pattern) == "" {
+			return invalid("include", "patterns must not be empty")
+		}
+	}
+
+	for _, pattern := range opts.Exclude {
+		if strings.TrimSpace(pattern) == "" {
+			return invalid("exclude", "patterns must not be empty")
+		}
+	}
+
+	if opts.Retry.Retries < 0 {
+		return invalid("retries", "must not be negative")
+	}
+
+	if opts.Retry.Backoff < 0 || opts.Retry.MaxBackoff < 0 {
+		return invalid("retry-backoff", "must not be negative")
+	}
+
+	if opts.Retry.Jitter < 0 || opts.Retry.Jitter > 1 {
+		return invalid("retry-jitter", "must be between 0 and 1")
+	}
+
+	if opts.Cache != nil {
+		if opts.Cache.Dir == "" {
+			return invalid("cache-dir", "must not be empty")
+		}
+
+		if opts.Cache.MaxSize < 0 {
+			return invalid("cache-max-size", "must not be negative")
+		}
+	}
+
+	if opts.ObjectStore != "" {
+		if opts.Cache != nil {
+			return conflict("cannot use both a cache and an object store")
+		}
+
+		if opts.Filter != "" {
+			return conflict("cannot use a filter with an object store")
+		}
+
+		if opts.Deepen > 0 {
+			return conflict("cannot use an object store when deepening")
+		}
+	}
+
+	switch opts.IfExists {
+	case "", IfExistsFail, IfExistsClean, IfExistsMerge:
+	default:
+		return invalid("if-exists", "must be one of fail, clean or merge")
+	}
+
+	if (opts.IfExists == IfExistsClean || opts.IfExists == IfExistsMerge) && (opts.Deepen > 0 || opts.Archive != "") {
+		return conflict("cannot clean or merge into an existing directory when deepening or with an archive")
+	}
+
+	if opts.FallbackDepth < 0 {
+		return invalid("fallback-depth", "must not be negative")
+	}
+
+	// host key options alone don't conflict with basic auth, they only matter
+	// for ssh repos
+	if opts.BasicAuth != nil && opts.SSHAuth != nil && opts.SSHAuth.hasCredentials() {
+		return conflict("cannot specify both basic auth and ssh auth options")
+	}
+
+	if opts.BasicAuth != nil {
+		if opts.BasicAuth.Username == "" {
+			return invalid("username", "required if password specified (if using token, set username to \"token\")")
+		}
+
+		if opts.BasicAuth.Password == "" {
+			return invalid("password", "required if username specified")
+		}
+	}
+
+	if opts.SSHAuth != nil {
+		if opts.SSHAuth.useAgent() {
+			if opts.SSHAuth.PEMPath != "" || opts.SSHAuth.Passphrase != "" {
+				return conflict("cannot use both a key file and ssh-agent")
+			}
+		} else if opts.SSHAuth.PEMPath == "" {
+			return invalid("key-path", "required if ssh options set")
+		}
+
+		if err := opts.SSHAuth.validateHostKey(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (o *SSHAuthOptions) validateHostKey() error {
+	switch o.HostKeyPolicy {
+	case "", HostKeyStrict, HostKeyTOFU, HostKeyInsecure:
+	default:
+		return invalid("host-key-policy", fmt.Sprintf("must be %s, %s or %s", HostKeyStrict, HostKeyTOFU, HostKeyInsecure))
+	}
+
+	for _, fp := range o.HostKeyFingerprints {
+		if !validFingerprint(fp) {
+			return invalid("host-key-fingerprint", fmt.Sprintf("%q isn't a SHA256: or MD5: fingerprint", fp))
+		}
+	}
+
+	switch {
+	case len(o.HostKeyFingerprints) > 0 && len(o.KnownHosts) > 0:
+		return conflict("cannot both pin host key fingerprints and use known_hosts files")
+	case len(o.HostKeyFingerprints) > 0 && o.HostKeyPolicy == HostKeyTOFU:
+		return conflict("cannot trust host keys on first use when pinning their fingerprints")
+	case (len(o.HostKeyFingerprints) > 0 || len(o.KnownHosts) > 0) && o.HostKeyPolicy == HostKeyInsecure:
+		return conflict("cannot ignore host keys when verifying them with known_hosts or pinned fingerprints")
+	}
+	return nil
+}
@@ -0,0 +1,345 @@
+package sfs_test
+
+import (
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+var _ = Describe("Options", func() {
+	var (
+		options       sfs.Options
+		sshAuthOpts   sfs.SSHAuthOptions
+		basicAuthOpts sfs.BasicAuthOptions
+		dummyDir      = makeTemp()
+	)
+
+	BeforeEach(func() {
+		options = sfs.Options{
+			Repo:         publicRepo.SSH,
+			SHA:          publicRepo.Commit,
+			Directory:    dummyDir,
+			RemoveDotGit: false,
+			BasicAuth:    nil,
+			SSHAuth:      nil,
+		}
+
+		sshAuthOpts = sfs.SSHAuthOptions{
+			PEMPath:    sshKeyWithPassPath,
+			Passphrase: sshPassphrase,
+		}
+
+		basicAuthOpts = sfs.BasicAuthOptions{
+			Username: "token",
+			Password: "notpassword",
+		}
+	})
+
+	Describe("Validate", func() {
+		It("should succeed with no auth", func() {
+			Expect(options.Validate()).To(BeNil())
+		})
+
+		It("should succeed with ssh auth", func() {
+			options.SSHAuth = &sshAuthOpts
+			Expect(options.Validate()).To(BeNil())
+		})
+
+		It("should succeed with basic auth", func() {
+			options.BasicAuth = &basicAuthOpts
+			Expect(options.Validate()).To(BeNil())
+		})
+
+		It("should fail with both auth options", func() {
+			options.BasicAuth = &basicAuthOpts
+			options.SSHAuth = &sshAuthOpts
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+
+		It("should succeed with basic auth and host key options", func() {
+			options.Repo = publicRepo.HTTPS
+			options.BasicAuth = &basicAuthOpts
+			options.SSHAuth = &sfs.SSHAuthOptions{
+				KnownHosts:    []string{"/etc/ssh/ssh_known_hosts"},
+				HostKeyPolicy: sfs.HostKeyTOFU,
+			}
+			Expect(options.Validate()).To(BeNil())
+		})
+
+		It("should fail for invalid repo", func() {
+			options.Repo = ""
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+
+		It("should fail for invalid sha", func() {
+			options.SHA = "deadbeef"
+			Expect(options.Validate()).To(Not(BeNil()))
+
+			options.SHA = "zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz"
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+
+		It("should succeed with ref instead of sha", func() {
+			options.SHA = ""
+			options.Ref = "main"
+			Expect(options.Validate()).To(BeNil())
+		})
+
+		It("should fail with both sha and ref", func() {
+			options.Ref = "main"
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+
+		It("should fail for negative fallback depth", func() {
+			options.FallbackDepth = -1
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+
+		It("should fail for negative depth", func() {
+			options.Depth = -1
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+
+		It("should succeed when deepening without repo and sha", func() {
+			options.Repo = ""
+			options.SHA = ""
+			options.Deepen = 10
+			Expect(options.Validate()).To(BeNil())
+		})
+
+		It("should fail when deepening with repo or sha", func() {
+			options.Deepen = 10
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+
+		It("should fail when deepening and removing dot git", func() {
+			options.Repo = ""
+			options.SHA = ""
+			options.Deepen = 10
+			options.RemoveDotGit = true
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+
+		It("should fail when deepening with sparse patterns", func() {
+			options.Repo = ""
+			options.SHA = ""
+			options.Deepen = 10
+			options.Include = []string{"deploy/"}
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+
+		It("should fail when deepening recursively", func() {
+			options.Repo = ""
+			options.SHA = ""
+			options.Deepen = 10
+			options.Recursive = true
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+
+		It("should fail for lfs options without lfs", func() {
+			options.LFSInclude = []string{"*.psd"}
+			Expect(options.Validate()).To(Not(BeNil()))
+
+			options.LFS = true
+			Expect(options.Validate()).To(BeNil())
+		})
+
+		It("should succeed with archives of known formats", func() {
+			for _, archive := range []string{"out.tar", "out.tar.gz", "out.TGZ", "out.zip", "-"} {
+				options.Archive = archive
+				Expect(options.Validate()).To(BeNil())
+			}
+
+			options.Archive = "out.bin"
+			options.ArchiveFormat = "zip"
+			Expect(options.Validate()).To(BeNil())
+		})
+
+		It("should fail for archives of unknown formats", func() {
+			options.Archive = "out.rar"
+			Expect(options.Validate()).To(Not(BeNil()))
+
+			options.ArchiveFormat = "rar"
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+
+		It("should fail for an archive format without an archive", func() {
+			options.ArchiveFormat = "zip"
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+
+		It("should fail for archives when removing dot git", func() {
+			options.Archive = "out.zip"
+			options.RemoveDotGit = true
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+
+		It("should fail for empty sparse patterns", func() {
+			options.Include = []string{"deploy/"}
+			options.Exclude = []string{" "}
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+
+		It("should succeed with valid filters", func() {
+			options.Repo = publicRepo.HTTPS
+			for _, filter := range []string{"blob:none", "blob:limit=1024", "blob:limit=1m", "tree:0"} {
+				options.Filter = filter
+				Expect(options.Validate()).To(BeNil())
+			}
+		})
+
+		It("should fail for invalid filters", func() {
+			options.Repo = publicRepo.HTTPS
+			for _, filter := range []string{"blob", "blob:limit=", "blob:limit=1t", "tree:", "sparse:oid=main"} {
+				options.Filter = filter
+				Expect(options.Validate()).To(Not(BeNil()))
+			}
+		})
+
+		It("should fail for filters on ssh repos", func() {
+			options.Filter = "blob:none"
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+
+		It("should fail for invalid basic auth", func() {
+			options.BasicAuth = &sfs.BasicAuthOptions{
+				Username: "",
+				Password: basicAuthOpts.Password,
+			}
+			Expect(options.Validate()).To(Not(BeNil()))
+
+			options.BasicAuth = &sfs.BasicAuthOptions{
+				Username: basicAuthOpts.Username,
+				Password: "",
+			}
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+
+		It("should fail for invalid ssh auth", func() {
+			options.SSHAuth = &sfs.SSHAuthOptions{
+				PEMPath:    "",
+				Passphrase: sshAuthOpts.Passphrase,
+			}
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+
+		It("should fail with an invalid retry policy", func() {
+			options.Retry = sfs.RetryPolicy{Retries: -1}
+			Expect(options.Validate()).To(Not(BeNil()))
+
+			options.Retry = sfs.RetryPolicy{Retries: 3, Backoff: -time.Second}
+			Expect(options.Validate()).To(Not(BeNil()))
+
+			options.Retry = sfs.RetryPolicy{Retries: 3, Jitter: 1.5}
+			Expect(options.Validate()).To(Not(BeNil()))
+
+			options.Retry = sfs.RetryPolicy{Retries: 3, Backoff: time.Second, Jitter: 0.2}
+			Expect(options.Validate()).To(BeNil())
+		})
+
+		It("should fail for an unknown if-exists policy", func() {
+			for _, policy := range []string{"", sfs.IfExistsFail, sfs.IfExistsClean, sfs.IfExistsMerge} {
+				options.IfExists = policy
+				Expect(options.Validate()).To(BeNil())
+			}
+
+			options.IfExists = "overwrite"
+			Expect(options.Validate()).To(Not(BeNil()))
+
+			options.IfExists = sfs.IfExistsClean
+			options.Archive = "out.zip"
+			Expect(options.Validate()).To(Not(BeNil()))
+		})
+	})
+
+	Describe("SetRev", func() {
+		It("should set a full sha", func() {
+			options.SetRev(publicRepo.Commit)
+
+			Expect(options.SHA).To(Equal(publicRepo.Commit))
+			Expect(options.Ref).To(BeEmpty())
+		})
+
+		It("should set anything else as a ref", func() {
+			options.SetRev("refs/heads/main")
+
+			Expect(options.SHA).To(BeEmpty())
+			Expect(options.Ref).To(Equal("refs/heads/main"))
+
+			options.SetRev(publicRepo.Commit[:7])
+
+			Expect(options.SHA).To(BeEmpty())
+			Expect(options.Ref).To(Equal(publicRepo.Commit[:7]))
+		})
+	})
+
+	Describe("Auth", func() {
+		It("should return nil with no auth", func() {
+			auth, err := options.Auth()
+
+			Expect(auth).To(BeNil())
+			Expect(err).To(BeNil())
+		})
+
+		It("should return ssh auth method", func() {
+			options.SSHAuth = &sshAuthOpts
+			auth, err := options.Auth()
+
+			Expect(auth).To(Not(BeNil()))
+			Expect(err).To(BeNil())
+			Expect(auth.Name()).To(Equal(ssh.PublicKeysName))
+
+			sshAuth, ok := auth.(*ssh.PublicKeys)
+			Expect(ok).To(BeTrue())
+
+			Expect(sshAuth.User).To(Equal("git"))
+		})
+
+		It("should return ssh auth method w/ custom user", func() {
+			options.SSHAuth = &sshAuthOpts
+			options.Repo = "not" + publicRepo.SSH
+			auth, err := options.Auth()
+
+			Expect(auth).To(Not(BeNil()))
+			Expect(err).To(BeNil())
+			Expect(auth.Name()).To(Equal("ssh-public-keys"))
+
+			sshAuth, ok := auth.(*ssh.PublicKeys)
+			Expect(ok).To(BeTrue())
+
+			Expect(sshAuth.User).To(Equal("notgit"))
+		})
+
+		It("should return ssh auth method w/ the user of an ssh url", func() {
+			options.SSHAuth = &sshAuthOpts
+			options.Repo = "ssh://deploy@example.com:2222/org/repo.git"
+			auth, err := options.Auth()
+			Expect(err).To(BeNil())
+
+			sshAuth, ok := auth.(*ssh.PublicKeys)
+			Expect(ok).To(BeTrue())
+
+			Expect(sshAuth.User).To(Equal("deploy"))
+		})
+
+		It("should return basic auth method", func() {
+			options.BasicAuth = &basicAuthOpts
+			options.Repo = publicRepo.HTTPS
+			auth, err := options.Auth()
+
+			Expect(auth).To(Not(BeNil()))
+			Expect(err).To(BeNil())
+			Expect(auth.Name()).To(Equal("http-basic-auth"))
+
+			basicAuth, ok := auth.(*http.BasicAuth)
+			Expect(ok).To(BeTrue())
+
+			Expect(basicAuth.Username).To(Equal(basicAuthOpts.Username))
+			Expect(basicAuth.Password).To(Equal(basicAuthOpts.Password))
+		})
+	})
+})
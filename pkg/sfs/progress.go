@@ -0,0 +1,70 @@
+package sfs
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// prefixWriter writes whole lines to the underlying writer with a prefix, so
+// output from concurrent fetches can share a terminal. Carriage returns, which
+// git uses to redraw progress counters in place, discard the pending line so
+// only the final state of each counter is written.
+type prefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix []byte
+	line   []byte
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{
+		w:      w,
+		prefix: []byte(prefix),
+	}
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	for _, b := range p {
+		switch b {
+		case '\r':
+			pw.line = pw.line[:0]
+		case '\n':
+			if err := pw.flush(); err != nil {
+				return 0, err
+			}
+		default:
+			pw.line = append(pw.line, b)
+		}
+	}
+
+	return len(p), nil
+}
+
+// Flush writes out any partial line.
+func (pw *prefixWriter) Flush() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	return pw.flush()
+}
+
+func (pw *prefixWriter) flush() error {
+	if len(bytes.TrimSpace(pw.line)) == 0 {
+		pw.line = pw.line[:0]
+		return nil
+	}
+
+	out := make([]byte, 0, len(pw.prefix)+len(pw.line)+1)
+	out = append(out, pw.prefix...)
+	out = append(out, pw.line...)
+	out = append(out, '\n')
+	pw.line = pw.line[:0]
+
+	// a single write keeps lines from different fetches from interleaving
+	_, err := pw.w.Write(out)
+	return err
+}
@@ -0,0 +1,254 @@
+package sfs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// same delta window git uses by default
+const packWindow = 10
+
+// walkHistory walks breadth first from hash, up to depth commits deep like a
+// shallow fetch would. It returns the commits seen and the ones that would be
+// shallow (those at the depth limit with parents, or whose parents are missing
+// from the repository). complete is false if any parents within depth were
+// missing.
+func walkHistory(repo *git.Repository, hash plumbing.Hash, depth int) (commits, shallow []plumbing.Hash, complete bool, err error) {
+	complete = true
+	seen := map[plumbing.Hash]bool{hash: true}
+	level := []plumbing.Hash{hash}
+
+	for d := 1; len(level) > 0; d++ {
+		var next []plumbing.Hash
+		for _, h := range level {
+			commit, err := repo.CommitObject(h)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			commits = append(commits, h)
+
+			if len(commit.ParentHashes) == 0 {
+				continue
+			}
+
+			if depth > 0 && d >= depth {
+				shallow = append(shallow, h)
+				continue
+			}
+
+			missing := false
+			for _, p := range commit.ParentHashes {
+				if _, err := repo.Storer.EncodedObject(plumbing.CommitObject, p); err != nil {
+					missing = true
+				}
+			}
+			if missing {
+				complete = false
+				shallow = append(shallow, h)
+				continue
+			}
+
+			for _, p := range commit.ParentHashes {
+				if !seen[p] {
+					seen[p] = true
+					next = append(next, p)
+				}
+			}
+		}
+		level = next
+	}
+
+	return commits, shallow, complete, nil
+}
+
+// historyDepth is how many commits deep the history of hash goes in the
+// repository, i.e. the depth it was shallow fetched with.
+func historyDepth(repo *git.Repository, hash plumbing.Hash) (int, error) {
+	seen := map[plumbing.Hash]bool{hash: true}
+	level := []plumbing.Hash{hash}
+
+	d := 0
+	for ; len(level) > 0; d++ {
+		var next []plumbing.Hash
+		for _, h := range level {
+			commit, err := repo.CommitObject(h)
+			if err != nil {
+				return 0, err
+			}
+
+			for _, p := range commit.ParentHashes {
+				if _, err := repo.Storer.EncodedObject(plumbing.CommitObject, p); err != nil {
+					continue
+				}
+				if !seen[p] {
+					seen[p] = true
+					next = append(next, p)
+				}
+			}
+		}
+		level = next
+	}
+
+	return d, nil
+}
+
+// pruneHistory drops every ref, object and bit of history that isn't needed
+// for the given commit and depth, leaving the repository as if only that
+// commit had been shallow fetched.
+func pruneHistory(repo *git.Repository, hash plumbing.Hash, depth int) error {
+	objects, shallow, err := reachableObjects(repo, hash, depth)
+	if err != nil {
+		return err
+	}
+
+	if err := resetRefs(repo, hash); err != nil {
+		return err
+	}
+
+	if err := repo.Storer.SetShallow(shallow); err != nil {
+		return err
+	}
+
+	return repack(repo, objects)
+}
+
+// resetRefs drops every ref but HEAD and points the remote ref of hash at it,
+// the refs a fetch of only that commit leaves.
+func resetRefs(repo *git.Repository, hash plumbing.Hash) error {
+	refs, err := repo.References()
+	if err != nil {
+		return err
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() == plumbing.HEAD {
+			return nil
+		}
+		return repo.Storer.RemoveReference(ref.Name())
+	})
+	if err != nil {
+		return err
+	}
+
+	ref := plumbing.NewHashReference(plumbing.NewRemoteReferenceName(remoteName, hash.String()), hash)
+	return repo.Storer.SetReference(ref)
+}
+
+// reachableObjects returns the commits up to depth deep from hash with their
+// trees and blobs, and the commits that would be shallow.
+func reachableObjects(repo *git.Repository, hash plumbing.Hash, depth int) (objects, shallow []plumbing.Hash, err error) {
+	commits, shallow, _, err := walkHistory(repo, hash, depth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, h := range commits {
+		commit, err := repo.CommitObject(h)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		tree, err := commit.Tree()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		objects = append(objects, h)
+		objects, err = appendTreeObjects(objects, tree)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return dedupe(objects), shallow, nil
+}
+
+func dedupe(hashes []plumbing.Hash) []plumbing.Hash {
+	seen := make(map[plumbing.Hash]bool, len(hashes))
+	unique := hashes[:0]
+	for _, h := range hashes {
+		if !seen[h] {
+			seen[h] = true
+			unique = append(unique, h)
+		}
+	}
+	return unique
+}
+
+func appendTreeObjects(objects []plumbing.Hash, tree *object.Tree) ([]plumbing.Hash, error) {
+	objects = append(objects, tree.Hash)
+	for _, entry := range tree.Entries {
+		switch entry.Mode {
+		case filemode.Submodule:
+			// gitlinks point into another repository
+			continue
+		case filemode.Dir:
+			subtree, err := tree.Tree(entry.Name)
+			if err != nil {
+				return nil, err
+			}
+			objects, err = appendTreeObjects(objects, subtree)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			objects = append(objects, entry.Hash)
+		}
+	}
+	return objects, nil
+}
+
+// repack writes the given objects to a new packfile and removes all others.
+func repack(repo *git.Repository, objects []plumbing.Hash) (err error) {
+	pos, ok := repo.Storer.(storer.PackedObjectStorer)
+	if !ok {
+		return git.ErrPackedObjectsNotSupported
+	}
+
+	pfw, ok := repo.Storer.(storer.PackfileWriter)
+	if !ok {
+		return fmt.Errorf("repository storer is not a packfile writer")
+	}
+
+	oldPacks, err := pos.ObjectPacks()
+	if err != nil {
+		return err
+	}
+
+	w, err := pfw.PackfileWriter()
+	if err != nil {
+		return err
+	}
+
+	newPack, err := packfile.NewEncoder(w, repo.Storer, false).Encode(objects, packWindow)
+	if err != nil {
+		_ = w.Close()
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	for _, h := range oldPacks {
+		if h == newPack {
+			continue
+		}
+		if err := pos.DeleteOldObjectPackAndIndex(h, time.Time{}); err != nil {
+			return err
+		}
+	}
+
+	// the filesystem storer caches which packs hold which objects
+	if r, ok := repo.Storer.(interface{ Reindex() }); ok {
+		r.Reindex()
+	}
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package sfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	gitcfg "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// shortest abbreviated sha accepted, same as git
+	minAbbrevLength = 4
+	// how many commits back from each advertised ref to search for a short sha
+	expandSearchDepth = 50
+)
+
+var (
+	errRefNotFound    = errors.New("unable to find ref on remote")
+	errCommitNotFound = errors.New("unable to find commit")
+)
+
+// same lookup order git uses when expanding a short refname
+var refLookupPrefixes = []string{
+	"refs/",
+	"refs/tags/",
+	"refs/heads/",
+}
+
+func advertisedRefs(ctx context.Context, url string, auth transport.AuthMethod) (*packp.AdvRefs, error) {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newClient(ep)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := c.NewUploadPackSession(ep, auth)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = session.Close() }()
+
+	return session.AdvertisedReferencesContext(ctx)
+}
+
+// ResolveRef finds the commit sha for a ref in the remote's advertised refs.
+// The ref can be "HEAD", a full ref name (refs/heads/main) or a bare branch or
+// tag name (main, v1.0.0). Annotated tags are peeled to the commit they point to.
+func ResolveRef(ar *packp.AdvRefs, ref string) (string, error) {
+	if ref == plumbing.HEAD.String() {
+		if ar.Head == nil {
+			return "", fmt.Errorf("remote did not advertise %s", plumbing.HEAD)
+		}
+		return ar.Head.String(), nil
+	}
+
+	candidates := []string{ref}
+	if !strings.HasPrefix(ref, "refs/") {
+		candidates = candidates[:0]
+		for _, prefix := range refLookupPrefixes {
+			candidates = append(candidates, prefix+ref)
+		}
+	}
+
+	var matches []string
+	for _, name := range candidates {
+		if _, ok := ar.References[name]; ok {
+			matches = append(matches, name)
+		}
+	}
+
+	if len(matches) == 0 {
+		return "", fmt.Errorf("%w: %q", errRefNotFound, ref)
+	}
+
+	if len(matches) > 1 {
+		log.WithFields(log.Fields{
+			"ref":     ref,
+			"matches": matches,
+		}).Warnf("ref is ambiguous, using %q", matches[0])
+	}
+
+	name := matches[0]
+	if peeled, ok := ar.Peeled[name]; ok {
+		return peeled.String(), nil
+	}
+	return ar.References[name].String(), nil
+}
+
+func isAbbrevSHA(s string) bool {
+	return len(s) >= minAbbrevLength && len(s) < 40 && regHex.MatchString(s)
+}
+
+// MatchSHAPrefix returns the distinct commit shas advertised by the remote (ref
+// tips and peeled tags) that start with the given prefix.
+func MatchSHAPrefix(ar *packp.AdvRefs, prefix string) []string {
+	prefix = strings.ToLower(prefix)
+	seen := make(map[string]bool)
+
+	check := func(h plumbing.Hash) {
+		if sha := h.String(); strings.HasPrefix(sha, prefix) {
+			seen[sha] = true
+		}
+	}
+
+	if ar.Head != nil {
+		check(*ar.Head)
+	}
+	for name, h := range ar.References {
+		// annotated tags point to a tag object, only their commit is wanted
+		if peeled, ok := ar.Peeled[name]; ok {
+			h = peeled
+		}
+		check(h)
+	}
+
+	matches := make([]string, 0, len(seen))
+	for sha := range seen {
+		matches = append(matches, sha)
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// searchSHAPrefix fetches the last expandSearchDepth commits of every branch
+// and tag into memory and returns the commit shas that start with the prefix.
+func searchSHAPrefix(ctx context.Context, url string, auth transport.AuthMethod, prefix string) ([]string, error) {
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = repo.CreateRemote(&gitcfg.RemoteConfig{
+		Name: remoteName,
+		URLs: []string{url},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"url":   url,
+		"depth": expandSearchDepth,
+	}).Debugln("fetching recent history to expand short sha")
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: remoteName,
+		Depth:      expandSearchDepth,
+		RefSpecs: []gitcfg.RefSpec{
+			gitcfg.RefSpec(fmt.Sprintf(gitcfg.DefaultFetchRefSpec, remoteName)),
+			"+refs/tags/*:refs/tags/*",
+		},
+		Auth: auth,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, err
+	}
+
+	commits, err := repo.CommitObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix = strings.ToLower(prefix)
+	var matches []string
+	err = commits.ForEach(func(c *object.Commit) error {
+		if sha := c.Hash.String(); strings.HasPrefix(sha, prefix) {
+			matches = append(matches, sha)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// expandSHA expands opts.Ref, an abbreviated sha, against the ref tips and
+// the recent history of the remote's refs. Matching a tip doesn't stop the
+// search, an older commit can start with the same prefix.
+func expandSHA(ctx context.Context, opts *Options, ar *packp.AdvRefs, auth transport.AuthMethod) (string, error) {
+	found, err := searchSHAPrefix(ctx, opts.Repo, auth, opts.Ref)
+	if err != nil {
+		return "", err
+	}
+
+	seen := make(map[string]bool)
+	var matches []string
+	for _, sha := range append(MatchSHAPrefix(ar, opts.Ref), found...) {
+		if !seen[sha] {
+			seen[sha] = true
+			matches = append(matches, sha)
+		}
+	}
+	sort.Strings(matches)
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("%w: no commit matching short sha %q in the last %d commits of the remote's refs", errCommitNotFound, opts.Ref, expandSearchDepth)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("short sha %q is ambiguous in the last %d commits of the remote's refs, candidates: %s", opts.Ref, expandSearchDepth, strings.Join(matches, ", "))
+	}
+}
+
+// resolve turns opts.Ref into a full commit sha, either by looking up the ref
+// name on the remote or, when enabled, expanding it as an abbreviated sha.
+func resolve(ctx context.Context, opts *Options, auth transport.AuthMethod) (string, error) {
+	log.WithFields(log.Fields{
+		"url": opts.Repo,
+		"ref": opts.Ref,
+	}).Debugln("listing remote refs")
+	ar, err := advertisedRefs(ctx, opts.Repo, auth)
+	if err != nil {
+		return "", err
+	}
+
+	sha, err := ResolveRef(ar, opts.Ref)
+	if err == nil || !errors.Is(err, errRefNotFound) || !opts.ExpandSHA || !isAbbrevSHA(opts.Ref) {
+		return sha, err
+	}
+
+	log.WithField("ref", opts.Ref).Debugln("no matching ref, expanding as short sha")
+	return expandSHA(ctx, opts, ar, auth)
+}
@@ -0,0 +1,145 @@
+package sfs_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+var _ = Describe("ResolveRef", func() {
+	var (
+		ar        *packp.AdvRefs
+		headSHA   = "1bd1c0c32ff7d4b4db95a3591a5c018b86708c8b"
+		branchSHA = "0196c49057e45387838aa3a1d0601e8c7a4317d0"
+		tagSHA    = "fd40042f1a21da61b4abddebbe94f21dc700ffb0"
+		peeledSHA = "b8e471f58bcbca63b07bda20e428190409c2db47"
+	)
+
+	BeforeEach(func() {
+		head := plumbing.NewHash(headSHA)
+		ar = packp.NewAdvRefs()
+		ar.Head = &head
+		ar.References["refs/heads/main"] = head
+		ar.References["refs/heads/feature"] = plumbing.NewHash(branchSHA)
+		ar.References["refs/tags/v1.0.0"] = plumbing.NewHash(tagSHA)
+		ar.Peeled["refs/tags/v1.0.0"] = plumbing.NewHash(peeledSHA)
+		ar.References["refs/tags/feature"] = plumbing.NewHash(tagSHA)
+	})
+
+	It("should resolve HEAD", func() {
+		Expect(sfs.ResolveRef(ar, "HEAD")).To(Equal(headSHA))
+	})
+
+	It("should resolve full ref names", func() {
+		Expect(sfs.ResolveRef(ar, "refs/heads/feature")).To(Equal(branchSHA))
+	})
+
+	It("should resolve bare branch names", func() {
+		Expect(sfs.ResolveRef(ar, "main")).To(Equal(headSHA))
+	})
+
+	It("should peel annotated tags", func() {
+		Expect(sfs.ResolveRef(ar, "v1.0.0")).To(Equal(peeledSHA))
+		Expect(sfs.ResolveRef(ar, "refs/tags/v1.0.0")).To(Equal(peeledSHA))
+	})
+
+	It("should prefer tags over branches like git", func() {
+		Expect(sfs.ResolveRef(ar, "feature")).To(Equal(tagSHA))
+	})
+
+	It("should fail for unknown refs", func() {
+		_, err := sfs.ResolveRef(ar, "nope")
+		Expect(err).To(Not(BeNil()))
+	})
+})
+
+var _ = Describe("MatchSHAPrefix", func() {
+	var ar *packp.AdvRefs
+
+	BeforeEach(func() {
+		ar = packp.NewAdvRefs()
+		ar.References["refs/heads/main"] = plumbing.NewHash("1bd1c0c32ff7d4b4db95a3591a5c018b86708c8b")
+		ar.References["refs/heads/other"] = plumbing.NewHash("1bd1ffffffffffffffffffffffffffffffffffff")
+		ar.References["refs/tags/v1.0.0"] = plumbing.NewHash("fd40042f1a21da61b4abddebbe94f21dc700ffb0")
+		ar.Peeled["refs/tags/v1.0.0"] = plumbing.NewHash("b8e471f58bcbca63b07bda20e428190409c2db47")
+	})
+
+	It("should match a unique prefix", func() {
+		Expect(sfs.MatchSHAPrefix(ar, "1bd1c0c")).To(Equal([]string{"1bd1c0c32ff7d4b4db95a3591a5c018b86708c8b"}))
+	})
+
+	It("should be case insensitive", func() {
+		Expect(sfs.MatchSHAPrefix(ar, "1BD1C0C")).To(HaveLen(1))
+	})
+
+	It("should return every candidate for an ambiguous prefix", func() {
+		Expect(sfs.MatchSHAPrefix(ar, "1bd1")).To(HaveLen(2))
+	})
+
+	It("should match peeled tags instead of tag objects", func() {
+		Expect(sfs.MatchSHAPrefix(ar, "b8e471f")).To(HaveLen(1))
+		Expect(sfs.MatchSHAPrefix(ar, "fd40042")).To(BeEmpty())
+	})
+})
+
+// commitLike adds a commit on top of the branch of HEAD in root/repo.git, made
+// by gitRepo, whose sha starts with the first four digits of the sha of an
+// older commit, and returns it.
+func commitLike(root, sha string) string {
+	repo, err := git.PlainOpen(filepath.Join(root, "repo.git"))
+	plsno(err)
+	head, err := repo.Head()
+	plsno(err)
+	parent, err := repo.CommitObject(head.Hash())
+	plsno(err)
+
+	sig := object.Signature{Name: "sfs", Email: "sfs@example.com", When: time.Unix(1600000000, 0).UTC()}
+	for i := 0; ; i++ {
+		commit := &object.Commit{
+			Author:       sig,
+			Committer:    sig,
+			Message:      fmt.Sprintf("collide %d\n", i),
+			TreeHash:     parent.TreeHash,
+			ParentHashes: []plumbing.Hash{parent.Hash},
+		}
+		obj := repo.Storer.NewEncodedObject()
+		plsno(commit.Encode(obj))
+		if obj.Hash().String()[:4] != sha[:4] {
+			continue
+		}
+
+		hash, err := repo.Storer.SetEncodedObject(obj)
+		plsno(err)
+		plsno(repo.Storer.SetReference(plumbing.NewHashReference(head.Name(), hash)))
+		return hash.String()
+	}
+}
+
+var _ = Describe("ExpandSHA", func() {
+	It("should report a short sha matching a ref tip and an older commit as ambiguous", func() {
+		root, shas := gitRepo(2)
+		tip := commitLike(root, shas[1])
+		url, stop := serveRepo(root)
+		defer stop()
+
+		options := sfs.Options{
+			Repo:      url,
+			Ref:       tip[:4],
+			ExpandSHA: true,
+			Directory: makeTemp(),
+			Silent:    true,
+		}
+		err := sfs.ShallowFetchSHA(&options)
+		Expect(err).To(MatchError(ContainSubstring("is ambiguous")))
+		Expect(err).To(MatchError(ContainSubstring(shas[1])))
+		Expect(err).To(MatchError(ContainSubstring(tip)))
+	})
+})
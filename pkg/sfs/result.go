@@ -0,0 +1,224 @@
+package sfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/idxfile"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Result is what a fetch did, as far as it got when it failed: the commit it
+// fetched, how much it transferred and how long each step took.
+type Result struct {
+	Repo      string
+	SHA       string
+	Directory string
+	Archive   string
+	// Commit is nil until the commit is fetched.
+	Commit *CommitInfo
+	// Cached is true when the commit came from the cache, without fetching.
+	Cached bool
+	// Bytes is the size of the packfiles received from the remote, and Objects
+	// the objects in them. Neither includes submodules or lfs objects. When
+	// the server doesn't let the commit be fetched by sha, the history fetched
+	// around it is pruned first, and they're what was kept of it.
+	Bytes   int64
+	Objects ObjectCounts
+	// Durations is how long each step took, keyed by the Op constants.
+	// Retries are included.
+	Durations map[string]time.Duration
+	Duration  time.Duration
+}
+
+// CommitInfo is the metadata of a fetched commit.
+type CommitInfo struct {
+	Author    object.Signature
+	Committer object.Signature
+	Message   string
+	Tree      string
+}
+
+// ObjectCounts is the number of git objects of each type.
+type ObjectCounts struct {
+	Commits int
+	Trees   int
+	Blobs   int
+	Tags    int
+}
+
+func (c ObjectCounts) Total() int {
+	return c.Commits + c.Trees + c.Blobs + c.Tags
+}
+
+func (c ObjectCounts) sub(o ObjectCounts) ObjectCounts {
+	return ObjectCounts{
+		Commits: c.Commits - o.Commits,
+		Trees:   c.Trees - o.Trees,
+		Blobs:   c.Blobs - o.Blobs,
+		Tags:    c.Tags - o.Tags,
+	}
+}
+
+func (c *ObjectCounts) add(t plumbing.ObjectType) {
+	switch t {
+	case plumbing.CommitObject:
+		c.Commits++
+	case plumbing.TreeObject:
+		c.Trees++
+	case plumbing.BlobObject:
+		c.Blobs++
+	case plumbing.TagObject:
+		c.Tags++
+	}
+}
+
+func newResult(opts *Options) *Result {
+	return &Result{
+		Repo:      opts.Repo,
+		SHA:       opts.SHA,
+		Directory: opts.Directory,
+		Archive:   opts.Archive,
+		Durations: map[string]time.Duration{},
+	}
+}
+
+// phase adds the time since start to the duration of op.
+func (r *Result) phase(op string, start time.Time) {
+	r.Durations[op] += time.Since(start)
+}
+
+func (r *Result) setCommit(commit *object.Commit) {
+	r.SHA = commit.Hash.String()
+	r.Commit = &CommitInfo{
+		Author:    commit.Author,
+		Committer: commit.Committer,
+		Message:   commit.Message,
+		Tree:      commit.TreeHash.String(),
+	}
+}
+
+// storageStats is the size of the packfiles of the repository in gitDir and
+// the number of objects of each type in it.
+func storageStats(repo *git.Repository, gitDir string) (int64, ObjectCounts, error) {
+	var counts ObjectCounts
+
+	packs, err := filepath.Glob(filepath.Join(gitDir, "objects", "pack", "*.pack"))
+	if err != nil {
+		return 0, counts, err
+	}
+
+	var size int64
+	for _, pack := range packs {
+		fi, err := os.Stat(pack)
+		if err != nil {
+			return 0, counts, err
+		}
+		size += fi.Size()
+	}
+
+	iter, err := repo.Storer.IterEncodedObjects(plumbing.AnyObject)
+	if err != nil {
+		return 0, counts, err
+	}
+
+	err = iter.ForEach(func(obj plumbing.EncodedObject) error {
+		counts.add(obj.Type())
+		return nil
+	})
+	return size, counts, err
+}
+
+// setTransfer records what was fetched into the repository in gitDir since
+// its storageStats were size and counts.
+func (r *Result) setTransfer(repo *git.Repository, gitDir string, size int64, counts ObjectCounts) error {
+	after, afterCounts, err := storageStats(repo, gitDir)
+	if err != nil {
+		return err
+	}
+
+	r.Bytes = after - size
+	r.Objects = afterCounts.sub(counts)
+	return nil
+}
+
+// packNames is the set of packfiles of the repository in gitDir.
+func packNames(gitDir string) (map[string]bool, error) {
+	packs, err := filepath.Glob(filepath.Join(gitDir, "objects", "pack", "*.pack"))
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for _, pack := range packs {
+		names[filepath.Base(pack)] = true
+	}
+	return names, nil
+}
+
+// setPackTransfer records what was fetched into the repository in gitDir
+// from the packfiles that aren't in before. Unlike setTransfer it only reads
+// the new packfiles, for repositories too large to count every object of.
+func (r *Result) setPackTransfer(gitDir string, before map[string]bool) error {
+	after, err := packNames(gitDir)
+	if err != nil {
+		return err
+	}
+
+	packDir := filepath.Join(gitDir, "objects", "pack")
+	fs := osfs.New(packDir)
+	for name := range after {
+		if before[name] {
+			continue
+		}
+
+		fi, err := os.Stat(filepath.Join(packDir, name))
+		if err != nil {
+			return err
+		}
+		r.Bytes += fi.Size()
+
+		if err := countPack(fs, name, &r.Objects); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// countPack adds the objects in the packfile name of fs to counts.
+func countPack(fs billy.Filesystem, name string, counts *ObjectCounts) error {
+	idxf, err := fs.Open(strings.TrimSuffix(name, ".pack") + ".idx")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = idxf.Close() }()
+
+	idx := idxfile.NewMemoryIndex()
+	if err := idxfile.NewDecoder(idxf).Decode(idx); err != nil {
+		return err
+	}
+
+	f, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	p := packfile.NewPackfile(idx, fs, f)
+	defer func() { _ = p.Close() }()
+
+	iter, err := p.GetAll()
+	if err != nil {
+		return err
+	}
+	return iter.ForEach(func(obj plumbing.EncodedObject) error {
+		counts.add(obj.Type())
+		return nil
+	})
+}
@@ -0,0 +1,202 @@
+package sfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaults for the zero fields of a RetryPolicy
+const (
+	DefaultRetryBackoff    = time.Second
+	DefaultRetryMaxBackoff = 30 * time.Second
+	DefaultRetryJitter     = 0.2
+)
+
+// fatalErrors are never worth retrying, the same request will fail again
+var fatalErrors = []error{
+	transport.ErrRepositoryNotFound,
+	transport.ErrEmptyRemoteRepository,
+	transport.ErrAuthenticationRequired,
+	transport.ErrAuthorizationFailed,
+	transport.ErrInvalidAuthMethod,
+	plumbing.ErrObjectNotFound,
+	errRefNotFound,
+	errCommitNotFound,
+}
+
+// transient failures go-git only reports as a message
+var retryableMessages = []string{
+	"connection reset by peer",
+	"broken pipe",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"unexpected EOF",
+}
+
+// RetryPolicy is how network operations that fail with a transient error are
+// retried. The wait before each retry doubles from Backoff up to MaxBackoff,
+// and is randomly spread by Jitter, a fraction of the wait, so many clients
+// retrying at once don't all hit the server at the same time. The zero value
+// doesn't retry.
+type RetryPolicy struct {
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Jitter     float64
+}
+
+// jitterRand spreads retry waits. The global source of math/rand always
+// starts from the same seed before Go 1.20, which would have every process
+// retry at the same times.
+var jitterRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// Wait is how long to wait before the nth retry, starting at 1.
+func (p RetryPolicy) Wait(n int) time.Duration {
+	backoff, max := p.Backoff, p.MaxBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	if max <= 0 {
+		max = DefaultRetryMaxBackoff
+	}
+
+	d := backoff
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+
+	if p.Jitter > 0 {
+		jitterRand.Lock()
+		r := jitterRand.Float64()
+		jitterRand.Unlock()
+
+		// anywhere from d*(1-jitter) to d*(1+jitter)
+		d += time.Duration(float64(d) * p.Jitter * (2*r - 1))
+	}
+	return d
+}
+
+// statusError is an http request failing with an unexpected status.
+type statusError struct {
+	msg    string
+	status string
+	code   int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.msg, e.status)
+}
+
+// statusCode finds the http status code of a failed request in err.
+func statusCode(err error) (int, bool) {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code, true
+	}
+
+	var he *githttp.Err
+	if errors.As(err, &he) {
+		return he.StatusCode(), true
+	}
+
+	return 0, false
+}
+
+// IsRetryable reports whether err is a transient failure worth retrying: the
+// connection failing, timing out or being reset, or the server replying with a
+// 5xx or 429 status. Anything else, like failing to authenticate or the repo or
+// commit not being found, is fatal.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	// once the context is done, retrying can't get anywhere
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if isAny(err, fatalErrors) {
+		return false
+	}
+
+	var optErr *OptionError
+	if errors.As(err, &optErr) {
+		return false
+	}
+
+	// go-git wraps transport errors in types without Unwrap
+	var unexpected *plumbing.UnexpectedError
+	if errors.As(err, &unexpected) {
+		return IsRetryable(unexpected.Err)
+	}
+
+	var permanent *plumbing.PermanentError
+	if errors.As(err, &permanent) {
+		return false
+	}
+
+	if code, ok := statusCode(err); ok {
+		return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		// a host that doesn't exist won't start existing
+		return !dnsErr.IsNotFound
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	return hasMessage(err, retryableMessages)
+}
+
+// retry calls fn until it succeeds, fails with an error that isn't retryable,
+// runs out of retries or the context is done.
+func retry(ctx context.Context, policy RetryPolicy, op string, fn func() error) error {
+	for n := 1; ; n++ {
+		err := fn()
+		if err == nil || n > policy.Retries || ctx.Err() != nil || !IsRetryable(err) {
+			return err
+		}
+
+		wait := policy.Wait(n)
+		log.WithFields(log.Fields{
+			"op":    op,
+			"retry": fmt.Sprintf("%d/%d", n, policy.Retries),
+			"wait":  wait.Round(time.Millisecond),
+		}).Warnln(err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package sfs_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+func httpErr(code int) error {
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/repo.git/info/refs", nil)
+	return githttp.NewErr(&http.Response{StatusCode: code, Request: req})
+}
+
+var _ = Describe("IsRetryable", func() {
+	It("should retry transient network failures", func() {
+		Expect(sfs.IsRetryable(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET})).To(BeTrue())
+		Expect(sfs.IsRetryable(&url.Error{Op: "Get", URL: "https://example.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}})).To(BeTrue())
+		Expect(sfs.IsRetryable(fmt.Errorf("reading pack: %w", io.ErrUnexpectedEOF))).To(BeTrue())
+		Expect(sfs.IsRetryable(errors.New("read tcp 10.0.0.1:22: connection reset by peer"))).To(BeTrue())
+		Expect(sfs.IsRetryable(&net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true})).To(BeTrue())
+	})
+
+	It("should retry 5xx and 429 responses", func() {
+		Expect(sfs.IsRetryable(httpErr(http.StatusBadGateway))).To(BeTrue())
+		Expect(sfs.IsRetryable(httpErr(http.StatusServiceUnavailable))).To(BeTrue())
+		Expect(sfs.IsRetryable(httpErr(http.StatusTooManyRequests))).To(BeTrue())
+		Expect(sfs.IsRetryable(&sfs.Error{Op: sfs.OpFetch, Err: httpErr(http.StatusInternalServerError)})).To(BeTrue())
+	})
+
+	It("should not retry fatal errors", func() {
+		Expect(sfs.IsRetryable(nil)).To(BeFalse())
+		Expect(sfs.IsRetryable(httpErr(http.StatusUnauthorized))).To(BeFalse())
+		Expect(sfs.IsRetryable(httpErr(http.StatusNotFound))).To(BeFalse())
+		Expect(sfs.IsRetryable(httpErr(http.StatusBadRequest))).To(BeFalse())
+		Expect(sfs.IsRetryable(transport.ErrAuthenticationRequired)).To(BeFalse())
+		Expect(sfs.IsRetryable(&sfs.Error{Op: sfs.OpFetch, Err: plumbing.ErrObjectNotFound})).To(BeFalse())
+		Expect(sfs.IsRetryable(&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true})).To(BeFalse())
+		Expect(sfs.IsRetryable(errors.New("ssh: handshake failed: ssh: unable to authenticate"))).To(BeFalse())
+	})
+
+	It("should not retry once the context is done", func() {
+		Expect(sfs.IsRetryable(context.DeadlineExceeded)).To(BeFalse())
+		Expect(sfs.IsRetryable(&sfs.Error{Op: sfs.OpFetch, Err: context.Canceled})).To(BeFalse())
+	})
+})
+
+var _ = Describe("RetryPolicy", func() {
+	It("should double the wait up to the max backoff", func() {
+		policy := sfs.RetryPolicy{Retries: 5, Backoff: time.Second, MaxBackoff: 5 * time.Second}
+		Expect(policy.Wait(1)).To(Equal(time.Second))
+		Expect(policy.Wait(2)).To(Equal(2 * time.Second))
+		Expect(policy.Wait(3)).To(Equal(4 * time.Second))
+		Expect(policy.Wait(4)).To(Equal(5 * time.Second))
+	})
+
+	It("should spread waits within the jitter", func() {
+		policy := sfs.RetryPolicy{Retries: 3, Backoff: time.Second, Jitter: 0.2}
+
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 100; i++ {
+			wait := policy.Wait(2)
+			Expect(wait).To(BeNumerically(">=", 1600*time.Millisecond))
+			Expect(wait).To(BeNumerically("<=", 2400*time.Millisecond))
+			seen[wait] = true
+		}
+		Expect(len(seen)).To(BeNumerically(">", 1))
+	})
+})
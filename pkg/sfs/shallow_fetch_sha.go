@@ -0,0 +1,395 @@
+package sfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	gitcfg "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	remoteName   = git.DefaultRemoteName
+	defaultDepth = 1
+
+	// DefaultFallbackDepth is how deep advertised refs are searched for a
+	// commit when the server can't fetch it by sha.
+	DefaultFallbackDepth = 256
+)
+
+// ShallowFetchSHA fetches and checks out opts.SHA, or the commit opts.Ref
+// resolves to, of opts.Repo in opts.Directory. The options should be validated
+// first. Fetcher does both, and is the simpler way to fetch a repository.
+func ShallowFetchSHA(opts *Options) error {
+	return ShallowFetchSHAContext(context.Background(), opts)
+}
+
+// ShallowFetchSHAContext is ShallowFetchSHA with a context. When the context
+// is done the fetch is stopped, opts.Directory is left as it was and the error
+// wraps the context's error.
+func ShallowFetchSHAContext(ctx context.Context, opts *Options) error {
+	if opts == nil {
+		return errors.New("must initialize options")
+	}
+	return shallowFetchSHA(ctx, opts, newResult(opts))
+}
+
+// shallowFetchSHA is ShallowFetchSHAContext, recording what it did in res.
+func shallowFetchSHA(ctx context.Context, opts *Options, res *Result) (err error) {
+	start := time.Now()
+	defer func() { res.Duration = time.Since(start) }()
+
+	absDir, err := filepath.Abs(opts.Directory)
+	if err != nil {
+		return fmt.Errorf("invalid directory: %s", err)
+	}
+
+	_, statErr := os.Stat(absDir)
+	created := os.IsNotExist(statErr)
+	defer func() {
+		if err == nil || ctx.Err() == nil {
+			return
+		}
+
+		var e *Error
+		if errors.As(err, &e) {
+			err = &Error{Op: e.Op, Repo: e.Repo, Err: ctx.Err()}
+		} else {
+			err = ctx.Err()
+		}
+	}()
+
+	patterns, err := opts.SparsePatterns()
+	if err != nil {
+		return err
+	}
+
+	var sparse *SparseMatcher
+	if len(patterns) > 0 {
+		sparse = NewSparseMatcher(patterns)
+	}
+
+	log.WithFields(log.Fields{
+		"https": opts.BasicAuth != nil,
+		"ssh":   opts.SSHAuth != nil,
+	}).Debugln("configuring auth")
+	auth, closeAuth, err := opts.auth()
+	if err != nil {
+		return opError(OpAuth, opts.Repo, err)
+	}
+	defer closeAuth()
+
+	if opts.Ref != "" {
+		var sha string
+		phase := time.Now()
+		err := retry(ctx, opts.Retry, OpResolve, func() (err error) {
+			sha, err = resolve(ctx, opts, auth)
+			return err
+		})
+		res.phase(OpResolve, phase)
+		if err != nil {
+			return opError(OpResolve, opts.Repo, err)
+		}
+
+		log.WithFields(log.Fields{
+			"ref": opts.Ref,
+			"sha": sha,
+		}).Info("resolved ref")
+		opts.SHA = sha
+		res.SHA = sha
+	}
+
+	if opts.Archive != "" {
+		if err := archive(ctx, opts, auth, sparse, res); err != nil {
+			return opError(OpArchive, opts.Repo, err)
+		}
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"sha": opts.SHA,
+		"dir": absDir,
+	}).Info("shallow fetching repository")
+
+	fetchSparse := sparse
+	if sparse != nil && opts.Recursive {
+		// submodule urls are needed even when .gitmodules isn't checked out
+		fetchSparse = NewSparseMatcher(append(patterns[:len(patterns):len(patterns)], "/"+gitmodulesFile))
+	}
+
+	if err := checkProtected(absDir); err != nil {
+		return err
+	}
+
+	// the repository and index of the checkout being updated, if any
+	var existing *git.Repository
+	var before *index.Index
+	if !created {
+		existing, err = prepareDirectory(absDir, opts)
+		if err != nil {
+			return opError(OpInit, opts.Repo, err)
+		}
+	}
+	if existing != nil && opts.IfExists != IfExistsClean {
+		before, err = prepareUpdate(existing, absDir, opts)
+		if err != nil {
+			return opError(OpInit, opts.Repo, err)
+		}
+	}
+
+	// everything is written to staging, which only replaces absDir once the
+	// checkout is done
+	staging, err := newStaging(absDir, existing != nil || opts.IfExists == IfExistsMerge, opts.KeepOnFailure)
+	if err != nil {
+		return opError(OpInit, opts.Repo, err)
+	}
+	defer func() {
+		if err != nil {
+			rollback(staging)
+		}
+	}()
+
+	if existing != nil {
+		if existing, err = openStaged(staging, opts.Repo); err != nil {
+			return opError(OpInit, opts.Repo, err)
+		}
+	}
+	if existing != nil && opts.IfExists == IfExistsClean {
+		before, err = prepareUpdate(existing, staging, opts)
+		if err != nil {
+			return opError(OpInit, opts.Repo, err)
+		}
+	}
+
+	gitDir := filepath.Join(staging, git.GitDirName)
+	phase := time.Now()
+	strategy := strategyCache
+	var repo *git.Repository
+	if existing == nil {
+		repo = fromCache(opts, staging, gitDir, false)
+	}
+	switch {
+	case existing != nil:
+		strategy, repo, err = updateRepository(ctx, opts, auth, existing, staging, fetchSparse, res)
+	case repo != nil:
+	case opts.ObjectStore != "":
+		strategy, repo, err = fromStore(ctx, opts, auth, staging, res)
+	default:
+		strategy, repo, err = fetchRepository(ctx, opts, auth, staging, gitDir, false, fetchSparse)
+	}
+	res.phase(OpFetch, phase)
+	if err != nil {
+		return err
+	}
+	res.Cached = strategy == strategyCache
+
+	log.WithFields(log.Fields{
+		"sha":      opts.SHA,
+		"strategy": strategy,
+	}).Info("fetched commit")
+
+	if strategy == strategyFilter {
+		if err := markPartialClone(repo, staging, opts.Filter); err != nil {
+			return opError(OpFetch, opts.Repo, err)
+		}
+	}
+	if existing != nil && prunable(repo, opts, strategy) {
+		log.Debugln("pruning the previous checkout's history")
+		if err := pruneHistory(repo, plumbing.NewHash(opts.SHA), opts.depth()); err != nil {
+			return opError(OpFetch, opts.Repo, err)
+		}
+	}
+	toCache(opts, gitDir, strategy)
+
+	commit, err := repo.CommitObject(plumbing.NewHash(opts.SHA))
+	if err != nil {
+		return opError(OpFetch, opts.Repo, err)
+	}
+	res.setCommit(commit)
+	// fetching into the object store or an existing checkout already recorded
+	// its transfer
+	if !res.Cached && opts.ObjectStore == "" && existing == nil {
+		if err := res.setTransfer(repo, gitDir, 0, ObjectCounts{}); err != nil {
+			log.Debugln("unable to count fetched objects:", err)
+		}
+	}
+
+	// checking out can't be stopped part way, don't start if already canceled
+	if err := ctx.Err(); err != nil {
+		return opError(OpCheckout, opts.Repo, err)
+	}
+
+	phase = time.Now()
+	if existing != nil {
+		err := removeStale(repo, staging, plumbing.NewHash(opts.SHA), sparse, before)
+		if err != nil {
+			return opError(OpCheckout, opts.Repo, err)
+		}
+	}
+
+	if sparse != nil {
+		log.WithFields(log.Fields{
+			"hash":     opts.SHA,
+			"patterns": patterns,
+		}).Debugln("checking out sparse tree")
+		err = sparseCheckout(repo, staging, plumbing.NewHash(opts.SHA), patterns, before)
+		if err != nil {
+			return opError(OpCheckout, opts.Repo, err)
+		}
+	} else if existing != nil || opts.IfExists == IfExistsMerge {
+		// go-git removes the files that aren't in the commit, and can't check
+		// out over submodules
+		log.WithFields(log.Fields{
+			"hash": opts.SHA,
+		}).Debugln("checking out hash over existing files")
+		err = checkoutTree(repo, staging, plumbing.NewHash(opts.SHA), nil, before)
+		if err != nil {
+			return opError(OpCheckout, opts.Repo, err)
+		}
+	} else {
+		log.Debugln("retrieving worktree")
+		worktree, err := repo.Worktree()
+		if err != nil {
+			return opError(OpCheckout, opts.Repo, err)
+		}
+
+		if worktree == nil {
+			return opError(OpCheckout, opts.Repo, errors.New("unknown working tree"))
+		}
+
+		log.WithFields(log.Fields{
+			"hash": opts.SHA,
+		}).Debugln("checking out hash")
+		err = worktree.Checkout(&git.CheckoutOptions{
+			Hash: plumbing.NewHash(opts.SHA),
+		})
+		if err != nil {
+			return opError(OpCheckout, opts.Repo, err)
+		}
+	}
+
+	if existing != nil {
+		if sparse == nil {
+			if err := disableSparseCheckout(repo, staging); err != nil {
+				return opError(OpCheckout, opts.Repo, err)
+			}
+		}
+	} else if opts.IfExists == IfExistsMerge {
+		warnStray(repo, staging)
+	}
+	res.phase(OpCheckout, phase)
+
+	if opts.LFS {
+		phase := time.Now()
+		err := fetchLFS(ctx, repo, staging, opts, auth, sparse)
+		res.phase(OpLFS, phase)
+		if err != nil {
+			return opError(OpLFS, opts.Repo, err)
+		}
+	}
+
+	if opts.Recursive {
+		phase := time.Now()
+		err := fetchSubmodules(ctx, repo, staging, opts, sparse)
+		res.phase(OpSubmodule, phase)
+		if err != nil {
+			return opError(OpSubmodule, opts.Repo, err)
+		}
+	}
+
+	if opts.RemoveDotGit {
+		log.Debugf("removing %q directory\n", git.GitDirName)
+		dotGitPath := filepath.Join(staging, git.GitDirName)
+		if err := os.RemoveAll(dotGitPath); err != nil {
+			return opError(OpCheckout, opts.Repo, fmt.Errorf("unable to remove .git path: %w", err))
+		}
+	}
+
+	log.WithField("dir", absDir).Debugln("moving staging directory into place")
+	if err := commitStaging(staging, absDir, !created); err != nil {
+		return opError(OpCheckout, opts.Repo, err)
+	}
+	return nil
+}
+
+// prunable reports whether the history of the previous checkout can be pruned
+// from repo after an update fetched strategy into it. Deepening prunes on its
+// own, the object store keeps history for other checkouts, and a partial clone
+// doesn't have the objects to repack.
+func prunable(repo *git.Repository, opts *Options, strategy string) bool {
+	switch {
+	case strategy == strategyUpToDate, strategy == strategyDeepen:
+		return false
+	case opts.ObjectStore != "":
+		return false
+	}
+	return !isPartialClone(repo)
+}
+
+// fetchRepository initializes a repository in dir, with its git directory in
+// gitDir, and fetches opts.SHA into it, starting over from an empty repository
+// for each retry. It returns the strategy that worked.
+func fetchRepository(ctx context.Context, opts *Options, auth transport.AuthMethod, dir, gitDir string, bare bool, sparse *SparseMatcher) (strategy string, repo *git.Repository, err error) {
+	err = retry(ctx, opts.Retry, OpFetch, func() error {
+		if repo != nil {
+			// start over, a failed fetch can leave objects and shallow commits behind
+			log.Debugln("resetting repository")
+			if err := os.RemoveAll(gitDir); err != nil {
+				return opError(OpInit, opts.Repo, err)
+			}
+		}
+
+		log.Debugln("initalizing repository on filesystem")
+		repo, err = initRepository(dir, opts.Repo, bare)
+		if err != nil {
+			return opError(OpInit, opts.Repo, err)
+		}
+
+		strategy, err = fetchCommit(ctx, repo, opts, auth, opts.progress())
+		if err != nil {
+			return opError(OpFetch, opts.Repo, err)
+		}
+
+		if strategy == strategyFilter {
+			commits := []plumbing.Hash{plumbing.NewHash(opts.SHA)}
+			if err := fetchMissingObjects(ctx, repo, commits, opts, auth, sparse, opts.progress()); err != nil {
+				return opError(OpFetch, opts.Repo, err)
+			}
+		}
+		return nil
+	})
+	return strategy, repo, err
+}
+
+// initRepository creates a repository in dir with the url as its remote.
+func initRepository(dir, url string, bare bool) (*git.Repository, error) {
+	repo, err := git.PlainInit(dir, bare)
+	if errors.Is(err, git.ErrRepositoryAlreadyExists) {
+		return nil, fmt.Errorf("%q already has a repository: %w", dir, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"remote": remoteName,
+		"url":    url,
+	}).Debugln("creating remote")
+	_, err = repo.CreateRemote(&gitcfg.RemoteConfig{
+		Name: remoteName,
+		URLs: []string{url},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
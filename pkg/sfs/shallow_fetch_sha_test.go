@@ -0,0 +1,313 @@
+package sfs_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-git/v5"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+func checkFiles(dir string, expectedFiles []string) bool {
+	foundFiles, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+
+	for _, expected := range expectedFiles {
+		seen := false
+		for _, found := range foundFiles {
+			if expected == found.Name() {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			return false
+		}
+	}
+
+	return true
+}
+
+var _ = Describe("ShallowFetchSha", func() {
+	It("should fetch a public repo via https", func() {
+		tmpDir := makeTemp()
+		options := sfs.Options{
+			Repo:      publicRepo.HTTPS,
+			SHA:       publicRepo.Commit,
+			Directory: tmpDir,
+			Silent:    true,
+		}
+
+		err := sfs.ShallowFetchSHA(&options)
+		Expect(err).To(BeNil())
+
+		seenAllFiles := checkFiles(tmpDir, publicRepo.ExpectedFiles)
+		Expect(seenAllFiles).To(BeTrue())
+	})
+
+	It("should fetch a public repo by ref", func() {
+		tmpDir := makeTemp()
+		options := sfs.Options{
+			Repo:      publicRepo.HTTPS,
+			Ref:       "HEAD",
+			Directory: tmpDir,
+			Silent:    true,
+		}
+
+		err := sfs.ShallowFetchSHA(&options)
+		Expect(err).To(BeNil())
+		Expect(options.SHA).To(HaveLen(40))
+
+		seenAllFiles := checkFiles(tmpDir, publicRepo.ExpectedFiles)
+		Expect(seenAllFiles).To(BeTrue())
+	})
+
+	It("should fetch a public repo with a filter", func() {
+		tmpDir := makeTemp()
+		options := sfs.Options{
+			Repo:      publicRepo.HTTPS,
+			SHA:       publicRepo.Commit,
+			Directory: tmpDir,
+			Filter:    "blob:none",
+			Silent:    true,
+		}
+
+		err := sfs.ShallowFetchSHA(&options)
+		Expect(err).To(BeNil())
+
+		seenAllFiles := checkFiles(tmpDir, publicRepo.ExpectedFiles)
+		Expect(seenAllFiles).To(BeTrue())
+	})
+
+	It("should fetch only included paths of a public repo", func() {
+		tmpDir := makeTemp()
+		options := sfs.Options{
+			Repo:      publicRepo.HTTPS,
+			SHA:       publicRepo.Commit,
+			Directory: tmpDir,
+			Include:   []string{"README.md"},
+			Silent:    true,
+		}
+
+		err := sfs.ShallowFetchSHA(&options)
+		Expect(err).To(BeNil())
+
+		Expect(checkFiles(tmpDir, []string{"README.md"})).To(BeTrue())
+		Expect(filepath.Join(tmpDir, "index.js")).ToNot(BeAnExistingFile())
+		Expect(filepath.Join(tmpDir, git.GitDirName, "info", "sparse-checkout")).To(BeAnExistingFile())
+	})
+
+	It("should archive a public repo", func() {
+		archive := filepath.Join(makeTemp(), "repo.tar.gz")
+		options := sfs.Options{
+			Repo:    publicRepo.HTTPS,
+			SHA:     publicRepo.Commit,
+			Archive: archive,
+			Silent:  true,
+		}
+
+		err := sfs.ShallowFetchSHA(&options)
+		Expect(err).To(BeNil())
+
+		f, err := os.Open(archive)
+		Expect(err).To(BeNil())
+		defer f.Close()
+
+		gz, err := gzip.NewReader(f)
+		Expect(err).To(BeNil())
+
+		var names []string
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			Expect(err).To(BeNil())
+			names = append(names, hdr.Name)
+		}
+		Expect(names).To(ContainElements(publicRepo.ExpectedFiles))
+	})
+
+	It("should fetch a public repo via ssh", func() {
+		tmpDir := makeTemp()
+		options := sfs.Options{
+			Repo:      publicRepo.SSH,
+			SHA:       publicRepo.Commit,
+			Directory: tmpDir,
+			Silent:    true,
+			SSHAuth: &sfs.SSHAuthOptions{
+				PEMPath: sshKeyNoPassPath,
+			},
+		}
+
+		err := sfs.ShallowFetchSHA(&options)
+		Expect(err).To(BeNil())
+
+		seenAllFiles := checkFiles(tmpDir, publicRepo.ExpectedFiles)
+		Expect(seenAllFiles).To(BeTrue())
+	})
+
+	It("should fetch a private repo via ssh", func() {
+		tmpDir := makeTemp()
+		options := sfs.Options{
+			Repo:      privateRepo.SSH,
+			SHA:       privateRepo.Commit,
+			Directory: tmpDir,
+			SSHAuth: &sfs.SSHAuthOptions{
+				PEMPath: sshKeyNoPassPath,
+			},
+			Silent: true,
+		}
+
+		err := sfs.ShallowFetchSHA(&options)
+		Expect(err).To(BeNil())
+
+		seenAllFiles := checkFiles(tmpDir, privateRepo.ExpectedFiles)
+		Expect(seenAllFiles).To(BeTrue())
+	})
+
+	It("should fetch a private repo via ssh with passphrase", func() {
+		tmpDir := makeTemp()
+		options := sfs.Options{
+			Repo:      privateRepo.SSH,
+			SHA:       privateRepo.Commit,
+			Directory: tmpDir,
+			SSHAuth: &sfs.SSHAuthOptions{
+				PEMPath:    sshKeyWithPassPath,
+				Passphrase: sshPassphrase,
+			},
+			Silent: true,
+		}
+
+		err := sfs.ShallowFetchSHA(&options)
+		Expect(err).To(BeNil())
+
+		seenAllFiles := checkFiles(tmpDir, privateRepo.ExpectedFiles)
+		Expect(seenAllFiles).To(BeTrue())
+	})
+
+	It("should fetch a private repo via https", func() {
+		tmpDir := makeTemp()
+		options := sfs.Options{
+			Repo:      privateRepo.HTTPS,
+			SHA:       privateRepo.Commit,
+			Directory: tmpDir,
+			BasicAuth: &sfs.BasicAuthOptions{
+				Username: "x-access-token",
+				Password: botToken,
+			},
+			Silent: true,
+		}
+
+		err := sfs.ShallowFetchSHA(&options)
+		Expect(err).To(BeNil())
+
+		seenAllFiles := checkFiles(tmpDir, privateRepo.ExpectedFiles)
+		Expect(seenAllFiles).To(BeTrue())
+	})
+
+	It("should deepen an existing checkout", func() {
+		tmpDir := makeTemp()
+		options := sfs.Options{
+			Repo:      publicRepo.HTTPS,
+			SHA:       publicRepo.Commit,
+			Directory: tmpDir,
+			Depth:     1,
+			Silent:    true,
+		}
+
+		err := sfs.ShallowFetchSHA(&options)
+		Expect(err).To(BeNil())
+
+		deepen := sfs.Options{
+			Directory: tmpDir,
+			Deepen:    1,
+			Silent:    true,
+		}
+		Expect(deepen.Validate()).To(BeNil())
+
+		err = sfs.Deepen(&deepen)
+		Expect(err).To(BeNil())
+		Expect(deepen.Repo).To(Equal(publicRepo.HTTPS))
+		Expect(deepen.SHA).To(Equal(publicRepo.Commit))
+		Expect(deepen.Depth).To(Equal(2))
+	})
+
+	It("should deepen the history of a checkout by the given commits", func() {
+		url, shas, stop := gitServer(10)
+		defer stop()
+
+		tmpDir := makeTemp()
+		options := sfs.Options{
+			Repo:          url,
+			SHA:           shas[0],
+			Directory:     tmpDir,
+			Depth:         2,
+			FallbackDepth: 2,
+			Silent:        true,
+		}
+		Expect(sfs.ShallowFetchSHA(&options)).To(BeNil())
+		Expect(commitCount(tmpDir)).To(Equal(2))
+
+		deepen := sfs.Options{
+			Directory: tmpDir,
+			Deepen:    3,
+			Silent:    true,
+		}
+		Expect(sfs.Deepen(&deepen)).To(BeNil())
+		Expect(commitCount(tmpDir)).To(Equal(5))
+
+		Expect(sfs.Deepen(&deepen)).To(BeNil())
+		Expect(commitCount(tmpDir)).To(Equal(8))
+	})
+
+	It("should deepen a checkout of a commit the server won't give by sha", func() {
+		url, shas, stop := gitServer(10)
+		defer stop()
+
+		tmpDir := makeTemp()
+		options := sfs.Options{
+			Repo:          url,
+			SHA:           shas[3],
+			Directory:     tmpDir,
+			FallbackDepth: 16,
+			Silent:        true,
+		}
+		Expect(sfs.ShallowFetchSHA(&options)).To(BeNil())
+
+		deepen := sfs.Options{
+			Directory:     tmpDir,
+			Deepen:        2,
+			FallbackDepth: 16,
+			Silent:        true,
+		}
+		Expect(sfs.Deepen(&deepen)).To(BeNil())
+		Expect(commitCount(tmpDir)).To(Equal(3))
+		Expect(filepath.Join(tmpDir, "8.txt")).ToNot(BeAnExistingFile())
+	})
+
+	It("should remove dot git if specified", func() {
+		tmpDir := makeTemp()
+		options := sfs.Options{
+			Repo:         publicRepo.HTTPS,
+			SHA:          publicRepo.Commit,
+			Directory:    tmpDir,
+			RemoveDotGit: true,
+			Silent:       true,
+		}
+
+		err := sfs.ShallowFetchSHA(&options)
+		Expect(err).To(BeNil())
+
+		_, err = os.Stat(filepath.Join(tmpDir, git.GitDirName))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
@@ -0,0 +1,363 @@
+package sfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// matches everything at the top level, and so everything below it
+	sparseAll = "/*"
+
+	// index entry flags, see Documentation/gitformat-index.txt in git
+	indexFlagExtended     = 0x4000
+	indexFlagSkipWorktree = 0x4000
+	indexNameMask         = 0xfff
+)
+
+// SparsePatterns returns the sparse-checkout patterns for the options, in the
+// format of git's sparse-checkout file: patterns from SparseFile, then Include,
+// then Exclude (negated). Only excluding paths includes everything else. No
+// patterns means the whole tree is checked out.
+func (opts *Options) SparsePatterns() ([]string, error) {
+	var patterns []string
+
+	if opts.SparseFile != "" {
+		f, err := os.Open(opts.SparseFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read sparse file: %s", err)
+		}
+		defer func() { _ = f.Close() }()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			patterns = append(patterns, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("unable to read sparse file: %s", err)
+		}
+	}
+
+	return includeExclude(patterns, opts.Include, opts.Exclude), nil
+}
+
+// includeExclude appends include and then negated exclude patterns to the
+// patterns. When there is nothing else to include, excluding paths includes
+// everything else.
+func includeExclude(patterns, include, exclude []string) []string {
+	patterns = append(patterns, include...)
+
+	if len(exclude) > 0 && len(patterns) == 0 {
+		patterns = append(patterns, sparseAll)
+	}
+	for _, pattern := range exclude {
+		patterns = append(patterns, "!"+pattern)
+	}
+
+	return patterns
+}
+
+// SparseMatcher decides which paths of a tree are checked out. Like git's
+// sparse-checkout file, the last pattern matching a path wins: a plain pattern
+// checks it out and a "!" pattern leaves it out.
+type SparseMatcher struct {
+	matcher gitignore.Matcher
+}
+
+func NewSparseMatcher(patterns []string) *SparseMatcher {
+	ps := make([]gitignore.Pattern, 0, len(patterns))
+	for _, p := range patterns {
+		ps = append(ps, gitignore.ParsePattern(p, nil))
+	}
+
+	return &SparseMatcher{matcher: gitignore.NewMatcher(ps)}
+}
+
+// Match reports whether the file at the slash separated path is checked out.
+// A nil matcher checks out everything.
+func (m *SparseMatcher) Match(name string) bool {
+	if m == nil {
+		return true
+	}
+
+	// gitignore reports a plain pattern as "excluded", here that means included
+	return m.matcher.Match(strings.Split(name, "/"), false)
+}
+
+// sparseCheckout is worktree.Checkout for a subset of the tree. go-git can't
+// check out part of a tree, so the matching files are written by hand, the
+// rest are marked skip-worktree in the index and the patterns are saved to
+// .git/info/sparse-checkout, so git treats the directory as a sparse checkout.
+// prev is the index of a checkout being updated, or nil, see checkoutTree.
+func sparseCheckout(repo *git.Repository, dir string, hash plumbing.Hash, patterns []string, prev *index.Index) error {
+	if err := checkoutTree(repo, dir, hash, NewSparseMatcher(patterns), prev); err != nil {
+		return err
+	}
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	cfg.Raw.Section("core").SetOption("sparseCheckout", "true")
+	if err := repo.SetConfig(cfg); err != nil {
+		return err
+	}
+
+	infoDir := filepath.Join(dir, git.GitDirName, "info")
+	if err := os.MkdirAll(infoDir, 0755); err != nil {
+		return err
+	}
+	contents := strings.Join(patterns, "\n") + "\n"
+	return os.WriteFile(filepath.Join(infoDir, "sparse-checkout"), []byte(contents), 0644)
+}
+
+// checkoutTree writes the files of the commit matching m, or all of them if m
+// is nil, into dir over whatever is there, marks the rest skip-worktree in the
+// index and points HEAD at the commit. Unlike worktree.Checkout, it leaves
+// files that aren't in the tree alone. Files of prev, the index of a checkout
+// being updated, that are unchanged in the commit and on disk are kept as
+// they are.
+func checkoutTree(repo *git.Repository, dir string, hash plumbing.Hash, m *SparseMatcher, prev *index.Index) error {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+
+	kept := make(map[string]*index.Entry)
+	if prev != nil {
+		for _, e := range prev.Entries {
+			if !e.SkipWorktree {
+				kept[e.Name] = e
+			}
+		}
+	}
+
+	var entries []*index.Entry
+	checkedOut := 0
+
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if entry.Mode == filemode.Dir {
+			continue
+		}
+
+		e := &index.Entry{
+			Hash: entry.Hash,
+			Name: name,
+			Mode: entry.Mode,
+		}
+		entries = append(entries, e)
+
+		if m != nil && !m.Match(name) {
+			e.SkipWorktree = true
+			continue
+		}
+
+		if old, ok := kept[name]; ok && old.Hash == e.Hash && old.Mode == e.Mode && entry.Mode != filemode.Submodule {
+			changed, err := entryChanged(dir, old)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				entries[len(entries)-1] = old
+				checkedOut++
+				continue
+			}
+		}
+
+		if err := checkoutEntry(repo, dir, name, entry, e); err != nil {
+			return fmt.Errorf("unable to check out %q: %s", name, err)
+		}
+		checkedOut++
+	}
+
+	log.WithFields(log.Fields{
+		"files":   checkedOut,
+		"skipped": len(entries) - checkedOut,
+	}).Debugln("checked out tree")
+
+	if err := writeIndex(filepath.Join(dir, git.GitDirName, "index"), entries); err != nil {
+		return err
+	}
+
+	return repo.Storer.SetReference(plumbing.NewHashReference(plumbing.HEAD, hash))
+}
+
+// disableSparseCheckout undoes the config sparseCheckout left, for a checkout
+// being updated that now has the whole tree.
+func disableSparseCheckout(repo *git.Repository, dir string) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+
+	core := cfg.Raw.Section("core")
+	if core.HasOption("sparseCheckout") {
+		core.RemoveOption("sparseCheckout")
+		if err := repo.SetConfig(cfg); err != nil {
+			return err
+		}
+	}
+
+	err = os.Remove(filepath.Join(dir, git.GitDirName, "info", "sparse-checkout"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// checkoutEntry writes a single tree entry into dir and fills in the stat info
+// of its index entry.
+func checkoutEntry(repo *git.Repository, dir, name string, entry object.TreeEntry, e *index.Entry) error {
+	path := filepath.Join(dir, filepath.FromSlash(name))
+
+	if entry.Mode == filemode.Submodule {
+		// same as go-git, submodules are left as an empty directory
+		return os.MkdirAll(path, 0755)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	blob, err := repo.BlobObject(entry.Hash)
+	if err != nil {
+		return err
+	}
+
+	r, err := blob.Reader()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = r.Close() }()
+
+	mode, err := entry.Mode.ToOSFileMode()
+	if err != nil {
+		return err
+	}
+
+	// whatever is there, like the same file in a checkout being updated, is
+	// replaced rather than written through, it can be a link
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if mode&os.ModeSymlink != 0 {
+		target, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(string(target), path); err != nil {
+			return err
+		}
+	} else {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	e.CreatedAt = info.ModTime()
+	e.ModifiedAt = info.ModTime()
+	e.Size = uint32(info.Size())
+	return nil
+}
+
+// writeIndex writes a git index file. go-git only encodes version 2 indexes,
+// which can't hold the skip-worktree flag, so skipped entries need version 3.
+func writeIndex(path string, entries []*index.Entry) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	version := uint32(2)
+	for _, e := range entries {
+		if e.SkipWorktree {
+			version = 3
+			break
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("DIRC")
+	_ = binary.Write(buf, binary.BigEndian, []uint32{version, uint32(len(entries))})
+
+	for _, e := range entries {
+		start := buf.Len()
+
+		_ = binary.Write(buf, binary.BigEndian, []uint32{
+			uint32(e.CreatedAt.Unix()), uint32(e.CreatedAt.Nanosecond()),
+			uint32(e.ModifiedAt.Unix()), uint32(e.ModifiedAt.Nanosecond()),
+			e.Dev, e.Inode, uint32(e.Mode), e.UID, e.GID, e.Size,
+		})
+		buf.Write(e.Hash[:])
+
+		flags := uint16(len(e.Name))
+		if len(e.Name) > indexNameMask {
+			flags = indexNameMask
+		}
+		if e.SkipWorktree {
+			flags |= indexFlagExtended
+		}
+		_ = binary.Write(buf, binary.BigEndian, flags)
+		if e.SkipWorktree {
+			_ = binary.Write(buf, binary.BigEndian, uint16(indexFlagSkipWorktree))
+		}
+
+		buf.WriteString(e.Name)
+
+		// entries are nul terminated and padded to a multiple of eight bytes
+		pad := 8 - (buf.Len()-start)%8
+		buf.Write(make([]byte, pad))
+	}
+
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
@@ -0,0 +1,82 @@
+package sfs_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+var _ = Describe("Sparse", func() {
+	Describe("SparsePatterns", func() {
+		It("should return nothing without patterns", func() {
+			options := sfs.Options{}
+			Expect(options.SparsePatterns()).To(BeEmpty())
+		})
+
+		It("should negate excludes after includes", func() {
+			options := sfs.Options{
+				Include: []string{"deploy/"},
+				Exclude: []string{"deploy/secrets/"},
+			}
+			Expect(options.SparsePatterns()).To(Equal([]string{"deploy/", "!deploy/secrets/"}))
+		})
+
+		It("should include everything else when only excluding", func() {
+			options := sfs.Options{
+				Exclude: []string{"docs/"},
+			}
+			Expect(options.SparsePatterns()).To(Equal([]string{"/*", "!docs/"}))
+		})
+
+		It("should read patterns from a sparse file", func() {
+			sparseFile := filepath.Join(makeTemp(), "sparse-checkout")
+			plsno(os.WriteFile(sparseFile, []byte("# deploy files\n/deploy/\n\n!/deploy/dev/\n"), 0644))
+
+			options := sfs.Options{
+				SparseFile: sparseFile,
+				Include:    []string{"*.md"},
+			}
+			Expect(options.SparsePatterns()).To(Equal([]string{"/deploy/", "!/deploy/dev/", "*.md"}))
+		})
+
+		It("should fail for a missing sparse file", func() {
+			options := sfs.Options{
+				SparseFile: filepath.Join(makeTemp(), "nope"),
+			}
+			_, err := options.SparsePatterns()
+			Expect(err).To(Not(BeNil()))
+		})
+	})
+
+	Describe("SparseMatcher", func() {
+		It("should match files below included directories", func() {
+			m := sfs.NewSparseMatcher([]string{"deploy/"})
+			Expect(m.Match("deploy/app.yml")).To(BeTrue())
+			Expect(m.Match("deploy/k8s/svc.yml")).To(BeTrue())
+			Expect(m.Match("src/main.go")).To(BeFalse())
+			Expect(m.Match("deploy")).To(BeFalse())
+		})
+
+		It("should anchor patterns with a leading slash", func() {
+			m := sfs.NewSparseMatcher([]string{"/deploy/"})
+			Expect(m.Match("deploy/app.yml")).To(BeTrue())
+			Expect(m.Match("src/deploy/app.yml")).To(BeFalse())
+		})
+
+		It("should let later negated patterns win", func() {
+			m := sfs.NewSparseMatcher([]string{"/*", "!docs/", "!*.png"})
+			Expect(m.Match("README.md")).To(BeTrue())
+			Expect(m.Match("src/main.go")).To(BeTrue())
+			Expect(m.Match("docs/index.md")).To(BeFalse())
+			Expect(m.Match("src/logo.png")).To(BeFalse())
+		})
+
+		It("should match everything when nil", func() {
+			var m *sfs.SparseMatcher
+			Expect(m.Match("anything")).To(BeTrue())
+		})
+	})
+})
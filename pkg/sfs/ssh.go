@@ -0,0 +1,323 @@
+package sfs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/net/proxy"
+)
+
+// dialSSH connects to an ssh server, through the proxy of ALL_PROXY if there
+// is one, giving up on both the connection and the handshake when the context
+// is done.
+func dialSSH(ctx context.Context, addr string, config *cryptossh.ClientConfig) (*cryptossh.Client, error) {
+	dialCtx := ctx
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+	conn, err := proxy.Dial(dialCtx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshake has no context of its own, closing the connection ends it
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	c, chans, reqs, err := cryptossh.NewClientConn(conn, addr, config)
+	if err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return cryptossh.NewClient(c, chans, reqs), nil
+}
+
+// sshAuthMethod is auth as an ssh auth method, or go-git's default one, from
+// the ssh-agent, when there is none.
+func sshAuthMethod(ep *transport.Endpoint, auth transport.AuthMethod) (gitssh.AuthMethod, error) {
+	if auth == nil {
+		return gitssh.DefaultAuthBuilder(ep.User)
+	}
+
+	sshAuth, ok := auth.(gitssh.AuthMethod)
+	if !ok {
+		return nil, transport.ErrInvalidAuthMethod
+	}
+	return sshAuth, nil
+}
+
+// sshAddr is the address of the ssh server of ep, with the host name and port
+// of the ssh config for its host if there are ones, like go-git connects to.
+func sshAddr(ep *transport.Endpoint) string {
+	host, port := ep.Host, ep.Port
+	if gitssh.DefaultSSHConfig != nil {
+		if h := gitssh.DefaultSSHConfig.Get(ep.Host, "Hostname"); h != "" {
+			host = h
+			if p, err := strconv.Atoi(gitssh.DefaultSSHConfig.Get(ep.Host, "Port")); err == nil {
+				port = p
+			}
+		}
+	}
+
+	if port <= 0 {
+		port = gitssh.DefaultPort
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func isSSH(url string) bool {
+	ep, err := transport.NewEndpoint(url)
+	return err == nil && ep.Protocol == "ssh"
+}
+
+// newClient is the transport the upload-pack sessions sfs opens itself go
+// through: sshTransport for ssh, go-git's for the rest. go-git's fetches keep
+// using its own.
+func newClient(ep *transport.Endpoint) (transport.Transport, error) {
+	if ep.Protocol == "ssh" {
+		return sshTransport{}, nil
+	}
+	return client.NewClient(ep)
+}
+
+// sshTransport is go-git's ssh transport for fetches, except that it connects
+// with the context of the fetch, which go-git's doesn't have until it's done
+// connecting. It gives up on an ssh server that hangs in the handshake, or at
+// any point after, once the context is done. Pushes are left to go-git.
+type sshTransport struct{}
+
+func (sshTransport) NewUploadPackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	sshAuth, err := sshAuthMethod(ep, auth)
+	if err != nil {
+		return nil, err
+	}
+	return &sshSession{endpoint: ep, auth: sshAuth, closed: make(chan struct{})}, nil
+}
+
+func (sshTransport) NewReceivePackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	return gitssh.DefaultClient.NewReceivePackSession(ep, auth)
+}
+
+// sshSession is an upload-pack session over ssh. It connects on the first
+// call that has a context, and the connection is closed as soon as that or
+// any later context is done.
+type sshSession struct {
+	endpoint *transport.Endpoint
+	auth     gitssh.AuthMethod
+
+	client  *cryptossh.Client
+	session *cryptossh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+	errLine chan string
+
+	advRefs *packp.AdvRefs
+	packRun bool
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// repoNotFoundMessages start the line servers write to stderr for a
+// repository that doesn't exist, or that we aren't allowed to see. They're
+// the ssh ones go-git's transport checks for, which it doesn't export.
+var repoNotFoundMessages = []string{
+	"ERROR: Repository not found.",
+	"conq: repository does not exist.",
+	"Gogs: Repository does not exist or you do not have access",
+}
+
+func (s *sshSession) connect(ctx context.Context) error {
+	if s.client != nil {
+		return nil
+	}
+
+	config, err := s.auth.ClientConfig()
+	if err != nil {
+		return err
+	}
+
+	s.client, err = dialSSH(ctx, sshAddr(s.endpoint), config)
+	if err != nil {
+		return err
+	}
+	s.watch(ctx)
+
+	if s.session, err = s.client.NewSession(); err != nil {
+		return err
+	}
+	if s.stdin, err = s.session.StdinPipe(); err != nil {
+		return err
+	}
+	if s.stdout, err = s.session.StdoutPipe(); err != nil {
+		return err
+	}
+	stderr, err := s.session.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	s.errLine = make(chan string, 1)
+	go func() {
+		sc := bufio.NewScanner(stderr)
+		if sc.Scan() {
+			s.errLine <- sc.Text()
+		}
+		close(s.errLine)
+		_, _ = io.Copy(io.Discard, stderr)
+	}()
+
+	return s.session.Start(fmt.Sprintf("%s '%s'", transport.UploadPackServiceName, s.endpoint.Path))
+}
+
+// watch closes the connection once ctx is done, unless the session is closed
+// first. Whatever is waiting on the server then fails right away.
+func (s *sshSession) watch(ctx context.Context) {
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.client.Close()
+		case <-s.closed:
+		}
+	}()
+}
+
+func (s *sshSession) AdvertisedReferences() (*packp.AdvRefs, error) {
+	return s.AdvertisedReferencesContext(context.Background())
+}
+
+func (s *sshSession) AdvertisedReferencesContext(ctx context.Context) (*packp.AdvRefs, error) {
+	if s.advRefs != nil {
+		return s.advRefs, nil
+	}
+	if err := s.connect(ctx); err != nil {
+		return nil, canceled(ctx, err)
+	}
+
+	ar := packp.NewAdvRefs()
+	switch err := ar.Decode(s.stdout); {
+	case err == packp.ErrEmptyInput:
+		// the server said why on stderr, if anything
+		return nil, canceled(ctx, s.serverError(ctx))
+	case err == packp.ErrEmptyAdvRefs:
+		return nil, transport.ErrEmptyRemoteRepository
+	case err != nil:
+		return nil, canceled(ctx, err)
+	case ar.IsEmpty():
+		// like jgit, which advertises capabilities without refs
+		return nil, transport.ErrEmptyRemoteRepository
+	}
+
+	transport.FilterUnsupportedCapabilities(ar.Capabilities)
+	s.advRefs = ar
+	return ar, nil
+}
+
+// serverError is the error for the line the server wrote to stderr before
+// hanging up, when it sent nothing else.
+func (s *sshSession) serverError(ctx context.Context) error {
+	var line string
+	select {
+	case line = <-s.errLine:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if line == "" {
+		return io.ErrUnexpectedEOF
+	}
+	for _, m := range repoNotFoundMessages {
+		if strings.HasPrefix(line, m) {
+			return transport.ErrRepositoryNotFound
+		}
+	}
+	if strings.HasSuffix(line, "does not appear to be a git repository") {
+		return transport.ErrRepositoryNotFound
+	}
+	return fmt.Errorf("remote: %s", line)
+}
+
+func (s *sshSession) UploadPack(ctx context.Context, req *packp.UploadPackRequest) (*packp.UploadPackResponse, error) {
+	if req.IsEmpty() && len(req.Shallows) == 0 {
+		return nil, transport.ErrEmptyUploadPackRequest
+	}
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.AdvertisedReferencesContext(ctx); err != nil {
+		return nil, err
+	}
+	s.watch(ctx)
+	s.packRun = true
+
+	if err := req.UploadRequest.Encode(s.stdin); err != nil {
+		return nil, canceled(ctx, fmt.Errorf("sending upload-req message: %s", err))
+	}
+	if err := req.UploadHaves.Encode(s.stdin, true); err != nil {
+		return nil, canceled(ctx, fmt.Errorf("sending haves message: %s", err))
+	}
+	if err := pktline.NewEncoder(s.stdin).EncodeString("done\n"); err != nil {
+		return nil, canceled(ctx, fmt.Errorf("sending done message: %s", err))
+	}
+	if err := s.stdin.Close(); err != nil {
+		return nil, canceled(ctx, err)
+	}
+
+	// closing the response ends the session
+	resp := packp.NewUploadPackResponse(req)
+	if err := resp.Decode(struct {
+		io.Reader
+		io.Closer
+	}{s.stdout, s}); err != nil {
+		return nil, canceled(ctx, fmt.Errorf("error decoding upload-pack response: %s", err))
+	}
+	return resp, nil
+}
+
+func (s *sshSession) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		if s.client == nil {
+			return
+		}
+
+		if s.stdin != nil && !s.packRun {
+			// tells the server we're done with it, for it to exit cleanly
+			_, _ = s.stdin.Write(pktline.FlushPkt)
+		}
+		if s.session != nil {
+			_ = s.session.Close()
+		}
+		if err = s.client.Close(); errors.Is(err, net.ErrClosed) {
+			err = nil
+		}
+	})
+	return err
+}
@@ -0,0 +1,75 @@
+package sfs_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+// silentServer accepts connections and never says anything, like an ssh
+// server that hangs before its handshake. It returns the url of a repository
+// on it and a func to stop it.
+func silentServer() (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	plsno(err)
+
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+
+	return "ssh://git@" + l.Addr().String() + "/org/repo.git", func() {
+		_ = l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+}
+
+var _ = Describe("SSH", func() {
+	It("should stop a fetch hanging in the handshake when the context is done", func() {
+		url, stop := silentServer()
+		defer stop()
+
+		keyPath, _ := writeUserKey()
+		dir := filepath.Join(makeTemp(), "checkout")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := sfs.New(sfs.WithSSHKey(keyPath, ""), sfs.WithProgress(nil)).FetchContext(ctx, url, publicRepo.Commit, dir)
+		Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+
+		staged, err := filepath.Glob(filepath.Join(filepath.Dir(dir), ".checkout.sfs-*"))
+		Expect(err).To(BeNil())
+		Expect(staged).To(BeEmpty())
+	})
+
+	It("should leave go-git's ssh transport installed", func() {
+		Expect(client.Protocols["ssh"]).To(Equal(gitssh.DefaultClient))
+	})
+})
@@ -0,0 +1,374 @@
+package sfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/go-git/go-git/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// stagings are the staging directories of the fetches in progress, and what
+// rollback needs to remove them.
+var stagings = struct {
+	sync.Mutex
+	m map[string]pendingStaging
+}{m: map[string]pendingStaging{}}
+
+type pendingStaging struct {
+	// the topmost parent directory made for the staging directory, if any
+	parents string
+	keep    bool
+}
+
+// newStaging creates the directory a fetch into dir is done in, next to it so
+// it can be renamed into place once the checkout is done. When the parent of
+// an existing dir can't be written to, like a mount point's, it's created in
+// dir instead, and its contents are moved into place. With populate, what dir
+// has is brought over first, see copyTree. Until it's committed, rollback
+// removes it along with the parent directories it had to create, unless keep
+// is set.
+func newStaging(dir string, populate, keep bool) (staging string, err error) {
+	parent := filepath.Dir(dir)
+	parents, err := makeParents(parent)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil && parents != "" {
+			removeEmptyParents(filepath.Dir(parents), dir)
+		}
+	}()
+
+	staging, err = os.MkdirTemp(parent, "."+filepath.Base(dir)+".sfs-")
+	if err != nil && parents == "" && unwritable(err) {
+		if _, serr := os.Stat(dir); serr == nil {
+			log.WithField("dir", parent).Debugln("unable to stage next to the directory, staging in it:", err)
+			staging, err = os.MkdirTemp(dir, ".sfs-staging-")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	mode := os.FileMode(0755)
+	if fi, err := os.Stat(dir); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := os.Chmod(staging, mode); err != nil {
+		removeStaging(staging)
+		return "", err
+	}
+
+	if populate {
+		log.WithField("staging", staging).Debugln("copying directory to staging")
+		if err := copyTree(dir, staging); err != nil {
+			removeStaging(staging)
+			return "", fmt.Errorf("unable to copy %q to staging: %s", dir, err)
+		}
+	}
+
+	stagings.Lock()
+	stagings.m[staging] = pendingStaging{parents: parents, keep: keep}
+	stagings.Unlock()
+	return staging, nil
+}
+
+// unwritable reports whether err is from writing to a directory we can't.
+func unwritable(err error) bool {
+	return os.IsPermission(err) || errors.Is(err, syscall.EROFS)
+}
+
+// nested reports whether staging was created in dir rather than next to it.
+func nested(staging, dir string) bool {
+	return filepath.Dir(staging) == dir
+}
+
+// makeParents creates dir and the directories above it that don't exist yet,
+// returning the topmost one it created, or "" if dir already existed.
+func makeParents(dir string) (string, error) {
+	created := ""
+	for p := dir; ; p = filepath.Dir(p) {
+		if _, err := os.Stat(p); err == nil || filepath.Dir(p) == p {
+			break
+		}
+		created = p
+	}
+
+	if created == "" {
+		return "", nil
+	}
+	return created, os.MkdirAll(dir, 0755)
+}
+
+// copyTree copies the contents of src into dst, which can be in it. Files are
+// hard linked, sfs only ever replaces them, except for the files in .git
+// directories other than objects, which go-git writes in place. Modification
+// times are kept, so the stat info in the index still matches.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dst {
+			return filepath.SkipDir
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			return os.Mkdir(target, fi.Mode().Perm())
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !fi.Mode().IsRegular():
+			log.WithField("path", path).Debugln("not copying special file to staging")
+			return nil
+		}
+
+		if !writtenInPlace(rel) && os.Link(path, target) == nil {
+			return nil
+		}
+		if err := copyFileMode(path, target, fi.Mode().Perm()); err != nil {
+			return err
+		}
+		return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+	})
+}
+
+// writtenInPlace reports whether the file at rel, a path in a checkout, is
+// in a .git directory but isn't an object or pack.
+func writtenInPlace(rel string) bool {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if parts[i] != git.GitDirName {
+			continue
+		}
+
+		inGit := parts[i+1:]
+		return len(inGit) < 3 || inGit[0] != "objects" || inGit[1] == "info"
+	}
+	return false
+}
+
+func copyFileMode(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// openStaged opens the copy of the repository being updated in staging,
+// pointing its remote at url.
+func openStaged(staging, url string) (*git.Repository, error) {
+	repo, err := git.PlainOpen(staging)
+	if err != nil {
+		return nil, err
+	}
+
+	// the url of this fetch, which can be the ssh or https one
+	if err := setRemoteURL(repo, url); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// commitStaging puts the staging directory in place of dir, which existed
+// before the fetch or not. An existing dir is swapped with it in a single
+// rename where the filesystem can, and is then removed.
+func commitStaging(staging, dir string, existed bool) error {
+	if !existed {
+		if err := os.Rename(staging, dir); err != nil {
+			return err
+		}
+		untrackStaging(staging)
+		return nil
+	}
+
+	var err error
+	if nested(staging, dir) {
+		err = swapContents(staging, dir)
+	} else if holdsWorkingDir(dir) {
+		// renaming it would leave whoever runs in it in a removed directory
+		log.WithField("dir", dir).Debugln("moving the working directory's contents instead of renaming it")
+		err = swapContents(staging, dir)
+	} else if err = exchangeDirs(staging, dir); err != nil {
+		log.WithField("dir", dir).Debugln("unable to swap with staging in a single rename:", err)
+		if err = swapDirs(staging, dir); err != nil {
+			// like a mount point
+			log.WithField("dir", dir).Debugln("unable to rename directory:", err)
+			err = swapContents(staging, dir)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// staging is now what dir was
+	untrackStaging(staging)
+	removeStaging(staging)
+	return nil
+}
+
+// swapDirs puts staging in place of dir with two renames, so dir is missing
+// for a moment.
+func swapDirs(staging, dir string) error {
+	old := staging + ".old"
+	if err := os.Rename(dir, old); err != nil {
+		return err
+	}
+
+	if err := os.Rename(staging, dir); err != nil {
+		if rerr := os.Rename(old, dir); rerr != nil {
+			log.WithField("dir", old).Errorln("unable to move the previous directory back:", rerr)
+		}
+		return err
+	}
+	return os.Rename(old, staging)
+}
+
+// swapContents swaps what dir has with what staging has, one entry at a time,
+// for a dir that can't be renamed. staging can be in dir.
+func swapContents(staging, dir string) error {
+	old := staging + ".old"
+	if err := os.Mkdir(old, 0700); err != nil {
+		return err
+	}
+
+	if err := moveEntries(dir, old, staging, old); err != nil {
+		_ = moveEntries(old, dir)
+		return err
+	}
+	if err := moveEntries(staging, dir); err != nil {
+		_ = moveEntries(dir, staging, staging, old)
+		_ = moveEntries(old, dir)
+		return err
+	}
+
+	if err := os.Remove(staging); err != nil {
+		return err
+	}
+	return os.Rename(old, staging)
+}
+
+// moveEntries renames everything in src into dst, but the paths in skip.
+func moveEntries(src, dst string, skip ...string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+
+	skipped := make(map[string]bool, len(skip))
+	for _, path := range skip {
+		skipped[path] = true
+	}
+
+	for _, name := range names {
+		path := filepath.Join(src, name)
+		if skipped[path] {
+			continue
+		}
+		if err := os.Rename(path, filepath.Join(dst, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// holdsWorkingDir reports whether the working directory is dir or in it.
+func holdsWorkingDir(dir string) bool {
+	wd, err := os.Getwd()
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(resolvePath(dir), resolvePath(wd))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// rollback removes what a failed fetch created: the staging directory, and
+// the parent directories made for it if they're left empty. When the fetch was
+// asked to keep them, they're left for debugging.
+func rollback(staging string) {
+	p, ok := untrackStaging(staging)
+	if !ok {
+		// committed, or already rolled back by RollbackStaging
+		return
+	}
+	if p.keep {
+		log.WithField("dir", staging).Warn("keeping the staging directory of the failed fetch")
+		return
+	}
+
+	removeStaging(staging)
+	if p.parents != "" {
+		removeEmptyParents(filepath.Dir(p.parents), staging)
+	}
+}
+
+// untrackStaging forgets about a staging directory, returning what was kept
+// about it, if anything.
+func untrackStaging(staging string) (pendingStaging, bool) {
+	stagings.Lock()
+	defer stagings.Unlock()
+
+	p, ok := stagings.m[staging]
+	delete(stagings.m, staging)
+	return p, ok
+}
+
+// RollbackStaging rolls back every fetch in progress, removing what they
+// wrote so far the way a failed fetch does. It's for a process that has to
+// exit without waiting for its fetches to stop, which would leave their
+// staging directories behind otherwise.
+func RollbackStaging() {
+	stagings.Lock()
+	pending := make([]string, 0, len(stagings.m))
+	for staging := range stagings.m {
+		pending = append(pending, staging)
+	}
+	stagings.Unlock()
+
+	for _, staging := range pending {
+		rollback(staging)
+	}
+}
+
+// removeStaging removes a staging directory that is done with.
+func removeStaging(staging string) {
+	log.WithField("dir", staging).Debugln("removing staging directory")
+	if err := os.RemoveAll(staging); err != nil {
+		log.WithField("dir", staging).Warnln("unable to remove staging directory:", err)
+	}
+}
@@ -0,0 +1,8 @@
+package sfs
+
+import "golang.org/x/sys/unix"
+
+// exchangeDirs swaps two directories in a single rename.
+func exchangeDirs(a, b string) error {
+	return unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE)
+}
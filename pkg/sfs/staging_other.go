@@ -0,0 +1,11 @@
+//go:build !linux
+
+package sfs
+
+import "errors"
+
+// exchangeDirs swaps two directories in a single rename, which only linux can
+// do.
+func exchangeDirs(a, b string) error {
+	return errors.New("not supported on this platform")
+}
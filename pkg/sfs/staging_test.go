@@ -0,0 +1,136 @@
+package sfs_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-git/v5"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+var _ = Describe("Staging", func() {
+	It("should leave a checkout as it was when the fetch fails", func() {
+		dir := makeTemp()
+		makeCheckout(dir, "http://127.0.0.1:1/repo.git")
+		repo, err := git.PlainOpen(dir)
+		Expect(err).To(BeNil())
+		head, err := repo.Head()
+		Expect(err).To(BeNil())
+
+		_, err = sfs.New(sfs.WithProgress(nil)).Fetch("http://127.0.0.1:1/repo.git", publicRepo.Commit, dir)
+		Expect(errors.Is(err, sfs.ErrNetwork)).To(BeTrue())
+
+		contents, err := os.ReadFile(filepath.Join(dir, "file.txt"))
+		Expect(err).To(BeNil())
+		Expect(string(contents)).To(Equal("hello\n"))
+
+		repo, err = git.PlainOpen(dir)
+		Expect(err).To(BeNil())
+		after, err := repo.Head()
+		Expect(err).To(BeNil())
+		Expect(after.Hash()).To(Equal(head.Hash()))
+
+		staged, err := filepath.Glob(filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+".sfs-*"))
+		Expect(err).To(BeNil())
+		Expect(staged).To(BeEmpty())
+	})
+
+	It("should roll back the fetches in progress", func() {
+		url, stop := silentServer()
+		defer stop()
+
+		keyPath, _ := writeUserKey()
+		parent := makeTemp()
+		dir := filepath.Join(parent, "checkout")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			_, err := sfs.New(sfs.WithSSHKey(keyPath, ""), sfs.WithProgress(nil)).FetchContext(ctx, url, publicRepo.Commit, dir)
+			done <- err
+		}()
+
+		staging := filepath.Join(parent, ".checkout.sfs-*")
+		Eventually(func() ([]string, error) { return filepath.Glob(staging) }).Should(HaveLen(1))
+
+		sfs.RollbackStaging()
+		Expect(filepath.Glob(staging)).To(BeEmpty())
+
+		cancel()
+		Eventually(done).Should(Receive(HaveOccurred()))
+		entries, err := os.ReadDir(parent)
+		Expect(err).To(BeNil())
+		Expect(entries).To(BeEmpty())
+	})
+
+	It("should not create the directory when the fetch fails", func() {
+		parent := makeTemp()
+		dir := filepath.Join(parent, "checkout")
+
+		_, err := sfs.New(sfs.WithProgress(nil)).Fetch("http://127.0.0.1:1/repo.git", publicRepo.Commit, dir)
+		Expect(errors.Is(err, sfs.ErrNetwork)).To(BeTrue())
+
+		entries, err := os.ReadDir(parent)
+		Expect(err).To(BeNil())
+		Expect(entries).To(BeEmpty())
+	})
+
+	It("should remove the parent directories it created when the fetch fails", func() {
+		parent := makeTemp()
+		dir := filepath.Join(parent, "a", "b", "checkout")
+
+		_, err := sfs.New(sfs.WithProgress(nil)).Fetch("http://127.0.0.1:1/repo.git", publicRepo.Commit, dir)
+		Expect(errors.Is(err, sfs.ErrNetwork)).To(BeTrue())
+
+		entries, err := os.ReadDir(parent)
+		Expect(err).To(BeNil())
+		Expect(entries).To(BeEmpty())
+	})
+
+	It("should stage in the directory when its parent can't be written to", func() {
+		if os.Geteuid() == 0 {
+			Skip("root can write to any directory")
+		}
+		url, shas, stop := gitServer(3)
+		defer stop()
+
+		parent := makeTemp()
+		dir := filepath.Join(parent, "checkout")
+		fetcher := sfs.New(sfs.WithProgress(nil), sfs.WithFallbackDepth(4))
+		_, err := fetcher.Fetch(url, shas[1], dir)
+		Expect(err).To(BeNil())
+
+		plsno(os.Chmod(parent, 0555))
+		defer func() { plsno(os.Chmod(parent, 0755)) }()
+
+		_, err = fetcher.Fetch(url, shas[0], dir)
+		Expect(err).To(BeNil())
+		Expect(checkFiles(dir, []string{"1.txt", "2.txt", "3.txt"})).To(BeTrue())
+
+		staged, err := filepath.Glob(filepath.Join(dir, ".sfs-staging-*"))
+		Expect(err).To(BeNil())
+		Expect(staged).To(BeEmpty())
+	})
+
+	It("should keep the staging directory of a failed fetch when asked to", func() {
+		parent := makeTemp()
+		dir := filepath.Join(parent, "checkout")
+
+		_, err := sfs.New(sfs.WithProgress(nil), sfs.WithKeepOnFailure()).Fetch("http://127.0.0.1:1/repo.git", publicRepo.Commit, dir)
+		Expect(errors.Is(err, sfs.ErrNetwork)).To(BeTrue())
+
+		_, err = os.Stat(dir)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		staged, err := filepath.Glob(filepath.Join(parent, ".checkout.sfs-*"))
+		Expect(err).To(BeNil())
+		Expect(staged).To(HaveLen(1))
+
+		_, err = os.Stat(filepath.Join(staged[0], ".git"))
+		Expect(err).To(BeNil())
+	})
+})
@@ -0,0 +1,308 @@
+package sfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	alternatesFile  = "alternates"
+	storeLockSuffix = ".lock"
+	// a lock that hasn't been refreshed for this long was left behind by a
+	// process that died, and is taken over
+	storeLockStale = 5 * time.Minute
+	storeLockPoll  = 100 * time.Millisecond
+)
+
+// storeDir is the bare repository in the object store root that the objects
+// of url are fetched into. Every url of a repository shares it.
+func storeDir(root, url string) string {
+	return filepath.Join(root, repoKey(url)+".git")
+}
+
+// lockStore takes the lock of the object store repository in dir, waiting
+// while another fetch, possibly in another process, holds it. The lock is
+// refreshed until unlock is called.
+func lockStore(ctx context.Context, dir string) (unlock func(), err error) {
+	path := dir + storeLockSuffix
+	waiting := false
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, _ = fmt.Fprintln(f, os.Getpid())
+			_ = f.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > storeLockStale {
+			log.WithField("lock", path).Warn("taking over stale object store lock")
+			_ = os.Remove(path)
+			continue
+		}
+
+		if !waiting {
+			log.WithField("lock", path).Info("waiting for another fetch into the object store")
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(storeLockPoll):
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(storeLockStale / 4)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-t.C:
+				_ = os.Chtimes(path, now, now)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		_ = os.Remove(path)
+	}, nil
+}
+
+// openStore opens the object store repository in dir, initializing it on
+// first use, and points its remote at url.
+func openStore(dir, url string) (*git.Repository, error) {
+	repo, err := git.PlainOpen(dir)
+	if err == git.ErrRepositoryNotExists {
+		log.WithField("dir", dir).Debugln("initializing object store repository")
+		return initRepository(dir, url, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the url of the last fetch, which can be the ssh or https one
+	if err := setRemoteURL(repo, url); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// fetchToStore fetches opts.SHA into the object store repository of
+// opts.Repo, only transferring the objects it doesn't already have, and
+// returns the repository, its directory and the strategy that worked. Nothing
+// is fetched when the commit and its history to opts.depth() are already in
+// the store.
+func fetchToStore(ctx context.Context, opts *Options, auth transport.AuthMethod, res *Result) (repo *git.Repository, dir, strategy string, err error) {
+	dir = storeDir(opts.ObjectStore, opts.Repo)
+	if err := os.MkdirAll(opts.ObjectStore, 0755); err != nil {
+		return nil, "", "", opError(OpInit, opts.Repo, err)
+	}
+
+	unlock, err := lockStore(ctx, dir)
+	if err != nil {
+		return nil, "", "", opError(OpInit, opts.Repo, err)
+	}
+	defer unlock()
+
+	repo, err = openStore(dir, opts.Repo)
+	if err != nil {
+		return nil, "", "", opError(OpInit, opts.Repo, err)
+	}
+
+	if storeHas(repo, plumbing.NewHash(opts.SHA), opts.depth()) {
+		return repo, dir, strategyStore, nil
+	}
+
+	before, statsErr := packNames(dir)
+	// a failed fetch leaves nothing the next one can't use, so unlike
+	// fetchRepository the store isn't reset between retries
+	err = retry(ctx, opts.Retry, OpFetch, func() (err error) {
+		strategy, err = fetchStoreCommit(ctx, repo, opts, auth)
+		if err != nil {
+			return opError(OpFetch, opts.Repo, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if statsErr == nil {
+		statsErr = res.setPackTransfer(dir, before)
+	}
+	if statsErr != nil {
+		log.Debugln("unable to count fetched objects:", statsErr)
+	}
+	return repo, dir, strategy, nil
+}
+
+// storeHas reports whether the object store has every object of hash and its
+// history down to depth. A fetch that failed part way can leave the commit
+// without all of its blobs.
+func storeHas(repo *git.Repository, hash plumbing.Hash, depth int) bool {
+	if !hasObject(repo, hash) {
+		return false
+	}
+
+	commits, _, complete, err := walkHistory(repo, hash, depth)
+	if err != nil || !complete {
+		return false
+	}
+
+	for _, h := range commits {
+		commit, err := repo.CommitObject(h)
+		if err != nil {
+			return false
+		}
+		trees, blobs, err := missingObjects(repo, commit.TreeHash, "", nil)
+		if err != nil || len(trees) > 0 || len(blobs) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchStoreCommit fetches opts.SHA into the object store. Servers leave out
+// what a shallow client has only with thin packs, which go-git can't take, so
+// over http the commits and trees are fetched first with a filter and then
+// only the blobs the store doesn't have yet. Without filter support, or over
+// ssh, everything is fetched.
+func fetchStoreCommit(ctx context.Context, repo *git.Repository, opts *Options, auth transport.AuthMethod) (string, error) {
+	if !isHTTP(opts.Repo) {
+		return fetchCommit(ctx, repo, opts, auth, opts.progress())
+	}
+
+	filtered := *opts
+	filtered.Filter = treesOnlyFilter
+	strategy, err := fetchCommit(ctx, repo, &filtered, auth, opts.progress())
+	if err != nil || strategy != strategyFilter {
+		return strategy, err
+	}
+
+	commits, _, _, err := walkHistory(repo, plumbing.NewHash(opts.SHA), opts.depth())
+	if err != nil {
+		return "", err
+	}
+
+	log.WithField("commits", len(commits)).Debugln("fetching blobs missing from the object store")
+	if err := fetchMissingObjects(ctx, repo, commits, opts, auth, nil, opts.progress()); err != nil {
+		return "", err
+	}
+
+	// every object is there, it's no partial clone
+	return strategyWant, nil
+}
+
+// linkStore makes local, the repository of a checkout in dir, borrow its
+// objects from the object store repository in storeDir through
+// objects/info/alternates, like git clone --reference, with the history of
+// hash down to depth.
+func linkStore(store *git.Repository, storeDir string, local *git.Repository, dir string, hash plumbing.Hash, depth int) (*git.Repository, error) {
+	infoDir := filepath.Join(dir, git.GitDirName, "objects", "info")
+	if err := os.MkdirAll(infoDir, 0755); err != nil {
+		return nil, err
+	}
+	// git reads a relative alternate from the objects directory
+	absStore, err := filepath.Abs(storeDir)
+	if err != nil {
+		return nil, err
+	}
+	alternate := filepath.Join(absStore, "objects") + "\n"
+	if err := os.WriteFile(filepath.Join(infoDir, alternatesFile), []byte(alternate), 0644); err != nil {
+		return nil, err
+	}
+
+	// the store can have more history than this checkout asked for
+	_, shallow, _, err := walkHistory(store, hash, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	st := local.Storer.(*filesystem.Storage)
+	if err := st.SetShallow(shallow); err != nil {
+		return nil, err
+	}
+
+	if err := resetRefs(local, hash); err != nil {
+		return nil, err
+	}
+
+	linked := &linkedStorage{
+		Storage: st,
+		store:   &store.Storer.(*filesystem.Storage).ObjectStorage,
+	}
+	return git.Open(linked, osfs.New(dir))
+}
+
+// linkedStorage is the storage of a checkout linked to an object store, which
+// reads objects from the store first. go-git follows objects/info/alternates
+// on its own, but reopens the alternate for every object the checkout doesn't
+// have, which is far too slow to check out a tree.
+type linkedStorage struct {
+	*filesystem.Storage
+	store *filesystem.ObjectStorage
+}
+
+func (s *linkedStorage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	obj, err := s.store.EncodedObject(t, h)
+	if err == plumbing.ErrObjectNotFound {
+		return s.Storage.EncodedObject(t, h)
+	}
+	return obj, err
+}
+
+func (s *linkedStorage) HasEncodedObject(h plumbing.Hash) error {
+	if err := s.store.HasEncodedObject(h); err == nil {
+		return nil
+	}
+	return s.Storage.HasEncodedObject(h)
+}
+
+func (s *linkedStorage) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+	size, err := s.store.EncodedObjectSize(h)
+	if err == plumbing.ErrObjectNotFound {
+		return s.Storage.EncodedObjectSize(h)
+	}
+	return size, err
+}
+
+// fromStore fetches opts.SHA into the object store and initializes a
+// repository in dir linked to it.
+func fromStore(ctx context.Context, opts *Options, auth transport.AuthMethod, dir string, res *Result) (string, *git.Repository, error) {
+	store, storeDir, strategy, err := fetchToStore(ctx, opts, auth, res)
+	if err != nil {
+		return "", nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"store":    storeDir,
+		"strategy": strategy,
+	}).Debugln("fetched into object store")
+
+	local, err := initRepository(dir, opts.Repo, false)
+	if err != nil {
+		return "", nil, opError(OpInit, opts.Repo, err)
+	}
+
+	repo, err := linkStore(store, storeDir, local, dir, plumbing.NewHash(opts.SHA), opts.depth())
+	if err != nil {
+		return "", nil, opError(OpInit, opts.Repo, err)
+	}
+	return strategy, repo, nil
+}
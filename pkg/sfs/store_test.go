@@ -0,0 +1,45 @@
+package sfs_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+var _ = Describe("Object store", func() {
+	It("should share objects between fetches of the same repo", func() {
+		storeDir := makeTemp()
+		fetcher := sfs.New(sfs.WithProgress(nil), sfs.WithObjectStore(storeDir))
+
+		res, err := fetcher.FetchResult(context.Background(), publicRepo.HTTPS, publicRepo.Commit, makeTemp())
+		Expect(err).To(BeNil())
+		Expect(res.Bytes).ToNot(BeZero())
+
+		// the same repo, by another url
+		tmpDir := makeTemp()
+		res, err = fetcher.FetchResult(context.Background(), "https://github.com/robherley/fixture-public-repo", publicRepo.Commit, tmpDir)
+		Expect(err).To(BeNil())
+		Expect(res.Bytes).To(BeZero())
+		Expect(checkFiles(tmpDir, publicRepo.ExpectedFiles)).To(BeTrue())
+
+		alternates, err := os.ReadFile(filepath.Join(tmpDir, ".git", "objects", "info", "alternates"))
+		Expect(err).To(BeNil())
+		Expect(string(alternates)).To(HavePrefix(storeDir))
+
+		stores, err := os.ReadDir(storeDir)
+		Expect(err).To(BeNil())
+		Expect(stores).To(HaveLen(1))
+	})
+
+	It("should reject an object store with a cache", func() {
+		fetcher := sfs.New(sfs.WithObjectStore(makeTemp()), sfs.WithCache(makeTemp(), 0))
+		_, err := fetcher.Fetch(publicRepo.HTTPS, publicRepo.Commit, makeTemp())
+		Expect(errors.Is(err, sfs.ErrValidation)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("object store")))
+	})
+})
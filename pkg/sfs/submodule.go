@@ -0,0 +1,216 @@
+package sfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	gitcfg "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	log "github.com/sirupsen/logrus"
+)
+
+const gitmodulesFile = ".gitmodules"
+
+// SubmoduleURL resolves the url of a submodule from .gitmodules against the
+// url of its superproject. Like git, urls starting with "./" or "../" are
+// relative to the superproject's url, anything else is used as is.
+func SubmoduleURL(base, url string) (string, error) {
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		return url, nil
+	}
+
+	rel := url
+	base = strings.TrimSuffix(base, "/")
+	for {
+		if strings.HasPrefix(url, "./") {
+			url = url[len("./"):]
+			continue
+		}
+
+		if !strings.HasPrefix(url, "../") {
+			break
+		}
+		url = url[len("../"):]
+
+		// scp-like ssh urls (git@host:org/repo.git) separate the path with a colon
+		i := strings.LastIndexAny(base, "/:")
+		if i < 0 || strings.HasSuffix(base[:i+1], "://") {
+			return "", fmt.Errorf("relative submodule url %q goes above %q", rel, base)
+		}
+
+		sep := base[i]
+		base = base[:i]
+		if sep == ':' {
+			if strings.HasPrefix(url, "../") {
+				return "", fmt.Errorf("relative submodule url %q goes above %q", rel, base)
+			}
+			// keep the colon so the path is appended after the host
+			return base + ":" + url, nil
+		}
+	}
+
+	return base + "/" + url, nil
+}
+
+// gitlinks returns the sha of every submodule in the tree of a commit, keyed
+// by its path.
+func gitlinks(commit *object.Commit) (map[string]plumbing.Hash, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	links := make(map[string]plumbing.Hash)
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			return links, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if entry.Mode == filemode.Submodule {
+			links[name] = entry.Hash
+		}
+	}
+}
+
+// readModules parses .gitmodules from the tree of a commit, rather than from
+// the worktree, which may not have it with a sparse checkout.
+func readModules(commit *object.Commit) (*gitcfg.Modules, error) {
+	modules := gitcfg.NewModules()
+
+	f, err := commit.File(gitmodulesFile)
+	if err == object.ErrFileNotFound {
+		return modules, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := f.Contents()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := modules.Unmarshal([]byte(contents)); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", gitmodulesFile, err)
+	}
+	return modules, nil
+}
+
+// submoduleOptions are the options to fetch a submodule with, the same as the
+// superproject's except for what's specific to the submodule. Auth only
+// carries over to submodules using the same kind of url.
+func submoduleOptions(opts *Options, url, sha, dir string) *Options {
+	sub := *opts
+	sub.Repo = url
+	sub.SHA = sha
+	sub.Ref = ""
+	sub.Directory = dir
+	// sparse patterns are relative to the superproject
+	sub.Include = nil
+	sub.Exclude = nil
+	sub.SparseFile = ""
+
+	if isHTTP(url) {
+		sub.SSHAuth = nil
+	} else {
+		sub.BasicAuth = nil
+		sub.Filter = ""
+	}
+
+	return &sub
+}
+
+// fetchSubmodules shallow fetches every submodule of opts.SHA that is checked
+// out at exactly the sha of its gitlink, recursing into their submodules.
+func fetchSubmodules(ctx context.Context, repo *git.Repository, dir string, opts *Options, sparse *SparseMatcher) error {
+	commit, err := repo.CommitObject(plumbing.NewHash(opts.SHA))
+	if err != nil {
+		return err
+	}
+
+	links, err := gitlinks(commit)
+	if err != nil {
+		return err
+	}
+
+	if len(links) == 0 {
+		return nil
+	}
+
+	modules, err := readModules(commit)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+
+	// map order is random, fetch in a stable order
+	names := make([]string, 0, len(modules.Submodules))
+	for name := range modules.Submodules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		module := modules.Submodules[name]
+		sha, ok := links[module.Path]
+		if !ok {
+			log.WithField("path", module.Path).Warnln("submodule has no gitlink in tree, skipping")
+			continue
+		}
+		delete(links, module.Path)
+
+		if !sparse.Match(module.Path) {
+			continue
+		}
+
+		url, err := SubmoduleURL(opts.Repo, module.URL)
+		if err != nil {
+			return fmt.Errorf("submodule %q: %s", module.Name, err)
+		}
+
+		log.WithFields(log.Fields{
+			"path": module.Path,
+			"url":  url,
+			"sha":  sha.String(),
+		}).Info("fetching submodule")
+
+		sub := submoduleOptions(opts, url, sha.String(), filepath.Join(dir, filepath.FromSlash(module.Path)))
+		if err := sub.Validate(); err != nil {
+			return fmt.Errorf("submodule %q: %w", module.Name, err)
+		}
+
+		if err := ShallowFetchSHAContext(ctx, sub); err != nil {
+			return fmt.Errorf("submodule %q: %w", module.Name, err)
+		}
+
+		// same as "git submodule init", a url in the config makes it active
+		cfg.Submodules[module.Name] = &gitcfg.Submodule{
+			Name: module.Name,
+			Path: module.Path,
+			URL:  url,
+		}
+	}
+
+	for path := range links {
+		log.WithField("path", path).Warnf("gitlink has no url in %s, skipping", gitmodulesFile)
+	}
+
+	return repo.SetConfig(cfg)
+}
@@ -0,0 +1,33 @@
+package sfs_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+var _ = Describe("SubmoduleURL", func() {
+	It("should keep absolute urls", func() {
+		Expect(sfs.SubmoduleURL(publicRepo.HTTPS, privateRepo.SSH)).To(Equal(privateRepo.SSH))
+		Expect(sfs.SubmoduleURL(publicRepo.SSH, privateRepo.HTTPS)).To(Equal(privateRepo.HTTPS))
+	})
+
+	It("should resolve relative urls against https repos", func() {
+		Expect(sfs.SubmoduleURL(publicRepo.HTTPS, "../fixture-private-repo.git")).To(Equal(privateRepo.HTTPS))
+		Expect(sfs.SubmoduleURL("https://github.com/robherley/app/", "./lib.git")).To(Equal("https://github.com/robherley/app/lib.git"))
+		Expect(sfs.SubmoduleURL("https://github.com/robherley/app.git", "../../other/lib.git")).To(Equal("https://github.com/other/lib.git"))
+	})
+
+	It("should resolve relative urls against scp-like ssh repos", func() {
+		Expect(sfs.SubmoduleURL(publicRepo.SSH, "../fixture-private-repo.git")).To(Equal(privateRepo.SSH))
+		Expect(sfs.SubmoduleURL("git@github.com:app.git", "../lib.git")).To(Equal("git@github.com:lib.git"))
+	})
+
+	It("should fail for relative urls above the host", func() {
+		_, err := sfs.SubmoduleURL("https://github.com/app.git", "../../lib.git")
+		Expect(err).To(Not(BeNil()))
+
+		_, err = sfs.SubmoduleURL("git@github.com:app.git", "../../lib.git")
+		Expect(err).To(Not(BeNil()))
+	})
+})
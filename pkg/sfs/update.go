@@ -0,0 +1,299 @@
+package sfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	log "github.com/sirupsen/logrus"
+)
+
+// the commit was already checked out with enough history, nothing was fetched
+const strategyUpToDate = "up-to-date"
+
+// openExisting opens the repository a previous fetch left in dir, nil if
+// there is none. A repository of another remote isn't ours to update.
+func openExisting(dir, url string) (*git.Repository, error) {
+	if _, err := os.Stat(filepath.Join(dir, git.GitDirName)); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	repo, err := git.PlainOpen(dir)
+	if err == git.ErrRepositoryNotExists {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := repo.Remote(remoteName)
+	if err != nil || len(remote.Config().URLs) == 0 {
+		return nil, fmt.Errorf("%q already has a repository without an %q remote: %w", dir, remoteName, git.ErrRepositoryAlreadyExists)
+	}
+	if have := remote.Config().URLs[0]; NormalizeURL(have) != NormalizeURL(url) {
+		return nil, fmt.Errorf("%q already has a repository of %s: %w", dir, have, git.ErrRepositoryAlreadyExists)
+	}
+	return repo, nil
+}
+
+// setRemoteURL points the remote of repo at url, which can be another url of
+// the same repository than it was created with, like the ssh one.
+func setRemoteURL(repo *git.Repository, url string) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+
+	remote, ok := cfg.Remotes[remoteName]
+	if !ok {
+		return fmt.Errorf("no %q remote", remoteName)
+	}
+	if len(remote.URLs) == 1 && remote.URLs[0] == url {
+		return nil
+	}
+
+	remote.URLs = []string{url}
+	return repo.SetConfig(cfg)
+}
+
+// checkUnmodified returns the index of the checkout in dir, or an error if
+// any file it checked out was changed or removed since, which an update would
+// overwrite.
+func checkUnmodified(repo *git.Repository, dir string) (*index.Index, error) {
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+
+	var modified []string
+	for _, e := range idx.Entries {
+		if e.SkipWorktree || e.Mode == filemode.Submodule {
+			continue
+		}
+
+		changed, err := entryChanged(dir, e)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			modified = append(modified, e.Name)
+		}
+	}
+
+	if len(modified) > 0 {
+		return nil, fmt.Errorf("%q has local changes to %d files, like %q: %w", dir, len(modified), modified[0], ErrDirectoryNotEmpty)
+	}
+	return idx, nil
+}
+
+// entryChanged reports whether the file of an index entry differs from what
+// was checked out. Files with the stat info of the index are assumed
+// unchanged, like git does, the others are hashed.
+func entryChanged(dir string, e *index.Entry) (bool, error) {
+	path := filepath.Join(dir, filepath.FromSlash(e.Name))
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if uint32(fi.Size()) == e.Size && fi.ModTime().Equal(e.ModifiedAt) {
+		return false, nil
+	}
+
+	var r io.Reader
+	size := fi.Size()
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return false, err
+		}
+		r = strings.NewReader(target)
+		size = int64(len(target))
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return false, err
+		}
+		defer func() { _ = f.Close() }()
+		r = f
+	}
+
+	hasher := plumbing.NewHasher(plumbing.BlobObject, size)
+	if _, err := io.Copy(hasher, r); err != nil {
+		return false, err
+	}
+	return hasher.Sum() != e.Hash, nil
+}
+
+// updateRepository fetches opts.SHA into the repository of a previous fetch
+// in dir, only transferring what it doesn't have yet. Nothing is fetched when
+// the commit is already checked out with enough history.
+func updateRepository(ctx context.Context, opts *Options, auth transport.AuthMethod, repo *git.Repository, dir string, sparse *SparseMatcher, res *Result) (string, *git.Repository, error) {
+	hash := plumbing.NewHash(opts.SHA)
+	if head, err := repo.Head(); err == nil && head.Hash() == hash {
+		_, _, complete, err := walkHistory(repo, hash, opts.depth())
+		if err == nil && complete {
+			return strategyUpToDate, repo, nil
+		}
+	}
+
+	if opts.ObjectStore != "" {
+		store, storeDir, strategy, err := fetchToStore(ctx, opts, auth, res)
+		if err != nil {
+			return "", nil, err
+		}
+
+		linked, err := linkStore(store, storeDir, repo, dir, hash, opts.depth())
+		if err != nil {
+			return "", nil, opError(OpInit, opts.Repo, err)
+		}
+		return strategy, linked, nil
+	}
+
+	gitDir := filepath.Join(dir, git.GitDirName)
+	before, statsErr := packNames(gitDir)
+
+	var strategy string
+	// unlike fetchRepository a retry doesn't start over, that would throw away
+	// the previous checkout
+	err := retry(ctx, opts.Retry, OpFetch, func() (err error) {
+		strategy, err = fetchCommit(ctx, repo, opts, auth, opts.progress())
+		if err != nil {
+			return opError(OpFetch, opts.Repo, err)
+		}
+
+		if strategy == strategyFilter {
+			if err := fetchMissingObjects(ctx, repo, []plumbing.Hash{hash}, opts, auth, sparse, opts.progress()); err != nil {
+				return opError(OpFetch, opts.Repo, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	if statsErr == nil {
+		statsErr = res.setPackTransfer(gitDir, before)
+	}
+	if statsErr != nil {
+		log.Debugln("unable to count fetched objects:", statsErr)
+	}
+	return strategy, repo, nil
+}
+
+// removeStale removes the files the previous checkout, with the index before,
+// wrote that the checkout of hash, with the sparse patterns if any, won't, and
+// the directories that leaves empty. It runs before checking out, where a
+// file can become a directory.
+func removeStale(repo *git.Repository, dir string, hash plumbing.Hash, sparse *SparseMatcher, before *index.Index) error {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]bool)
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if entry.Mode != filemode.Dir && (sparse == nil || sparse.Match(name)) {
+			current[name] = true
+		}
+	}
+
+	for _, e := range before.Entries {
+		if e.SkipWorktree || current[e.Name] {
+			continue
+		}
+
+		path := filepath.Join(dir, filepath.FromSlash(e.Name))
+		if e.Mode == filemode.Submodule {
+			err = os.RemoveAll(path)
+		} else {
+			err = os.Remove(path)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removeEmptyParents(dir, path)
+	}
+	return nil
+}
+
+// removeEmptyParents removes the directories from the one holding path up to
+// dir, for as long as they're empty.
+func removeEmptyParents(dir, path string) {
+	for p := filepath.Dir(path); p != dir && len(p) > len(dir); p = filepath.Dir(p) {
+		// some of them can be gone already
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+}
+
+// strayFiles returns the files in dir that aren't in the index of its
+// checkout, sorted.
+func strayFiles(repo *git.Repository, dir string) ([]string, error) {
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := make(map[string]bool, len(idx.Entries))
+	for _, e := range idx.Entries {
+		tracked[e.Name] = true
+	}
+
+	var stray []string
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+
+		if fi.IsDir() {
+			if name == git.GitDirName || tracked[name] {
+				// the repository, or a submodule
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !tracked[name] {
+			stray = append(stray, name)
+		}
+		return nil
+	})
+
+	sort.Strings(stray)
+	return stray, err
+}
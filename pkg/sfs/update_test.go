@@ -0,0 +1,84 @@
+package sfs_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	gitcfg "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robherley/shallow-fetch-sha/pkg/sfs"
+)
+
+// makeCheckout makes a repository with a single commit of file.txt in dir, as
+// if it was fetched from url.
+func makeCheckout(dir, url string) {
+	repo, err := git.PlainInit(dir, false)
+	plsno(err)
+	_, err = repo.CreateRemote(&gitcfg.RemoteConfig{Name: "origin", URLs: []string{url}})
+	plsno(err)
+
+	plsno(os.WriteFile(filepath.Join(dir, "file.txt"), []byte("hello\n"), 0644))
+	worktree, err := repo.Worktree()
+	plsno(err)
+	_, err = worktree.Add("file.txt")
+	plsno(err)
+	_, err = worktree.Commit("commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "sfs", Email: "sfs@example.com", When: time.Now()},
+	})
+	plsno(err)
+}
+
+var _ = Describe("Update", func() {
+	It("should fetch again into an existing checkout", func() {
+		tmpDir := makeTemp()
+		fetcher := sfs.New(sfs.WithProgress(nil))
+
+		_, err := fetcher.FetchResult(context.Background(), publicRepo.HTTPS, publicRepo.Commit, tmpDir)
+		Expect(err).To(BeNil())
+
+		// the same commit, by another url of the repo
+		res, err := fetcher.FetchResult(context.Background(), "https://github.com/robherley/fixture-public-repo", publicRepo.Commit, tmpDir)
+		Expect(err).To(BeNil())
+		Expect(res.Bytes).To(BeZero())
+		Expect(checkFiles(tmpDir, publicRepo.ExpectedFiles)).To(BeTrue())
+	})
+
+	It("should refuse to update a repository of another remote", func() {
+		dir := makeTemp()
+		makeCheckout(dir, "http://127.0.0.1:1/other.git")
+
+		_, err := sfs.New(sfs.WithProgress(nil)).Fetch("http://127.0.0.1:1/repo.git", publicRepo.Commit, dir)
+		Expect(errors.Is(err, sfs.ErrDirectoryNotEmpty)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("other.git")))
+	})
+
+	It("should refuse to update a checkout with local changes", func() {
+		dir := makeTemp()
+		makeCheckout(dir, "http://127.0.0.1:1/repo.git")
+		plsno(os.WriteFile(filepath.Join(dir, "file.txt"), []byte("changed\n"), 0644))
+
+		_, err := sfs.New(sfs.WithProgress(nil)).Fetch("http://127.0.0.1:1/repo.git", publicRepo.Commit, dir)
+		Expect(errors.Is(err, sfs.ErrDirectoryNotEmpty)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("local changes")))
+
+		contents, err := os.ReadFile(filepath.Join(dir, "file.txt"))
+		Expect(err).To(BeNil())
+		Expect(string(contents)).To(Equal("changed\n"))
+	})
+
+	It("should refuse to update a checkout with files it didn't check out", func() {
+		dir := makeTemp()
+		makeCheckout(dir, "http://127.0.0.1:1/repo.git")
+		plsno(os.WriteFile(filepath.Join(dir, "build.log"), []byte("ok\n"), 0644))
+
+		_, err := sfs.New(sfs.WithProgress(nil)).Fetch("http://127.0.0.1:1/repo.git", publicRepo.Commit, dir)
+		Expect(errors.Is(err, sfs.ErrDirectoryNotEmpty)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("build.log")))
+	})
+})